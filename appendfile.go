@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// createOutput creates the given output file, or with --append, opens it to be appended to.
+//
+// With --flush-interval, a regular file is also synced to disk periodically.
+func createOutput(ctx context.Context, filename string, align int64) (files.Writer, error) {
+	f, err := createFile(ctx, filename, align)
+	if err != nil {
+		return nil, err
+	}
+
+	return withFlush(f), nil
+}
+
+// createFile creates the given output file, or with --append, opens it to be appended to.
+//
+// If align is greater than zero, then an appended file is first truncated to a multiple of align bytes,
+// so that a partial record left at the end of the file by a crash does not corrupt the continuation.
+//
+// A local file is also appended to if it is being reopened, as marked by withReopen.
+func createFile(ctx context.Context, filename string, align int64) (files.Writer, error) {
+	if isStdoutOutput(filename) {
+		return files.Create(ctx, filename)
+	}
+
+	path, ok := localPath(filename)
+
+	switch {
+	case Flags.Append && !ok:
+		return nil, errors.Errorf("--append is only supported for local files: %s", filename)
+	case !Flags.Append && !(ok && isReopen(ctx)):
+		return files.Create(ctx, filename)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if align > 0 {
+		if partial := end % align; partial != 0 {
+			glog.Warningf("%s: truncating partial packet of %d bytes at end of file", path, partial)
+
+			end -= partial
+
+			if err := f.Truncate(end); err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			if _, err := f.Seek(end, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if end > 0 {
+		glog.Infof("%s: appending after %d bytes", path, end)
+	}
+
+	return f, nil
+}
+
+type reopenKey struct{}
+
+// withReopen returns a context.Context that marks the output as being reopened,
+// so that a local file is appended to, rather than truncated.
+func withReopen(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reopenKey{}, true)
+}
+
+func isReopen(ctx context.Context) bool {
+	reopen, _ := ctx.Value(reopenKey{}).(bool)
+	return reopen
+}
+
+// localPath returns the local filesystem path of the given filename, if it refers to one.
+func localPath(filename string) (string, bool) {
+	if filepath.IsAbs(filename) {
+		return filename, true
+	}
+
+	uri, err := url.Parse(filename)
+	if err != nil {
+		return "", false
+	}
+
+	switch uri.Scheme {
+	case "":
+		return filename, true
+
+	case "file":
+		if uri.Path != "" {
+			return uri.Path, true
+		}
+
+		return uri.Opaque, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff tracks an exponentially growing delay between consecutive reconnect failures.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	factor  float64
+
+	cur time.Duration
+}
+
+func newBackoff() *backoff {
+	initial := Flags.ReconnectInitial
+	if initial <= 0 {
+		initial = Flags.Timeout
+	}
+
+	max := Flags.ReconnectMax
+	if max < initial {
+		max = initial
+	}
+
+	factor := Flags.ReconnectFactor
+	if factor < 1 {
+		factor = 1
+	}
+
+	return &backoff{
+		initial: initial,
+		max:     max,
+		factor:  factor,
+	}
+}
+
+// Next returns the delay to wait before the next reconnect attempt, and grows the delay for the attempt after that.
+//
+// The returned delay is jittered upwards by up to a quarter (but never beyond the maximum),
+// so that many clients of the same server do not all reconnect in lockstep.
+func (b *backoff) Next() time.Duration {
+	d := b.cur
+	if d <= 0 {
+		d = b.initial
+	}
+
+	next := time.Duration(float64(d) * b.factor)
+	if next > b.max || next <= 0 {
+		next = b.max
+	}
+	b.cur = next
+
+	if quarter := int64(d / 4); quarter > 0 {
+		d += time.Duration(rand.Int63n(quarter + 1))
+	}
+
+	if d > b.max {
+		d = b.max
+	}
+
+	return d
+}
+
+// Succeeded resets the backoff to its initial delay,
+// if the connection was alive for longer than the maximum delay.
+func (b *backoff) Succeeded(alive time.Duration) {
+	if alive >= b.max {
+		b.Reset()
+	}
+}
+
+// Reset resets the backoff to its initial delay.
+func (b *backoff) Reset() {
+	b.cur = 0
+}
+
+// Restore continues the backoff from the given delay, as recorded by a previous run.
+func (b *backoff) Restore(cur time.Duration) {
+	if cur > b.max {
+		cur = b.max
+	}
+
+	b.cur = cur
+}
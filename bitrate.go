@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// minAdaptiveTimeout keeps an --adaptive-timeout on a high bitrate stream from tripping over just the usual network jitter.
+	minAdaptiveTimeout = 1 * time.Second
+
+	// defaultCopyBuffer is the size of the buffer that files.Copy uses, if it is not given one.
+	defaultCopyBuffer = 64 << 10
+)
+
+var expectedBitrate struct {
+	sync.Mutex
+	bps float64
+}
+
+// setExpectedBitrate updates the expected bitrate of the stream from its icy-br header, if it has one.
+func setExpectedBitrate(h headerer) {
+	bps, err := getIcyBitrate(h)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+
+	expectedBitrate.Lock()
+	changed := bps != expectedBitrate.bps
+	expectedBitrate.bps = bps
+	expectedBitrate.Unlock()
+
+	if changed && bps > 0 {
+		if glog.V(2) {
+			glog.Infof("expected bitrate: %v bps", bps)
+		}
+	}
+
+	icyBitrate.Set(bps)
+}
+
+// streamBitrate returns the most recent expected bitrate of the stream in bits/second, or 0 if it is not known.
+func streamBitrate() float64 {
+	expectedBitrate.Lock()
+	defer expectedBitrate.Unlock()
+
+	return expectedBitrate.bps
+}
+
+// streamTimeout returns the watchdog timeout of a copy from f, with a buffer of the given size.
+//
+// The watchdog of files.Copy expires if a whole buffer has not been read within the timeout,
+// so with --adaptive-timeout, we allow for the time that it takes to fill the buffer at the icy-br of the stream,
+// and on top of that, a gap in the data for as long as it would take to send that much more of it.
+// This gives a low bitrate stream much longer than a high bitrate one. Otherwise, or if it has no icy-br, it is --timeout.
+func streamTimeout(f files.Reader, buffer int) time.Duration {
+	if Flags.AdaptiveTimeout == (byteSize{}) {
+		return Flags.Timeout
+	}
+
+	h, ok := f.(headerer)
+	if !ok {
+		return Flags.Timeout
+	}
+
+	// A bad icy-br has already been logged by setExpectedBitrate.
+	bps, err := getIcyBitrate(h)
+	if err != nil || bps <= 0 {
+		return Flags.Timeout
+	}
+
+	if buffer <= 0 {
+		buffer = defaultCopyBuffer
+	}
+
+	gap := time.Duration(float64(Flags.AdaptiveTimeout.Bytes(bps)) * 8 / bps * float64(time.Second))
+	if gap < minAdaptiveTimeout {
+		gap = minAdaptiveTimeout
+	}
+
+	return time.Duration(float64(buffer)*8/bps*float64(time.Second)) + gap
+}
+
+// getIcyBitrate returns the icy-br value from the headers in bits/second, or 0 if the stream does not advertise one.
+func getIcyBitrate(h headerer) (float64, error) {
+	header, err := h.Header()
+	if err != nil {
+		return 0, err
+	}
+
+	val := header.Get("Icy-Br")
+	if val == "" {
+		return 0, nil
+	}
+
+	// Some servers repeat the bitrate, as in: `icy-br: 128, 128`
+	if i := strings.IndexByte(val, ','); i >= 0 {
+		val = val[:i]
+	}
+
+	kbps, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return 0, errors.Errorf("bad icy-br value: %s: %+v", val, err)
+	}
+
+	if kbps < 0 {
+		return 0, errors.Errorf("bad icy-br value: %v", kbps)
+	}
+
+	return kbps * 1000, nil
+}
+
+// ratioObserver passes observed bandwidths through to another observer,
+// and also publishes the ratio of the observed bandwidth to the expected bitrate.
+type ratioObserver struct {
+	next interface{ Observe(float64) }
+}
+
+func (o ratioObserver) Observe(bps float64) {
+	o.next.Observe(bps)
+
+	expected := streamBitrate()
+	if expected <= 0 {
+		return
+	}
+
+	bwRatio.Set(bps / expected)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/io/bufpipe"
+)
+
+// defaultBitrate is used to convert a byteSize given as a duration, when the stream does not advertise its bitrate.
+const defaultBitrate = 128000
+
+// byteSize is a flag value for a buffer size, given either as a number of bytes with an optional k, M, or G suffix,
+// or as a duration, which is converted into bytes at the bitrate of the stream.
+type byteSize struct {
+	n int
+	d time.Duration
+}
+
+func (s *byteSize) String() string {
+	if s.d != 0 {
+		return s.d.String()
+	}
+
+	return strconv.Itoa(s.n)
+}
+
+// Get implements flag.Getter.
+func (s *byteSize) Get() interface{} {
+	return *s
+}
+
+var byteScales = map[byte]int{
+	'k': 1 << 10,
+	'K': 1 << 10,
+	'm': 1 << 20,
+	'M': 1 << 20,
+	'g': 1 << 30,
+	'G': 1 << 30,
+}
+
+// Set implements flag.Value.
+func (s *byteSize) Set(val string) error {
+	val = strings.TrimSpace(val)
+
+	if d, err := time.ParseDuration(val); err == nil {
+		if d < 0 {
+			return errors.Errorf("negative size: %s", val)
+		}
+
+		*s = byteSize{d: d}
+		return nil
+	}
+
+	num, scale := val, 1
+	if l := len(val); l > 0 {
+		if sc, ok := byteScales[val[l-1]]; ok {
+			num, scale = val[:l-1], sc
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 0, strconv.IntSize)
+	if err != nil {
+		return err
+	}
+
+	if n < 0 {
+		return errors.Errorf("negative size: %s", val)
+	}
+
+	if n > math.MaxInt/int64(scale) {
+		return errors.Errorf("size too large: %s", val)
+	}
+
+	*s = byteSize{n: int(n) * scale}
+	return nil
+}
+
+// Bytes returns the size in bytes, converting a duration at the given bitrate in bits/second.
+func (s *byteSize) Bytes(bps float64) int {
+	if s.d == 0 {
+		return s.n
+	}
+
+	if bps <= 0 {
+		bps = defaultBitrate
+	}
+
+	return int(s.d.Seconds() * bps / 8)
+}
+
+// loopMaxBuffer is the --max-buffer used with --loop, if none is given.
+const loopMaxBuffer = 1 << 20
+
+// maxBufferOptions returns the bufpipe options that enforce the --max-buffer limit, if any.
+func maxBufferOptions() []bufpipe.Option {
+	max := Flags.MaxBuffer.Bytes(streamBitrate())
+	if max <= 0 && Flags.Loop {
+		// A --loop source never ends, and a local file is read far faster than it is played out,
+		// so without a limit, it would go on filling the buffer until we run out of memory.
+		max = loopMaxBuffer
+	}
+
+	if max <= 0 {
+		return nil
+	}
+
+	return []bufpipe.Option{
+		bufpipe.WithMaxOutstanding(max),
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		val     string
+		n       int
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"4096", 4096, false},
+		{"64k", 64 << 10, false},
+		{"2M", 2 << 20, false},
+		{"1G", 1 << 30, false},
+		{"0x10k", 16 << 10, false},
+		{"-1", 0, true},
+		{"-1k", 0, true},
+		{"many", 0, true},
+		{strconv.Itoa(math.MaxInt), math.MaxInt, false},
+		{strconv.Itoa(math.MaxInt/(1<<10)) + "k", math.MaxInt / (1 << 10) * (1 << 10), false},
+		{strconv.Itoa(math.MaxInt/(1<<10)+1) + "k", 0, true},
+		{strconv.Itoa(math.MaxInt/(1<<30)+1) + "G", 0, true},
+	}
+
+	for _, tt := range tests {
+		var s byteSize
+
+		err := s.Set(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, expected error: %v", tt.val, err, tt.wantErr)
+			continue
+		}
+
+		if got := s.Bytes(0); got != tt.n {
+			t.Errorf("Set(%q) = %d bytes, expected %d", tt.val, got, tt.n)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+)
+
+// closeWaiter is an io.WriteCloser whose Close does not return until done is closed.
+//
+// It is used for outputs that finish writing in the background after they are closed,
+// so that we do not exit before they have been completely flushed.
+type closeWaiter struct {
+	io.WriteCloser
+
+	done <-chan struct{}
+}
+
+func (w *closeWaiter) Close() error {
+	err := w.WriteCloser.Close()
+
+	<-w.done
+
+	return err
+}
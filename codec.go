@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+// sniffSize is how much of the start of the stream we look at to decide what codec it uses.
+const sniffSize = 4
+
+// Stream types that the ts package does not define.
+const (
+	// programTypeMPEG2Audio is the stream_type for ISO/IEC 13818-3 audio.
+	programTypeMPEG2Audio ts.ProgramType = 0x04
+
+	// programTypeAACLATM is the stream_type for ISO/IEC 14496-3 audio, with the LATM transport syntax.
+	programTypeAACLATM ts.ProgramType = 0x11
+)
+
+// aacSampleRates are the sampling frequencies indexed by the sampling_frequency_index of an ADTS header.
+var aacSampleRates = [13]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacProfiles are the names of the profiles indexed by the profile of an ADTS header, which is the audio object type minus one.
+var aacProfiles = [4]string{"Main", "LC", "SSR", "LTP"}
+
+var magicOgg = []byte("OggS")
+
+var detectedCodec struct {
+	sync.Mutex
+	typ ts.ProgramType
+}
+
+// setStreamCodec records the stream_type that was detected for the stream.
+func setStreamCodec(typ ts.ProgramType) {
+	detectedCodec.Lock()
+	defer detectedCodec.Unlock()
+
+	detectedCodec.typ = typ
+}
+
+// streamCodec returns the stream_type that was most recently detected for the stream, or 0 if it is not known yet.
+func streamCodec() ts.ProgramType {
+	detectedCodec.Lock()
+	defer detectedCodec.Unlock()
+
+	return detectedCodec.typ
+}
+
+// isOgg returns true if the given start of a stream is an Ogg bitstream, which cannot be muxed into an MPEG-TS.
+func isOgg(b []byte) bool {
+	return bytes.HasPrefix(b, magicOgg)
+}
+
+// detectStreamType returns the MPEG-TS stream_type to use for a stream starting with the given frame header.
+func detectStreamType(b []byte) (ts.ProgramType, error) {
+	if isLOAS(b) {
+		return programTypeAACLATM, nil
+	}
+
+	// MPEG audio has an 11-bit sync word of all ones, and ADTS uses the first 12 bits of the same header.
+	if len(b) < 2 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return 0, errors.New("unrecognized frame header")
+	}
+
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+
+	switch {
+	case layer == 0 && b[1]&0xF0 == 0xF0:
+		// ADTS always has a layer of zero, which is reserved in MPEG audio.
+		return ts.ProgramTypeAAC, nil
+
+	case layer == 0:
+		// Layer zero is reserved in MPEG audio, and we could not have gotten here for ADTS.
+
+	case version == 3: // MPEG-1
+		return ts.ProgramTypeAudio, nil
+
+	case version == 2, version == 0: // MPEG-2, and MPEG-2.5
+		return programTypeMPEG2Audio, nil
+	}
+
+	return 0, errors.Errorf("bad MPEG audio header: % X", b[:2])
+}
+
+// codecName returns a human readable name for the given stream_type.
+func codecName(typ ts.ProgramType) string {
+	switch typ {
+	case ts.ProgramTypeAudio:
+		return "MPEG-1 audio"
+	case programTypeMPEG2Audio:
+		return "MPEG-2 audio"
+	case ts.ProgramTypeAAC:
+		return "AAC (ADTS)"
+	case programTypeAACLATM:
+		return "AAC (LATM)"
+	}
+
+	return "unknown"
+}
+
+// describeFrame returns a human readable description of the audio parameters in the given frame header.
+//
+// Only ADTS headers are described, since those are what downstream players most often get wrong,
+// while the configuration of a LATM stream is carried in-band, and MPEG audio is rarely misidentified.
+// It returns an empty string, if the parameters are not known.
+func describeFrame(typ ts.ProgramType, b []byte) string {
+	if typ != ts.ProgramTypeAAC || len(b) < maxFrameHeader {
+		return ""
+	}
+
+	profile := aacProfiles[b[2]>>6]
+
+	srIndex := (b[2] >> 2) & 0x0F
+	if int(srIndex) >= len(aacSampleRates) {
+		return ""
+	}
+
+	var channels string
+	switch config := (b[2]&0x01)<<2 | b[3]>>6; config {
+	case 0:
+		// The channel configuration is given in-band, in a program_config_element.
+		channels = "in-band channel config"
+	case 7:
+		channels = "7.1 channels"
+	default:
+		channels = fmt.Sprintf("%d channels", config)
+	}
+
+	return fmt.Sprintf("%s, %d Hz, %s", profile, aacSampleRates[srIndex], channels)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+	flag "github.com/puellanivis/breton/lib/gnuflag"
+)
+
+// loadConfig sets flags from the given TOML file.
+//
+// Each key is the long name of a flag, with either dashes or underscores, such as:
+//
+//	output = ["mpegts:udp://239.0.0.1:1234", "recording.ts"]
+//	metrics-port = 9090
+//	user_agent = "icycat/2.0"
+//	max-retries = 5
+//
+// Only flat key/value pairs are supported: no tables, and arrays must be on one line.
+// Flags that were given on the command line are left as they are, so that the command line overrides the file.
+// Unknown keys only warn, so that one config file can be shared between versions of icycat.
+func loadConfig(ctx context.Context, filename string) error {
+	b, err := files.Read(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+
+	// Once we are into a table, none of the keys are flags anymore.
+	var table string
+
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			table = line
+			glog.Warningf("%s:%d: tables are not supported, ignoring: %s", filename, lineno, table)
+			continue
+		}
+
+		if table != "" {
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return errors.Errorf("%s:%d: expected key = value", filename, lineno)
+		}
+
+		key := strings.TrimSpace(line[:i])
+		name := strings.ReplaceAll(strings.Trim(key, `"`), "_", "-")
+
+		values, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return errors.Errorf("%s:%d: %s: %+v", filename, lineno, key, err)
+		}
+
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			glog.Warningf("%s:%d: unknown key: %s", filename, lineno, key)
+			continue
+		}
+
+		if given[f.Name] {
+			continue
+		}
+
+		for _, value := range values {
+			if err := flag.Set(f.Name, value); err != nil {
+				return errors.Errorf("%s:%d: %s: %+v", filename, lineno, key, err)
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+// stripComment removes any # comment from the line, unless it is inside of a string.
+func stripComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+
+		case c == '"' || c == '\'':
+			quote = c
+
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// parseConfigValue returns the flag values of a TOML value, which is more than one, if it is an array.
+func parseConfigValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if rest != "" {
+			return nil, errors.Errorf("unexpected: %s", rest)
+		}
+
+		return []string{v}, nil
+	}
+
+	if !strings.HasSuffix(s, "]") {
+		return nil, errors.New("unterminated array")
+	}
+
+	s = strings.TrimSpace(s[1 : len(s)-1])
+
+	var values []string
+
+	for s != "" {
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+
+		if rest != "" && rest[0] != ',' {
+			return nil, errors.Errorf("expected comma: %s", rest)
+		}
+
+		s = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+
+	return values, nil
+}
+
+// parseConfigScalar parses one string, number or boolean from the start of s, and returns the remainder.
+func parseConfigScalar(s string) (v, rest string, err error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("missing value")
+
+	case s[0] == '\'':
+		// literal strings have no escapes.
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), nil
+
+	case s[0] == '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+
+		if end >= len(s) {
+			return "", "", errors.New("unterminated string")
+		}
+
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", err
+		}
+
+		return v, strings.TrimSpace(s[end+1:]), nil
+	}
+
+	end := strings.IndexAny(s, ", \t")
+	if end < 0 {
+		end = len(s)
+	}
+
+	v, rest = s[:end], strings.TrimSpace(s[end:])
+
+	// TOML allows underscores between digits, but our flags do not.
+	if strings.IndexAny(v[:1], "+-0123456789") == 0 {
+		v = strings.ReplaceAll(v, "_", "")
+	}
+
+	return v, rest, nil
+}
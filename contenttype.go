@@ -0,0 +1,140 @@
+package main
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/metrics"
+)
+
+var badContentTypes = metrics.Counter("bad_content_type_total", "number of times a connection to the input stream has been refused for its Content-Type")
+
+// defaultContentTypes are the Content-Types accepted when --accept-content-type is not given.
+var defaultContentTypes = []string{
+	"audio/*",
+	"application/ogg",
+	"video/mp2t",
+	"video/mpeg",
+}
+
+// preferredCodecTypes are the Content-Types that each --prefer-codec asks the stream for, in order of preference.
+var preferredCodecTypes = map[string][]string{
+	"aac":  {"audio/aac", "audio/aacp", "audio/x-aac"},
+	"mp3":  {"audio/mpeg", "audio/mp3"},
+	"ogg":  {"application/ogg", "audio/ogg"},
+	"opus": {"audio/ogg; codecs=opus", "audio/opus"},
+}
+
+// validatePreferCodec checks that --prefer-codec is one that we know the Content-Types of.
+func validatePreferCodec() error {
+	if Flags.PreferCodec == "" {
+		return nil
+	}
+
+	if _, ok := preferredCodecTypes[strings.ToLower(Flags.PreferCodec)]; !ok {
+		return errors.Errorf("unknown --prefer-codec: %q: must be one of aac, mp3, ogg, or opus", Flags.PreferCodec)
+	}
+
+	return nil
+}
+
+// acceptHeader returns the Accept header to send for --prefer-codec, or "" if it is not set.
+//
+// Anything else is still accepted, at a lower quality, because a server that cannot send the preferred codec
+// should send us whatever it has, rather than a 406 Not Acceptable.
+func acceptHeader() string {
+	types := preferredCodecTypes[strings.ToLower(Flags.PreferCodec)]
+	if len(types) < 1 {
+		return ""
+	}
+
+	return strings.Join(types, ", ") + ", audio/*;q=0.5, */*;q=0.1"
+}
+
+// checkPreferredCodec logs if the stream did not send us the --prefer-codec, which is not an error,
+// since it is entirely up to the server whether it offers any other variants at all.
+func checkPreferredCodec(h headerer) {
+	types := preferredCodecTypes[strings.ToLower(Flags.PreferCodec)]
+	if len(types) < 1 {
+		return
+	}
+
+	header, err := h.Header()
+	if err != nil {
+		return
+	}
+
+	typ, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	typ = strings.ToLower(typ)
+
+	for _, pref := range types {
+		if pref, _, err := mime.ParseMediaType(pref); err == nil && typ == pref {
+			return
+		}
+	}
+
+	if glog.V(1) {
+		glog.Infof("stream sent %s, rather than the --prefer-codec %s", typ, Flags.PreferCodec)
+	}
+}
+
+// matchContentType returns true if the media type matches the pattern, which may end in /* to match any subtype.
+func matchContentType(typ, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(typ, prefix)
+	}
+
+	return typ == pattern
+}
+
+// checkContentType returns an error if the stream has a Content-Type that is not accepted,
+// such as the text/html of an error page, which we would otherwise record as if it were audio.
+//
+// A stream without a Content-Type is accepted, since some older servers do not send one.
+func checkContentType(h headerer) error {
+	header, err := h.Header()
+	if err != nil {
+		return err
+	}
+
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		if glog.V(1) {
+			glog.Info("stream has no Content-Type")
+		}
+		return nil
+	}
+
+	typ, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		badContentTypes.Inc()
+		return errors.Errorf("bad Content-Type: %q: %+v", ct, err)
+	}
+	typ = strings.ToLower(typ)
+
+	if playlistTypes[typ] {
+		return nil
+	}
+
+	accept := Flags.AcceptContentType
+	if len(accept) < 1 {
+		accept = defaultContentTypes
+	}
+
+	for _, pattern := range accept {
+		if matchContentType(typ, pattern) {
+			return nil
+		}
+	}
+
+	badContentTypes.Inc()
+	return errors.Errorf("refusing Content-Type: %q", ct)
+}
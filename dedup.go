@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// dedupSummaryInterval is how often a summary of an ongoing run of repeated errors is logged.
+const dedupSummaryInterval = 5 * time.Minute
+
+// dedupLogger coalesces repeated identical errors, so that a long outage does not flood the logs.
+//
+// The first of a run of identical errors is logged right away, and the repeats after it are only counted.
+// They are summarized once a different error is logged, or Reset is called,
+// and at least every dedupSummaryInterval while the run goes on, so that an ongoing outage is still visibly ongoing.
+type dedupLogger struct {
+	mu sync.Mutex
+
+	last    string
+	since   time.Time
+	repeats int
+}
+
+// Errorf logs the error, unless it is the same as the last one, in which case it is only counted.
+func (d *dedupLogger) Errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msg == d.last {
+		d.repeats++
+
+		if time.Since(d.since) >= dedupSummaryInterval {
+			d.summarize(2)
+		}
+
+		return
+	}
+
+	d.summarize(2)
+
+	d.last = msg
+	d.since = time.Now()
+
+	glog.ErrorDepth(1, msg)
+}
+
+// Reset summarizes any repeats of the last error, and forgets it, so that the next error is logged even if it is the same.
+// It should be called once the operation that was failing has succeeded.
+func (d *dedupLogger) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.summarize(2)
+	d.last = ""
+}
+
+// summarize logs how many times the last error has been repeated, if at all, and starts counting again.
+//
+// Caller MUST hold the lock.
+func (d *dedupLogger) summarize(depth int) {
+	if d.repeats > 0 {
+		glog.ErrorDepth(depth, fmt.Sprintf("last error repeated %d times in %v", d.repeats, time.Since(d.since).Round(time.Second)))
+	}
+
+	d.since = time.Now()
+	d.repeats = 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// dryRun checks that each of the given outputs is writable, and that each of the given streams can be connected to,
+// without transferring any data.
+func dryRun(ctx context.Context, outputs, filenames []string) error {
+	if len(outputs) < 1 {
+		outputs = []string{""}
+	}
+
+	var failed int
+
+	if err := validateStdout(outputs); err != nil {
+		glog.Errorf("dry-run: %+v", err)
+		failed++
+	}
+
+	for _, output := range outputs {
+		if err := checkOutput(ctx, output); err != nil {
+			glog.Errorf("dry-run: output %q: %+v", output, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("output ok: %s\n", output)
+	}
+
+	for _, filename := range filenames {
+		if err := checkStream(ctx, filename); err != nil {
+			glog.Errorf("dry-run: %+v", err)
+			failed++
+		}
+	}
+
+	if total := len(outputs) + len(filenames); failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, total)
+	}
+
+	return nil
+}
+
+// checkOutput checks that the given output could be opened.
+//
+// Local files are not created, because that would truncate any existing recording,
+// so instead we check that we can create a file in the directory that it would be written to.
+func checkOutput(ctx context.Context, filename string) error {
+	name := strings.TrimPrefix(filename, "mpegts:")
+
+	isHLS := isHLSOutput(name)
+	if isHLS {
+		w, err := newHLSWriter(name)
+		if err != nil {
+			return err
+		}
+
+		name = w.Name()
+	}
+
+	if isHLS || strings.HasPrefix(filename, "mpegts:") {
+		if err := validateTSFlags(); err != nil {
+			return err
+		}
+	}
+
+	if isStdoutOutput(name) {
+		return nil
+	}
+
+	if path, ok := localPath(name); ok && !isSocketOutput(name) {
+		dir := filepath.Dir(path)
+		if isRotatingOutput(name) {
+			dir = filepath.Dir(strftime(path, time.Now()))
+		}
+
+		f, err := os.CreateTemp(dir, ".icycat-dry-run-*")
+		if err != nil {
+			return err
+		}
+
+		f.Close()
+		return os.Remove(f.Name())
+	}
+
+	out, _, err := openOutput(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// checkStream connects once to the given stream, and logs its ICY headers.
+func checkStream(ctx context.Context, filename string) error {
+	sources := newSourceSet([]string{filename})
+
+	f, err := sources.Open(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, src := sources.Current()
+
+	if h, ok := f.(headerer); ok {
+		header, err := h.Header()
+		if err != nil {
+			return errors.Errorf("%s: %+v", src.Name(), err)
+		}
+
+		if len(icyHeaderKeys(header)) < 1 {
+			glog.Warningf("dry-run: %s: no ICY headers", src.Name())
+		}
+
+		printIcyHeaders(h)
+	}
+
+	fmt.Printf("stream ok: %s\n", src.Name())
+
+	return nil
+}
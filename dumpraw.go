@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// rawDumpQueue is how many reads from the stream may be waiting to be written to the --dump-raw file,
+// before we start dropping them.
+const rawDumpQueue = 256
+
+// rawDump is the --dump-raw file, if there is one.
+var rawDump *rawDumper
+
+// rawDumper saves the bytes of the stream exactly as they were read from the server, for --dump-raw.
+//
+// Writes never fail or block, so that a slow disk cannot stall the stream:
+// they are queued up to be written in the background, and if the queue is full, they are dropped, with a warning.
+type rawDumper struct {
+	name string
+	f    files.Writer
+
+	ch   chan []byte
+	done chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	dropping bool
+	dropped  int64
+}
+
+func openRawDump(ctx context.Context, filename string) (*rawDumper, error) {
+	f, err := files.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &rawDumper{
+		name: f.Name(),
+		f:    f,
+		ch:   make(chan []byte, rawDumpQueue),
+		done: make(chan struct{}),
+	}
+
+	go d.run()
+
+	glog.Infof("--dump-raw: %s", d.name)
+
+	return d, nil
+}
+
+// run writes out everything queued up, until the queue is closed.
+// After a write error, everything else is simply discarded.
+func (d *rawDumper) run() {
+	defer close(d.done)
+
+	var failed bool
+
+	for b := range d.ch {
+		if failed {
+			continue
+		}
+
+		if _, err := d.f.Write(b); err != nil {
+			// If Close gave up on us, then it has already said so.
+			if !errors.Is(err, os.ErrClosed) {
+				glog.Errorf("--dump-raw: %s: %+v", d.name, err)
+			}
+			failed = true
+		}
+	}
+}
+
+func (d *rawDumper) Write(b []byte) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return len(b), nil
+	}
+
+	// The stream reuses b, as soon as we return.
+	buf := append([]byte(nil), b...)
+
+	select {
+	case d.ch <- buf:
+		if d.dropping {
+			glog.Warningf("--dump-raw: %s: caught up, after dropping %d bytes", d.name, d.dropped)
+			d.dropping = false
+		}
+
+	default:
+		if !d.dropping {
+			glog.Warningf("--dump-raw: %s: cannot keep up with the stream, dropping data", d.name)
+			d.dropping = true
+			d.dropped = 0
+		}
+
+		d.dropped += int64(len(b))
+	}
+
+	return len(b), nil
+}
+
+// Close waits for everything queued up to be written out, and then closes the file.
+//
+// The wait is bounded by --shutdown-timeout, since the very same slow disk could otherwise hold up the exit forever.
+func (d *rawDumper) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.ch)
+	}
+	d.mu.Unlock()
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		glog.Warningf("--dump-raw: %s: gave up waiting for the rest of the stream to be written out", d.name)
+	}
+
+	return d.f.Close()
+}
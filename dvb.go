@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+	"github.com/puellanivis/breton/lib/mpeg/ts/dvb"
+	"github.com/puellanivis/breton/lib/mpeg/ts/psi"
+)
+
+const (
+	// maxServiceNames is how much of the 255 bytes of a service_descriptor the provider and service names can take up together,
+	// after its service_type, and the lengths of each of the names.
+	maxServiceNames = 255 - 3
+
+	// The ts.Mux sends the whole SDT in a single packet, so all of the names have to fit in that,
+	// beside the pointer_field, the section header and syntax, the original_network_id, and the CRC_32,
+	// and for each service, its entry in the service loop, and the rest of its service_descriptor.
+	maxSDTPayload   = ts.PacketSize - 4
+	sdtOverhead     = 1 + 3 + 5 + 3 + 4
+	serviceOverhead = 5 + 2 + 3
+)
+
+// dvbServiceInfo is the DVB service carried by one program.
+type dvbServiceInfo struct {
+	desc  *dvb.ServiceDescriptor
+	title string
+}
+
+var dvbService struct {
+	sync.Mutex
+
+	muxes []*ts.Mux
+
+	// services is indexed by program, and with --multi-program, there is one for each stream.
+	services []dvbServiceInfo
+	version  uint8
+}
+
+// dvbServiceID returns the service_id of the DVB service carried by the index'th program.
+func dvbServiceID(index int) uint16 {
+	if Flags.DVBServiceID != 0 {
+		return Flags.DVBServiceID + uint16(index)
+	}
+
+	// The service_id is the program_number of the program in the PAT that carries the service.
+	return tsProgramNumber(index)
+}
+
+// addMux registers a ts.Mux to receive the DVB SDT.
+func addMux(mux *ts.Mux) {
+	dvbService.Lock()
+	defer dvbService.Unlock()
+
+	dvbService.muxes = append(dvbService.muxes, mux)
+
+	setDVBSDT()
+}
+
+// removeMux stops sending the DVB SDT to a ts.Mux that has been torn down.
+func removeMux(mux *ts.Mux) {
+	dvbService.Lock()
+	defer dvbService.Unlock()
+
+	for i, m := range dvbService.muxes {
+		if m == mux {
+			dvbService.muxes = append(dvbService.muxes[:i], dvbService.muxes[i+1:]...)
+			return
+		}
+	}
+}
+
+// dvbProgramService returns the service of the index'th program, adding it if necessary.
+//
+// Caller MUST hold the dvbService lock.
+func dvbProgramService(index int) *dvbServiceInfo {
+	for len(dvbService.services) <= index {
+		dvbService.services = append(dvbService.services, dvbServiceInfo{})
+	}
+
+	return &dvbService.services[index]
+}
+
+// DVBService sets the dvb.ServiceDescriptor to be used by the muxer.
+//
+// It may be called repeatedly, and each call replaces the SDT being sent by the muxer,
+// without otherwise interrupting the stream.
+func DVBService(desc *dvb.ServiceDescriptor) {
+	DVBProgramService(0, desc)
+}
+
+// DVBProgramService sets the dvb.ServiceDescriptor of the service carried by the index'th program, as with DVBService.
+func DVBProgramService(index int, desc *dvb.ServiceDescriptor) {
+	dvbService.Lock()
+	defer dvbService.Unlock()
+
+	dvbProgramService(index).desc = desc
+
+	setDVBSDT()
+}
+
+// DVBServiceName returns the name of the current DVB service, without any StreamTitle.
+func DVBServiceName() string {
+	dvbService.Lock()
+	defer dvbService.Unlock()
+
+	if len(dvbService.services) < 1 || dvbService.services[0].desc == nil {
+		return ""
+	}
+
+	return dvbService.services[0].desc.Name
+}
+
+// DVBServiceTitle updates the DVB service name to include the given ICY StreamTitle.
+func DVBServiceTitle(title string) {
+	DVBProgramTitle(0, title)
+}
+
+// DVBProgramTitle updates the name of the service carried by the index'th program to include the given ICY StreamTitle.
+func DVBProgramTitle(index int, title string) {
+	dvbService.Lock()
+	defer dvbService.Unlock()
+
+	service := dvbProgramService(index)
+	if service.title == title {
+		return
+	}
+
+	service.title = title
+
+	setDVBSDT()
+}
+
+// setDVBSDT builds a new SDT, and pushes it into the muxer.
+//
+// Caller MUST hold the dvbService lock.
+func setDVBSDT() {
+	if len(dvbService.muxes) < 1 {
+		return
+	}
+
+	var services []*dvb.Service
+	var descs []*dvb.ServiceDescriptor
+
+	for i, info := range dvbService.services {
+		if info.desc == nil {
+			continue
+		}
+
+		desc := *info.desc
+		if info.title != "" {
+			desc.Name = fmt.Sprintf("%s: %s", desc.Name, info.title)
+		}
+
+		service := &dvb.Service{
+			ID: dvbServiceID(i),
+		}
+		service.Descriptors = append(service.Descriptors, &desc)
+
+		services = append(services, service)
+		descs = append(descs, &desc)
+	}
+
+	if len(services) < 1 {
+		return
+	}
+
+	// Otherwise, the SDT fails to marshal, and the ts.Mux drops it altogether, or worse, fails to send its preamble.
+	budget := (maxSDTPayload-sdtOverhead)/len(services) - serviceOverhead
+	if budget > maxServiceNames {
+		budget = maxServiceNames
+	}
+	if budget < 0 {
+		budget = 0
+	}
+
+	for _, desc := range descs {
+		desc.Provider = truncateText(desc.Provider, budget)
+		desc.Name = truncateText(desc.Name, budget-len(desc.Provider))
+	}
+
+	sdt := &dvb.ServiceDescriptorTable{
+		Syntax: &psi.SectionSyntax{
+			TableIDExtension: 1,
+			// Receivers only reparse the SDT if the version changes.
+			Version: dvbService.version,
+			Current: true,
+		},
+		OriginalNetworkID: Flags.DVBONID,
+		Services:          services,
+	}
+	for _, mux := range dvbService.muxes {
+		mux.SetDVBSDT(sdt)
+	}
+
+	// version_number is only 5-bits wide.
+	dvbService.version = (dvbService.version + 1) & 0x1F
+
+	switch {
+	case glog.V(5) == true:
+		glog.Infof("dvb.sdt: %v", sdt)
+
+	case glog.V(2) == true:
+		for _, desc := range descs {
+			glog.Infof("DVB Service Description: %v", desc)
+		}
+	}
+}
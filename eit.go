@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+const (
+	// pidEIT is the fixed PID of the DVB Event Information Table.
+	pidEIT = 0x0012
+
+	// tableEITPresentFollowing is the table_id of the EIT present/following of the actual transport stream.
+	tableEITPresentFollowing = 0x4E
+
+	tagShortEvent    = 0x4D
+	tagExtendedEvent = 0x4E
+	tagContent       = 0x54
+
+	runningStatusRunning = 4
+
+	// maxEventName keeps the short_event_descriptor well within its 255 bytes.
+	maxEventName = 128
+
+	// maxEventURL keeps the extended_event_descriptor within its 255 bytes.
+	maxEventURL = 240
+)
+
+var dvbEvent struct {
+	sync.Mutex
+
+	title   string
+	genre   string
+	url     string
+	start   time.Time
+	id      uint16
+	version uint8
+
+	sections [][]byte
+}
+
+// DVBEventTitle starts a new DVB event in the EIT, named with the given ICY StreamTitle.
+func DVBEventTitle(title string) {
+	dvbEvent.Lock()
+	defer dvbEvent.Unlock()
+
+	if dvbEvent.sections != nil && dvbEvent.title == title {
+		return
+	}
+
+	dvbEvent.title = title
+	dvbEvent.start = time.Now()
+	dvbEvent.id++
+
+	setEITSections()
+
+	if glog.V(2) {
+		glog.Infof("DVB Event: %d: %q", dvbEvent.id, title)
+	}
+}
+
+// DVBEventInfo sets the icy-genre and icy-url of the stream, which are described in every DVB event of the EIT.
+//
+// The current event is updated in place, since it is still the same event, just described differently.
+func DVBEventInfo(genre, url string) {
+	dvbEvent.Lock()
+	defer dvbEvent.Unlock()
+
+	if dvbEvent.genre == genre && dvbEvent.url == url {
+		return
+	}
+
+	dvbEvent.genre = genre
+	dvbEvent.url = url
+
+	if dvbEvent.sections == nil {
+		// There is no event yet, so the first StreamTitle will pick these up.
+		return
+	}
+
+	setEITSections()
+
+	if glog.V(2) {
+		glog.Infof("DVB Event: %d: genre %q, url %q", dvbEvent.id, genre, url)
+	}
+}
+
+// setEventInfo describes the DVB events with the icy-genre and icy-url of the stream that we are currently copying.
+func setEventInfo(h headerer) {
+	header, err := h.Header()
+	if err != nil {
+		return
+	}
+
+	DVBEventInfo(header.Get("Icy-Genre"), header.Get("Icy-Url"))
+}
+
+// setEITSections rebuilds the sections of the EIT, with a new version_number.
+//
+// Caller MUST hold the dvbEvent lock.
+func setEITSections() {
+	var sections [][]byte
+	for i := byte(0); i < 2; i++ {
+		sections = append(sections, eitSection(i))
+	}
+
+	dvbEvent.sections = sections
+
+	// version_number is only 5-bits wide.
+	dvbEvent.version = (dvbEvent.version + 1) & 0x1F
+}
+
+// eitSections returns the present and following sections of the current EIT, or nil if there is no event yet.
+func eitSections() [][]byte {
+	dvbEvent.Lock()
+	defer dvbEvent.Unlock()
+
+	return dvbEvent.sections
+}
+
+// eitSection builds the given section of the EIT present/following:
+// section 0 is the present event, and section 1 is the following event, which we never know.
+//
+// Caller MUST hold the dvbEvent lock.
+func eitSection(number byte) []byte {
+	// Only the service of the first program follows the StreamTitle in --metadata-file and the like, so it is the only one with events.
+	id := dvbServiceID(0)
+
+	b := []byte{
+		tableEITPresentFollowing,
+		0, 0, // section_syntax_indicator, and section_length, filled in below.
+		byte(id >> 8), byte(id),
+		0xC0 | dvbEvent.version<<1 | 0x01, // current_next_indicator
+		number,
+		1,    // last_section_number
+		0, 1, // transport_stream_id, the same as in the PAT and SDT.
+		byte(Flags.DVBONID >> 8), byte(Flags.DVBONID),
+		1, // segment_last_section_number
+		tableEITPresentFollowing,
+	}
+
+	if number == 0 {
+		b = append(b, eitEvent(dvbEvent.id, dvbEvent.start, dvbEvent.title, dvbEvent.genre, dvbEvent.url)...)
+	}
+
+	// section_length counts everything after itself, including the CRC32.
+	l := len(b) - 3 + 4
+	b[1] = 0xF0 | byte(l>>8)&0x0F
+	b[2] = byte(l)
+
+	return binary.BigEndian.AppendUint32(b, crc32MPEG2(b))
+}
+
+// eitEvent builds a single event of the EIT, with a short_event_descriptor naming it,
+// a content_descriptor of its genre, and an extended_event_descriptor with the URL of the station, if there is one.
+func eitEvent(id uint16, start time.Time, name, genre, url string) []byte {
+	name = dvbText(name, maxEventName)
+
+	desc := []byte{
+		tagShortEvent,
+		byte(3 + 1 + len(name) + 1),
+		'u', 'n', 'd', // ISO_639_language_code: undetermined
+		byte(len(name)),
+	}
+	desc = append(desc, name...)
+	desc = append(desc, 0) // text_length
+
+	if content := dvbContent(genre); len(content) > 0 {
+		desc = append(desc, tagContent, byte(2*len(content)))
+		for _, nibbles := range content {
+			desc = append(desc, nibbles, 0) // user_byte
+		}
+	}
+
+	if url != "" {
+		item := "URL"
+		url = dvbText(url, maxEventURL)
+
+		items := []byte{byte(len(item))}
+		items = append(items, item...)
+		items = append(items, byte(len(url)))
+		items = append(items, url...)
+
+		desc = append(desc,
+			tagExtendedEvent,
+			byte(1+3+1+len(items)+1),
+			0x00, // descriptor_number, and last_descriptor_number: this is the only one.
+			'u', 'n', 'd',
+			byte(len(items)),
+		)
+		desc = append(desc, items...)
+		desc = append(desc, 0) // text_length
+	}
+
+	b := []byte{byte(id >> 8), byte(id)}
+	b = append(b, dvbTime(start)...)
+
+	// The duration is not known, so we mark it as undefined, in the same way as an undefined start_time.
+	b = append(b, 0xFF, 0xFF, 0xFF)
+
+	// running_status, free_CA_mode = 0, and descriptors_loop_length.
+	b = append(b, runningStatusRunning<<5|byte(len(desc)>>8)&0x0F, byte(len(desc)))
+
+	return append(b, desc...)
+}
+
+// dvbTime encodes t as a DVB UTC time: a 16-bit Modified Julian Date, followed by 6 BCD digits of hours, minutes, and seconds.
+func dvbTime(t time.Time) []byte {
+	t = t.UTC()
+
+	// The Unix epoch is MJD 40587.
+	mjd := 40587 + t.Unix()/86400
+
+	bcd := func(n int) byte {
+		return byte(n/10<<4 | n%10)
+	}
+
+	return []byte{byte(mjd >> 8), byte(mjd), bcd(t.Hour()), bcd(t.Minute()), bcd(t.Second())}
+}
+
+// dvbText encodes s as a DVB string of at most max bytes.
+//
+// Plain ASCII is the same in the default DVB character table, anything else is sent as UTF-8, which has to be marked as such.
+func dvbText(s string, max int) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+
+	if !ascii {
+		s = "\x15" + s
+	}
+
+	return truncateText(s, max)
+}
+
+// truncateText cuts s down to at most max bytes, without cutting a UTF-8 character in half.
+func truncateText(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	// Back up to the start of the character that would be cut.
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+
+	return s[:max]
+}
+
+// eitWriter sits between a ts.Mux and its sink, and sends the EIT right after every PAT,
+// so that it goes out with the same regularity as the rest of the PSI preamble.
+type eitWriter struct {
+	namedWriteCloser
+
+	mu         sync.Mutex
+	continuity byte
+
+	pkt [ts.PacketSize]byte
+}
+
+func newEITWriter(w namedWriteCloser) *eitWriter {
+	return &eitWriter{
+		namedWriteCloser: w,
+	}
+}
+
+func (w *eitWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for off := 0; off+ts.PacketSize <= len(b); off += ts.PacketSize {
+		if getPID(b[off+1:]) != pidPAT {
+			continue
+		}
+
+		// Write everything up to and including the PAT, and then the EIT.
+		end := off + ts.PacketSize
+
+		m, err := w.namedWriteCloser.Write(b[n:end])
+		n += m
+		if err != nil {
+			return n, err
+		}
+
+		if err := w.writeEIT(); err != nil {
+			return n, err
+		}
+	}
+
+	if n < len(b) {
+		m, err := w.namedWriteCloser.Write(b[n:])
+		return n + m, err
+	}
+
+	return n, nil
+}
+
+// writeEIT writes each of the EIT sections starting in its own packet,
+// continuing on into as many more packets as it takes to carry the rest of it.
+//
+// Caller MUST hold the lock.
+func (w *eitWriter) writeEIT() error {
+	for _, sec := range eitSections() {
+		for start := true; start || len(sec) > 0; start = false {
+			pkt := w.pkt[:]
+
+			pkt[0] = 0x47
+			pkt[1] = byte(pidEIT>>8) & 0x1F
+			pkt[2] = byte(pidEIT)
+			pkt[3] = 0x10 | w.continuity // payload only
+
+			payload := pkt[4:]
+			if start {
+				pkt[1] |= 0x40 // payload_unit_start_indicator
+				payload[0] = 0 // pointer_field
+				payload = payload[1:]
+			}
+
+			l := copy(payload, sec)
+			for i := l; i < len(payload); i++ {
+				payload[i] = 0xFF
+			}
+			sec = sec[l:]
+
+			w.continuity = (w.continuity + 1) & 0x0F
+
+			if _, err := w.namedWriteCloser.Write(pkt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
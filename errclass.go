@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/metrics"
+)
+
+// The classes of errors, as tagged in the logs, and as the class label of errors_total.
+const (
+	errClassDNS       = "dns"
+	errClassRefused   = "refused"
+	errClassTLS       = "tls"
+	errClassHTTP4xx   = "http_4xx"
+	errClassHTTP5xx   = "http_5xx"
+	errClassTimeout   = "timeout"
+	errClassEOF       = "eof"
+	errClassShortRead = "short_read"
+	errClassOther     = "other"
+)
+
+var (
+	labelClass = metrics.Label("class")
+
+	errorsTotal = metrics.Counter("errors_total", "number of errors opening or copying the stream, by class", metrics.WithLabels(labelClass))
+)
+
+// httpStatusError is returned in place of any failed response that is not a retryAfterError,
+// so that its status code survives to be classified, since httpfiles only keeps the status of a failed response as text.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.status
+}
+
+// connectTimeoutError is returned when the stream did not respond within the --connect-timeout,
+// which is a timeout, even though all that we can see of it underneath is a canceled context.
+type connectTimeoutError struct {
+	err error
+}
+
+func (e *connectTimeoutError) Error() string {
+	return fmt.Sprintf("no response within --connect-timeout of %v: %+v", Flags.ConnectTimeout, e.err)
+}
+
+func (e *connectTimeoutError) Timeout() bool { return true }
+func (e *connectTimeoutError) Unwrap() error { return e.err }
+
+// errorClass returns the class of an error from opening or copying the stream,
+// by unwrapping it down to whatever caused it, e.g. to tell a DNS failure apart from a 503.
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	// A DNS lookup can also time out, but it is still a DNS failure.
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errClassDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errClassRefused
+	}
+
+	if isTLSError(err) {
+		return errClassTLS
+	}
+
+	if code := httpStatusCode(err); code > 0 {
+		if code >= 500 {
+			return errClassHTTP5xx
+		}
+
+		return errClassHTTP4xx
+	}
+
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return errClassTimeout
+	}
+
+	switch cause := errors.Cause(err); {
+	case errors.Is(cause, io.ErrUnexpectedEOF):
+		return errClassShortRead
+	case errors.Is(cause, io.EOF):
+		return errClassEOF
+	}
+
+	return errClassOther
+}
+
+// isTLSError returns true if err came from the TLS handshake, or the verification of the certificate of the server.
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// httpStatusCode returns the status code of the failed response that err came from, or 0 if it did not come from one.
+func httpStatusCode(err error) int {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code
+	}
+
+	var retryErr *retryAfterError
+	if errors.As(err, &retryErr) {
+		return retryErr.code
+	}
+
+	return 0
+}
+
+// countError counts err in errors_total by its class, and returns the class, to be tagged in the log of the error.
+func countError(err error) string {
+	class := errorClass(err)
+	if class == "" {
+		return ""
+	}
+
+	errorsTotal.WithLabels(labelClass.WithValue(class)).Inc()
+	return class
+}
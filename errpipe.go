@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/io/bufpipe"
+)
+
+// Policies for --discontinuity-policy.
+const (
+	discontinuityKeep = "keep"
+	discontinuityDrop = "drop"
+)
+
+// validateDiscontinuityPolicy checks that --discontinuity-policy is one that we know.
+func validateDiscontinuityPolicy() error {
+	switch Flags.DiscontinuityPolicy {
+	case discontinuityKeep, discontinuityDrop:
+		return nil
+	}
+
+	return errors.Errorf("bad --discontinuity-policy: %q: must be one of %s, or %s", Flags.DiscontinuityPolicy, discontinuityKeep, discontinuityDrop)
+}
+
+// errPipe is a bufpipe.Pipe that can be closed with an error,
+// which will be returned from Read once the buffer has been drained.
+//
+// It also counts the bytes written to and read from it, so that Discard can skip over everything buffered up to that point.
+type errPipe struct {
+	*bufpipe.Pipe
+
+	mu  sync.Mutex
+	err error
+
+	written   int64
+	read      int64
+	skipUntil int64
+}
+
+func newErrPipe(ctx context.Context, opts ...bufpipe.Option) *errPipe {
+	return &errPipe{
+		Pipe: bufpipe.New(ctx, opts...),
+	}
+}
+
+// CloseWithError closes the pipe, such that Reads will return the given error rather than io.EOF.
+func (p *errPipe) CloseWithError(err error) error {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+
+	return p.Pipe.Close()
+}
+
+// Discard drops everything that has been written to the pipe, but not yet read from it.
+//
+// The bufpipe.Pipe cannot be emptied from the outside, so the bytes are skipped over by offset as they are read.
+// This must not be called concurrently with Write, or the offset could land partway through a write.
+func (p *errPipe) Discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if glog.V(1) {
+		if pending := p.written - p.read; pending > 0 {
+			glog.Infof("--discontinuity-policy=%s: dropping %d buffered bytes", discontinuityDrop, pending)
+		}
+	}
+
+	p.skipUntil = p.written
+}
+
+func (p *errPipe) Write(b []byte) (n int, err error) {
+	n, err = p.Pipe.Write(b)
+
+	p.mu.Lock()
+	p.written += int64(n)
+	p.mu.Unlock()
+
+	return n, err
+}
+
+func (p *errPipe) Read(b []byte) (n int, err error) {
+	for {
+		n, err = p.Pipe.Read(b)
+
+		p.mu.Lock()
+		skip := p.skipUntil - p.read
+		p.read += int64(n)
+		p.mu.Unlock()
+
+		if skip <= 0 || n == 0 {
+			break
+		}
+
+		if skip > int64(n) {
+			skip = int64(n)
+		}
+
+		n = copy(b, b[skip:n])
+
+		if n > 0 || err != nil {
+			break
+		}
+	}
+
+	if err == io.EOF {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.err != nil {
+			err = p.err
+		}
+	}
+
+	return n, err
+}
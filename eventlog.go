@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Structured log formats for --log-format.
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+// validateLogFormat checks that --log-format is one that we know.
+func validateLogFormat() error {
+	switch Flags.LogFormat {
+	case "", logFormatText, logFormatJSON, logFormatLogfmt:
+		return nil
+	}
+
+	return errors.Errorf("bad --log-format: %q: must be one of %s, %s, or %s", Flags.LogFormat, logFormatText, logFormatJSON, logFormatLogfmt)
+}
+
+var eventLog struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+// logEvent writes a structured record of one of the key events of the stream, with --log-format=json or logfmt.
+// The usual glog logging is not affected, this is only an addition to it.
+//
+// The fields are given as alternating keys and values.
+// A time.Duration is given in seconds, and an error as its message.
+func logEvent(level, event string, fields ...interface{}) {
+	switch Flags.LogFormat {
+	case logFormatJSON, logFormatLogfmt:
+	default:
+		return
+	}
+
+	kv := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level,
+		"event", event,
+	}
+	kv = append(kv, fields...)
+
+	eventLog.Lock()
+	defer eventLog.Unlock()
+
+	b := &eventLog.buf
+	b.Reset()
+
+	if Flags.LogFormat == logFormatJSON {
+		b.WriteByte('{')
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		val := eventValue(kv[i+1])
+
+		if Flags.LogFormat == logFormatJSON {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(val)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(val))
+			}
+
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+			continue
+		}
+
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(val))
+	}
+
+	if Flags.LogFormat == logFormatJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	os.Stderr.Write(b.Bytes())
+}
+
+// eventValue converts the values that do not marshal usefully into something that does.
+func eventValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.Seconds()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+// logfmtValue formats a value for logfmt, quoting it if it is empty, or contains spaces, quotes, or an equals sign.
+func logfmtValue(v interface{}) string {
+	var s string
+
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=\\") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// fallbackChunk is how much of the --fallback-audio is written at a time,
+// which also bounds how long it takes to stop playing it, once we have reconnected.
+const fallbackChunk = 4096
+
+// fallbackAudio is the whole of the --fallback-audio file, which is read in once, at startup.
+var fallbackAudio []byte
+
+// loadFallbackAudio reads in the --fallback-audio file, if there is one.
+func loadFallbackAudio(ctx context.Context) error {
+	if Flags.FallbackAudio == "" {
+		return nil
+	}
+
+	b, err := files.Read(ctx, Flags.FallbackAudio)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 1 {
+		return errors.Errorf("--fallback-audio: %s: is empty", Flags.FallbackAudio)
+	}
+
+	fallbackAudio = b
+	return nil
+}
+
+// nopCloser is an io.WriteCloser whose Close does nothing, so that the throttleWriter of a fallbackPlayer cannot close the pipe.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// fallbackPlayer loops the --fallback-audio into the buffer of a stream, while we are between connections to it,
+// so that the outputs keep on getting something to play, rather than going dead.
+//
+// It is paced to the bitrate of the stream, so it should be encoded the same as the stream is.
+// A nil fallbackPlayer never plays anything.
+type fallbackPlayer struct {
+	ctx context.Context
+	w   *throttleWriter
+
+	mu   sync.Mutex
+	stop func()
+}
+
+// newFallbackPlayer returns a fallbackPlayer that writes into w, or nil if there is no --fallback-audio.
+func newFallbackPlayer(ctx context.Context, w io.Writer) *fallbackPlayer {
+	if len(fallbackAudio) < 1 {
+		return nil
+	}
+
+	return &fallbackPlayer{
+		ctx: ctx,
+		w:   newThrottleWriter(ctx, nopCloser{w}, 0),
+	}
+}
+
+// Start starts looping the --fallback-audio, if it is not already playing.
+func (p *fallbackPlayer) Start() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+
+	if glog.V(1) {
+		glog.Infof("--fallback-audio: playing %s until we reconnect", Flags.FallbackAudio)
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			for off := 0; off < len(fallbackAudio); off += fallbackChunk {
+				if ctx.Err() != nil {
+					return
+				}
+
+				end := off + fallbackChunk
+				if end > len(fallbackAudio) {
+					end = len(fallbackAudio)
+				}
+
+				if _, err := p.w.Write(fallbackAudio[off:end]); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	p.stop = func() {
+		cancel()
+		<-done
+	}
+}
+
+// Playing returns true if the --fallback-audio is playing.
+func (p *fallbackPlayer) Playing() bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stop != nil
+}
+
+// Stop stops the --fallback-audio, and waits for its last write to finish, so that nothing more of it follows.
+func (p *fallbackPlayer) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop == nil {
+		return
+	}
+
+	p.stop()
+	p.stop = nil
+
+	if glog.V(1) {
+		glog.Infof("--fallback-audio: stopped")
+	}
+}
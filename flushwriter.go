@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// flushWriter syncs an output file to disk every --flush-interval, if anything has been written to it since the last sync.
+//
+// Without it, a hard crash or a power loss can lose whatever the OS has not yet written back from its page cache,
+// which can be far more than the last few seconds of a long recording.
+type flushWriter struct {
+	files.Writer
+
+	mu    sync.Mutex
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// withFlush wraps f in a flushWriter, if --flush-interval is set, and f is a regular file.
+//
+// Sockets and pipes cannot be synced, so they are returned as they are.
+func withFlush(f files.Writer) files.Writer {
+	if Flags.FlushInterval <= 0 {
+		return f
+	}
+
+	if _, ok := f.(*os.File); !ok {
+		return f
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return f
+	}
+
+	w := &flushWriter{
+		Writer: f,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *flushWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(Flags.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := w.flush(); err != nil {
+			glog.Errorf("%s: sync: %+v", w.Name(), err)
+		}
+	}
+}
+
+// flush syncs the file, if it has been written to since it was last synced.
+func (w *flushWriter) flush() error {
+	w.mu.Lock()
+	dirty := w.dirty
+	w.dirty = false
+	w.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	start := time.Now()
+
+	// The sync is not done under the lock, so that a slow disk does not also block the writes.
+	if err := w.Writer.Sync(); err != nil {
+		return err
+	}
+
+	if glog.V(3) {
+		glog.Infof("%s: synced in %v", w.Name(), time.Since(start))
+	}
+
+	return nil
+}
+
+func (w *flushWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+
+	if n > 0 {
+		w.mu.Lock()
+		w.dirty = true
+		w.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// Close stops the periodic syncing, and does one last sync, before closing the file.
+func (w *flushWriter) Close() error {
+	close(w.stop)
+	<-w.done
+
+	if err := w.flush(); err != nil {
+		w.Writer.Close()
+		return err
+	}
+
+	return w.Writer.Close()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// maxFrameHeader is the largest frame header that we need to see, which is the 7-byte ADTS header.
+	maxFrameHeader = 7
+
+	// loasHeader is the size of the header of a LOAS AudioSyncStream frame, an 11-bit sync word, and a 13-bit length.
+	loasHeader = 3
+
+	// maxResync is how far we will look for a frame header, before warning that the stream has no frames,
+	// e.g. after a failover to an Ogg stream, or to an HTML error page. We still keep on looking, though.
+	maxResync = 64 << 10
+
+	// minFramerBuffer holds the largest possible ADTS or LOAS frame, and the header of the frame after it.
+	// MP3 frames are never more than 2881 bytes.
+	minFramerBuffer = loasHeader + 1<<13 - 1 + maxFrameHeader
+
+	// defaultFramerBuffer is the default maximum size of the buffer of a bufio.Scanner.
+	defaultFramerBuffer = bufio.MaxScanTokenSize
+)
+
+// Bitrates in kbps, indexed by [version is MPEG-1][layer][bitrate_index].
+var mpegBitrates = [2][4][15]int{
+	{ // MPEG-2, and MPEG-2.5
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // Layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // Layer II
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}, // Layer I
+	},
+	{ // MPEG-1
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // Layer III
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // Layer II
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // Layer I
+	},
+}
+
+var mpegSampleRates = [4]int{44100, 48000, 32000}
+
+// frameLength returns the length of the MP3, ADTS, or LOAS frame starting at the start of b,
+// and a key of the header fields that must not change from one frame to the next.
+//
+// It returns a length of zero if b does not start with a valid frame header.
+func frameLength(b []byte) (n int, key uint32) {
+	if isLOAS(b) {
+		if len(b) < loasHeader {
+			return 0, 0
+		}
+
+		// The LATM stream carries its configuration in-band, so there is no header field to hold constant,
+		// but the key must still never match that of an MP3 or ADTS frame.
+		return loasHeader + (int(b[1]&0x1F)<<8 | int(b[2])), 1 << 24
+	}
+
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return 0, 0
+	}
+
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+
+	if layer == 0 {
+		// ADTS
+		if len(b) < maxFrameHeader || b[1]&0xF0 != 0xF0 || (b[2]>>2)&0x0F > 12 {
+			return 0, 0
+		}
+
+		n = int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		if n < maxFrameHeader {
+			return 0, 0
+		}
+
+		// MPEG version, profile, sampling frequency, and channel configuration.
+		return n, uint32(b[1]&0x08)<<16 | uint32(b[2]&0xFD)<<8 | uint32(b[3]&0xC0)
+	}
+
+	if version == 1 {
+		// reserved
+		return 0, 0
+	}
+
+	brIndex := b[2] >> 4
+	srIndex := (b[2] >> 2) & 0x03
+	if brIndex == 0 || brIndex == 15 || srIndex == 3 {
+		// We do not support free format bitrates.
+		return 0, 0
+	}
+
+	var v1 int
+	if version == 3 {
+		v1 = 1
+	}
+
+	br := mpegBitrates[v1][layer][brIndex] * 1000
+
+	sr := mpegSampleRates[srIndex]
+	switch version {
+	case 2: // MPEG-2
+		sr /= 2
+	case 0: // MPEG-2.5
+		sr /= 4
+	}
+
+	pad := int(b[2]>>1) & 0x01
+
+	switch {
+	case layer == 3: // Layer I
+		n = (12*br/sr + pad) * 4
+	case layer == 1 && version != 3: // Layer III, MPEG-2 and MPEG-2.5
+		n = 72*br/sr + pad
+	default:
+		n = 144*br/sr + pad
+	}
+
+	// MPEG version, layer, and sampling frequency.
+	return n, uint32(b[1]&0x1E)<<8 | uint32(b[2]&0x0C)
+}
+
+// isLOAS returns true if b starts with the sync word of a LOAS AudioSyncStream, which carries AAC in LATM.
+func isLOAS(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x56 && b[1]&0xE0 == 0xE0
+}
+
+// frameScanner splits an MP3, ADTS, or LOAS stream into whole frames.
+//
+// A frame is only accepted if it is followed by another valid frame header,
+// so a partial frame left at a reconnect seam is discarded, and the scanner resyncs on the next whole frame.
+type frameScanner struct {
+	*bufio.Scanner
+
+	mu sync.Mutex
+
+	// resyncing is set by a Discontinuity, where we expect to lose sync.
+	resyncing bool
+	dropped   int
+
+	// nosync is set once we have discarded more than maxResync bytes without finding a frame.
+	nosync bool
+
+	size int
+}
+
+// newFrameScanner returns a frameScanner that buffers up to --framer-buffer bytes of the stream.
+func newFrameScanner(r io.Reader) *frameScanner {
+	size := Flags.FramerBuffer.Bytes(streamBitrate())
+	switch {
+	case size <= 0:
+		size = defaultFramerBuffer
+	case size < minFramerBuffer:
+		glog.Warningf("--framer-buffer %d is too small for the largest frames, using %d", size, minFramerBuffer)
+		size = minFramerBuffer
+	}
+
+	s := &frameScanner{
+		Scanner: bufio.NewScanner(r),
+		size:    size,
+	}
+	s.Buffer(make([]byte, 0, minFramerBuffer), size)
+	s.Split(s.split)
+
+	return s
+}
+
+// Err returns the first error encountered by the frameScanner.
+func (s *frameScanner) Err() error {
+	err := s.Scanner.Err()
+	if err == bufio.ErrTooLong {
+		return errors.Errorf("%+v: needed more than --framer-buffer of %d bytes", err, s.size)
+	}
+
+	return err
+}
+
+// Discontinuity notes that the stream has been reconnected, so loss of sync is expected.
+func (s *frameScanner) Discontinuity() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resyncing = true
+
+	// The new connection gets a fresh start at finding a frame.
+	s.dropped = 0
+	s.nosync = false
+}
+
+// skipped records that n bytes have been discarded, while looking for the next frame.
+func (s *frameScanner) skipped(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropped += n
+	if s.dropped > maxResync && !s.nosync {
+		glog.Warningf("framer: no MP3, ADTS, or LOAS frame found in %d bytes, still looking", s.dropped)
+		framerErrors.Inc()
+		s.nosync = true
+	}
+}
+
+// synced records that we have found a whole frame, after discarding any bytes.
+func (s *frameScanner) synced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dropped > 0 {
+		if s.nosync {
+			glog.Warningf("framer: found a frame, after discarding %d bytes", s.dropped)
+		} else if !s.resyncing {
+			glog.Warningf("framer: lost sync, discarded %d bytes", s.dropped)
+			framerErrors.Inc()
+		} else if glog.V(1) {
+			glog.Infof("framer: resynced after discontinuity, discarded %d bytes", s.dropped)
+		}
+	}
+
+	s.dropped = 0
+	s.resyncing = false
+	s.nosync = false
+}
+
+func (s *frameScanner) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; i < len(data); i++ {
+		if !atEOF && len(data)-i < maxFrameHeader {
+			// need more data
+			s.skipped(i)
+			return i, nil, nil
+		}
+
+		n, key := frameLength(data[i:])
+		if n == 0 {
+			continue
+		}
+
+		end := i + n
+
+		if len(data)-end < maxFrameHeader {
+			if !atEOF {
+				// need more data
+				s.skipped(i)
+				return i, nil, nil
+			}
+
+			if end > len(data) {
+				// The stream ended partway through the frame.
+				continue
+			}
+
+		} else if m, next := frameLength(data[end:]); m == 0 || next != key {
+			// The frame is not followed by the next frame, so it is either truncated or a false sync.
+			continue
+		}
+
+		s.skipped(i)
+		s.synced()
+
+		return end, data[i:end], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		s.skipped(len(data))
+		return len(data), nil, nil
+	}
+
+	return 0, nil, nil
+}
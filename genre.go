@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// contentMusic is the content_nibble_level_1 of Music/Ballet/Dance, and the fallback for any genre that we do not know,
+	// since that is what most of what we carry is.
+	contentMusic = 0x60
+
+	// maxContentNibbles is how many genres we describe an event with, at most.
+	maxContentNibbles = 4
+)
+
+// genreContent maps the words of common icy-genre values to DVB content_nibble values, as per ETSI EN 300 468, Table 28.
+var genreContent = map[string]byte{
+	"rock":        0x61, // rock/pop
+	"pop":         0x61,
+	"metal":       0x61,
+	"punk":        0x61,
+	"indie":       0x61,
+	"alternative": 0x61,
+	"hits":        0x61,
+	"top40":       0x61,
+	"dance":       0x61,
+	"electronic":  0x61,
+	"techno":      0x61,
+	"house":       0x61,
+	"trance":      0x61,
+	"hiphop":      0x61,
+	"rap":         0x61,
+	"rnb":         0x61,
+	"rb":          0x61,
+	"soul":        0x61,
+	"funk":        0x61,
+	"reggae":      0x61,
+
+	"classical":  0x62, // serious music/classical music
+	"baroque":    0x62,
+	"orchestral": 0x62,
+	"symphony":   0x62,
+	"chamber":    0x62,
+
+	"folk":        0x63, // folk/traditional music
+	"traditional": 0x63,
+	"country":     0x63,
+	"celtic":      0x63,
+	"world":       0x63,
+
+	"jazz":  0x64, // jazz
+	"blues": 0x64,
+	"swing": 0x64,
+
+	"opera":   0x65, // musical/opera
+	"musical": 0x65,
+
+	"news":    0x21, // news/weather report
+	"weather": 0x21,
+	"talk":    0x24, // discussion/interview/debate
+
+	"sport":  0x40, // sports
+	"sports": 0x40,
+
+	"kids":     0x50, // children's/youth programmes
+	"children": 0x50,
+
+	"religion":  0x73, // religion
+	"religious": 0x73,
+
+	"education": 0x90, // education/science/factual topics
+
+	"comedy": 0x14, // comedy
+}
+
+// dvbContent returns the DVB content_nibble values that describe the given icy-genre, or nil, if there is no genre.
+//
+// A genre is often a list, e.g. "Jazz, Blues" or "Rock/Pop", so each word is looked up on its own,
+// and a genre that has none that we know of is described as just music.
+func dvbContent(genre string) []byte {
+	words := strings.FieldsFunc(strings.ToLower(genre), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) < 1 {
+		return nil
+	}
+
+	var content []byte
+
+	add := func(nibbles byte) {
+		for _, c := range content {
+			if c == nibbles {
+				return
+			}
+		}
+
+		if len(content) < maxContentNibbles {
+			content = append(content, nibbles)
+		}
+	}
+
+	for i, word := range words {
+		// "Hip Hop", and "R&B" are split up into words that mean nothing on their own.
+		if i+1 < len(words) {
+			if nibbles, ok := genreContent[word+words[i+1]]; ok {
+				add(nibbles)
+				continue
+			}
+		}
+
+		if nibbles, ok := genreContent[word]; ok {
+			add(nibbles)
+		}
+	}
+
+	if len(content) < 1 {
+		return []byte{contentMusic}
+	}
+
+	return content
+}
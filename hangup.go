@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/os/process"
+)
+
+// reopener is an output that can be closed and reopened at the same path on a SIGHUP,
+// after something like logrotate has moved its file out of the way.
+type reopener interface {
+	Name() string
+	Reopen() error
+}
+
+var reopeners struct {
+	sync.Mutex
+	list []reopener
+}
+
+// addReopener registers an output to be reopened on each SIGHUP.
+func addReopener(r reopener) {
+	reopeners.Lock()
+	defer reopeners.Unlock()
+
+	reopeners.list = append(reopeners.list, r)
+}
+
+// isReopenable returns true if the given output is a single local file, which can be reopened on a SIGHUP.
+//
+// Sockets and stdout have no path to reopen, and rotating and hls outputs already start their own new files.
+func isReopenable(filename string) bool {
+	filename = strings.TrimPrefix(filename, "mpegts:")
+
+	if isStdoutOutput(filename) || isSocketOutput(filename) || isHLSOutput(filename) || isRotatingOutput(filename) {
+		return false
+	}
+
+	_, ok := localPath(filename)
+	return ok
+}
+
+// reopenOnHangup reopens every registered output on each SIGHUP, until ctx is canceled.
+//
+// The process package treats a SIGHUP as a terminating signal if nothing is ready to receive it,
+// so the reopening is done apart from receiving, and a SIGHUP during a reopen only queues up one more.
+func reopenOnHangup(ctx context.Context) {
+	hup := process.HangupChannel()
+	pending := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pending:
+			}
+
+			reopenOutputs()
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+
+			select {
+			case pending <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// reopenOutputs reopens every registered output.
+func reopenOutputs() {
+	reopeners.Lock()
+	list := append([]reopener(nil), reopeners.list...)
+	reopeners.Unlock()
+
+	if len(list) < 1 {
+		if glog.V(1) {
+			glog.Info("SIGHUP: no file outputs to reopen")
+		}
+		return
+	}
+
+	for _, r := range list {
+		if err := r.Reopen(); err != nil {
+			glog.Errorf("SIGHUP: %s: %+v", r.Name(), err)
+			continue
+		}
+
+		glog.Infof("SIGHUP: reopened output: %s", r.Name())
+		logEvent("info", "reopen", "output", r.Name())
+	}
+}
+
+// reopenFile is a local file output that can be reopened at the same path.
+//
+// The new file is opened before the old one is closed, so if it cannot be opened, we just carry on with the old one.
+// An Ogg stream is only ever reopened on a page boundary, but its header pages are not repeated in the new file.
+type reopenFile struct {
+	ctx      context.Context
+	filename string
+
+	mu sync.Mutex
+	f  files.Writer
+}
+
+func newReopenFile(ctx context.Context, filename string) (*reopenFile, error) {
+	f, err := createOutput(ctx, filename, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reopenFile{
+		ctx:      ctx,
+		filename: filename,
+		f:        withID3(f, filename),
+	}, nil
+}
+
+func (w *reopenFile) Name() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Name()
+}
+
+// Reopen opens the path of the file again, appending to it if something else has already put a file there.
+func (w *reopenFile) Reopen() error {
+	f, err := createOutput(withReopen(w.ctx), w.filename, 0)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	old := w.f
+	w.f = withID3(f, w.filename)
+
+	return old.Close()
+}
+
+func (w *reopenFile) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Write(b)
+}
+
+func (w *reopenFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Close()
+}
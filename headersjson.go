@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+)
+
+// streamInfo is the JSON structure written out by --headers-json.
+type streamInfo struct {
+	URL     string                 `json:"url"`
+	MetaInt int                    `json:"icy_metaint"`
+	Headers map[string]interface{} `json:"headers"`
+}
+
+// writeHeadersJSON writes the full set of headers of the stream as JSON to the given filename.
+//
+// Headers with a single value are written as a string, and headers with multiple values are written as an array.
+func writeHeadersJSON(ctx context.Context, filename, url string, h headerer) error {
+	header, err := h.Header()
+	if err != nil {
+		return err
+	}
+
+	metaint, err := getMetaInt(h)
+	if err != nil {
+		return err
+	}
+
+	info := &streamInfo{
+		URL:     url,
+		MetaInt: metaint,
+		Headers: make(map[string]interface{}),
+	}
+
+	for key, val := range header {
+		var v interface{} = val
+		if len(val) == 1 {
+			v = val[0]
+		}
+
+		info.Headers[key] = v
+	}
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	if filename == "-" {
+		// Do not go through files.Create, because closing its file would close our stdout.
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	f, err := files.Create(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrap(err, "headers json")
+	}
+
+	return f.Close()
+}
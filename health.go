@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/puellanivis/breton/lib/metrics"
+)
+
+// lastData is the time in Unix nanoseconds that data was last received from the stream, or 0 if it never has been.
+var lastData atomic.Int64
+
+var (
+	streamUp          = metrics.Gauge("stream_up", "1 while connected to the input stream, and data is flowing, 0 otherwise")
+	lastDataTimestamp = metrics.Gauge("last_data_timestamp_seconds", "the time that data was last received from the input stream (seconds since the Unix epoch)")
+)
+
+// dataWriter records the time of every write of stream data into lastData.
+type dataWriter struct {
+	io.Writer
+}
+
+func (w dataWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	if n > 0 {
+		now := time.Now()
+
+		lastData.Store(now.UnixNano())
+		lastDataTimestamp.SetToTime(now)
+		streamUp.Set(1)
+	}
+	return n, err
+}
+
+// streamDown records that data is no longer flowing from the stream, until the next write to a dataWriter.
+func streamDown() {
+	streamUp.Set(0)
+}
+
+// sinceLastData returns how long it has been since data was last received from the stream,
+// and false if no data ever has been.
+func sinceLastData() (time.Duration, bool) {
+	t := lastData.Load()
+	if t == 0 {
+		return 0, false
+	}
+
+	return time.Since(time.Unix(0, t)), true
+}
+
+// isReady returns true if we are connected to the stream, and copying data.
+//
+// A quick reconnect does not make us unready, but reconnects that are failing for more than twice --timeout do.
+func isReady() bool {
+	since, ok := sinceLastData()
+	return ok && since < 2*Flags.Timeout
+}
+
+// registerHealthHandlers adds /healthz and /readyz to the default http.ServeMux.
+func registerHealthHandlers() {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		since, ok := sinceLastData()
+
+		switch {
+		case !ok:
+			http.Error(w, "not ready: no data received yet", http.StatusServiceUnavailable)
+		case !isReady():
+			http.Error(w, fmt.Sprintf("not ready: no data received in %v", since.Truncate(time.Second)), http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+}
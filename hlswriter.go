@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+	"github.com/puellanivis/breton/lib/mpeg/ts/dvb"
+)
+
+// pidPAT is the fixed PID of the MPEG-TS Program Association Table.
+const pidPAT = 0x0000
+
+// isHLSOutput returns true if the given output should be written as an HLS playlist and segments.
+func isHLSOutput(filename string) bool {
+	return strings.HasPrefix(filename, "hls:") || strings.HasSuffix(filename, ".m3u8")
+}
+
+type hlsSegment struct {
+	name          string
+	duration      time.Duration
+	discontinuity bool
+}
+
+// hlsWriter is an io.WriteCloser that takes an MPEG-TS from the ts.Mux,
+// and writes it out as a rolling sequence of segment files, along with an HLS playlist of the most recent segments.
+//
+// Segments are preferably cut at the start of the PSI preamble that the ts.Mux periodically writes,
+// so that every segment starts with a PAT and PMT, and can be decoded on its own.
+// If the preamble does not come around in time, the segment is cut at the start of a PES packet instead,
+// and the new segment starts with a copy of the last preamble, so that no segment runs longer than the EXT-X-TARGETDURATION.
+//
+// The duration of a segment is the media time of the primary elementary stream, at the icy-br of the stream,
+// since the ts.Mux does not carry the timing of the stream itself, and a burst after a reconnect would otherwise look short.
+// Only if the stream has no icy-br is the wall clock used instead.
+type hlsWriter struct {
+	mu sync.Mutex
+
+	playlist string
+	prefix   string
+
+	target    time.Duration
+	maxTarget time.Duration // the EXT-X-TARGETDURATION, which is the target rounded up to whole seconds.
+	listSize  int
+
+	seq      int // media sequence number of the first segment in the playlist.
+	discSeq  int // discontinuity sequence number of the first segment in the playlist.
+	segments []*hlsSegment
+
+	// expired segments have left the playlist, but clients may still be fetching them,
+	// so they are only removed once another whole window of segments has gone by.
+	expired []*hlsSegment
+
+	f        *os.File
+	cur      *hlsSegment
+	start    time.Time
+	next     int
+	hasMedia bool
+	inPSI    bool
+
+	// media is how many bytes of the primary elementary stream on esPID the current segment holds,
+	// and pes is how many bytes the last whole PES packet of it held, to tell if the next one would still fit.
+	esPID  uint16
+	media  int64
+	pes    int64
+	curPES int64
+	hasPES bool
+
+	// preamble is a copy of the last preamble, to start a segment that has to be cut anywhere else.
+	preamble   []byte
+	inPreamble bool
+
+	discontinuity bool
+	closed        bool
+}
+
+// hlsPlaylistName returns the filename of the playlist for the given hls output, or an empty string if it has none.
+func hlsPlaylistName(filename string) string {
+	filename = strings.TrimPrefix(filename, "hls:")
+	if filename == "" {
+		return ""
+	}
+
+	if !strings.HasSuffix(filename, ".m3u8") {
+		filename += ".m3u8"
+	}
+
+	return filename
+}
+
+func newHLSWriter(filename string) (*hlsWriter, error) {
+	filename = hlsPlaylistName(filename)
+	if filename == "" {
+		return nil, errors.New("hls output requires a playlist filename")
+	}
+
+	target := Flags.HLSSegmentDuration
+	if target <= 0 {
+		return nil, errors.Errorf("bad --hls-segment-duration: %v", target)
+	}
+
+	listSize := Flags.HLSListSize
+	if listSize < 1 {
+		return nil, errors.Errorf("bad --hls-list-size: %d", listSize)
+	}
+
+	w := &hlsWriter{
+		playlist: filename,
+		prefix:   strings.TrimSuffix(filename, ".m3u8"),
+
+		target:    target,
+		maxTarget: time.Duration(math.Ceil(target.Seconds())) * time.Second,
+		listSize:  listSize,
+
+		esPID: tsElementaryPID(0),
+	}
+
+	w.resume()
+
+	return w, nil
+}
+
+// resume picks up the numbering from the playlist of a previous run, if there is one,
+// so that we neither overwrite its segments while a client may still be fetching them,
+// nor start the EXT-X-MEDIA-SEQUENCE over again.
+//
+// The segments of the previous run are expired right away, so they are removed once another whole window has gone by.
+func (w *hlsWriter) resume() {
+	b, err := os.ReadFile(w.playlist)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("hls: %+v", err)
+		}
+		return
+	}
+
+	base := filepath.Base(w.prefix) + "-"
+
+	var seq, discSeq, count int
+	var discontinuity bool
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			seq, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			discSeq, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"))
+
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+
+		case line == "" || strings.HasPrefix(line, "#"):
+
+		default:
+			count++
+			if discontinuity {
+				discSeq++
+				discontinuity = false
+			}
+
+			num, ok := strings.CutPrefix(line, base)
+			if !ok {
+				// This is not one of our segments, so it is not ours to remove either.
+				continue
+			}
+
+			n, err := strconv.Atoi(strings.TrimSuffix(num, ".ts"))
+			if err != nil || n < 0 || !strings.HasSuffix(num, ".ts") {
+				continue
+			}
+
+			if n >= w.next {
+				w.next = n + 1
+			}
+
+			w.expired = append(w.expired, &hlsSegment{
+				name: line,
+			})
+		}
+	}
+
+	if count < 1 {
+		return
+	}
+
+	// None of the segments of the previous run are in our playlist, so they have all left it.
+	w.seq = seq + count
+	w.discSeq = discSeq
+	if w.next < w.seq {
+		w.next = w.seq
+	}
+
+	// Whatever we write next does not follow on from where the previous run left off.
+	w.discontinuity = true
+
+	if glog.V(1) {
+		glog.Infof("hls: %s: continuing from media sequence %d, and segment %d", w.playlist, w.seq, w.next)
+	}
+}
+
+// Name returns the filename of the HLS playlist.
+func (w *hlsWriter) Name() string {
+	return w.playlist
+}
+
+// Discontinuity marks the next segment with an EXT-X-DISCONTINUITY tag,
+// and ends the current segment at the next opportunity.
+func (w *hlsWriter) Discontinuity() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.discontinuity = true
+}
+
+func (w *hlsWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	for len(b) > 0 {
+		pkt := b
+		if len(pkt) > ts.PacketSize {
+			pkt = pkt[:ts.PacketSize]
+		}
+
+		m, err := w.writePacket(pkt)
+		n += m
+		if err != nil {
+			return n, err
+		}
+
+		b = b[len(pkt):]
+	}
+
+	return n, nil
+}
+
+// writePacket writes a single packet to the current segment, first rolling to a new segment, if it is time to.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) writePacket(pkt []byte) (n int, err error) {
+	psi := isPreamblePacket(pkt)
+	preambleStart := psi && !w.inPSI
+	w.inPSI = psi
+
+	pesStart, payload := w.esPayload(pkt)
+
+	switch {
+	case preambleStart:
+		if w.shouldRoll() {
+			if err := w.roll(); err != nil {
+				return 0, err
+			}
+		}
+
+		w.preamble = w.preamble[:0]
+		w.inPreamble = true
+
+	case pesStart && w.mustRoll():
+		// The preamble has not come around in time, so cut here, and repeat the last preamble to start the next segment.
+		if err := w.roll(); err != nil {
+			return 0, err
+		}
+
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+
+		if _, err := w.f.Write(w.preamble); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.inPreamble {
+		if payload >= 0 {
+			// The preamble is everything from the SDT or PAT up to the first packet of the elementary stream.
+			w.inPreamble = false
+		} else {
+			w.preamble = append(w.preamble, pkt...)
+		}
+	}
+
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if !psi {
+		w.hasMedia = true
+	}
+
+	if pesStart {
+		if w.hasPES {
+			w.pes = w.curPES
+		}
+
+		w.curPES = 0
+		w.hasPES = true
+	}
+
+	if payload > 0 {
+		w.media += int64(payload)
+		w.curPES += int64(payload)
+	}
+
+	return w.f.Write(pkt)
+}
+
+// esPayload returns how many bytes of the primary elementary stream the given packet carries, not counting any PES header,
+// and whether it starts a PES packet. If the packet is not of the primary elementary stream, the payload is -1.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) esPayload(pkt []byte) (pesStart bool, payload int) {
+	const (
+		flagPUSI    = 0x40
+		flagAF      = 0x20
+		flagPayload = 0x10
+	)
+
+	if len(pkt) < ts.PacketSize || pkt[0] != 0x47 || getPID(pkt[1:]) != w.esPID {
+		return false, -1
+	}
+
+	if pkt[3]&flagPayload == 0 {
+		return false, 0
+	}
+
+	off := 4
+	if pkt[3]&flagAF != 0 {
+		off += 1 + int(pkt[4])
+	}
+
+	if off >= len(pkt) {
+		return false, 0
+	}
+
+	data := pkt[off:]
+
+	if pkt[1]&flagPUSI != 0 && len(data) >= 9 && data[0] == 0 && data[1] == 0 && data[2] == 1 {
+		hdr := 9 + int(data[8])
+		if hdr > len(data) {
+			hdr = len(data)
+		}
+
+		return true, len(data) - hdr
+	}
+
+	return false, len(data)
+}
+
+// isPreamblePacket returns true if the given packet is one of the SDT or PAT packets that start the ts.Mux preamble.
+func isPreamblePacket(b []byte) bool {
+	if len(b) < 3 || b[0] != 0x47 {
+		return false
+	}
+
+	pid := uint16(b[1]&0x1F)<<8 | uint16(b[2])
+
+	return pid == pidPAT || pid == dvb.ServiceDescriptionPID
+}
+
+// shouldRoll returns true if the current segment should be ended, at the start of a preamble.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) shouldRoll() bool {
+	if w.f == nil || !w.hasMedia {
+		return false
+	}
+
+	return w.discontinuity || w.mediaTime() >= w.target
+}
+
+// mustRoll returns true if the current segment has to be ended before the next PES packet,
+// since another one like the last one would take it past the EXT-X-TARGETDURATION.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) mustRoll() bool {
+	if w.f == nil || !w.hasMedia || len(w.preamble) < 1 {
+		return false
+	}
+
+	bps := streamBitrate()
+	if bps <= 0 {
+		// We cannot tell how long a PES packet is, so the best that we can do is to cut right at the target.
+		return time.Since(w.start) >= w.maxTarget
+	}
+
+	return bytesDuration(w.media+w.pes, bps) > w.maxTarget
+}
+
+// mediaTime returns the media time of the current segment, or if the stream has no icy-br, the wall clock time since it started.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) mediaTime() time.Duration {
+	bps := streamBitrate()
+	if bps <= 0 {
+		return time.Since(w.start)
+	}
+
+	return bytesDuration(w.media, bps)
+}
+
+// bytesDuration returns how long n bytes play for at the given bitrate.
+func bytesDuration(n int64, bps float64) time.Duration {
+	return time.Duration(float64(n) * 8 / bps * float64(time.Second))
+}
+
+// open starts a new segment file.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) open() error {
+	name := fmt.Sprintf("%s-%d.ts", w.prefix, w.next)
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if glog.V(2) {
+		glog.Infof("hls: segment: %s", name)
+	}
+
+	w.f = f
+	w.cur = &hlsSegment{
+		name: filepath.Base(name),
+
+		// A discontinuity before the first segment of the whole stream is meaningless.
+		discontinuity: w.discontinuity && w.next > 0,
+	}
+	w.start = time.Now()
+	w.next++
+	w.hasMedia = false
+	w.media = 0
+	w.pes, w.curPES, w.hasPES = 0, 0, false
+	w.discontinuity = false
+
+	return nil
+}
+
+// roll closes the current segment, adds it to the playlist, and rewrites the playlist.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) roll() error {
+	err := w.finish()
+
+	if err2 := w.writePlaylist(false); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// finish closes the current segment, and adds it to the playlist,
+// dropping any segments that have fallen out of the sliding window,
+// and removing those that fell out of it a whole window ago.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) finish() error {
+	f, seg := w.f, w.cur
+	w.f, w.cur = nil, nil
+
+	seg.duration = w.mediaTime()
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "hls segment")
+	}
+
+	w.segments = append(w.segments, seg)
+
+	for len(w.segments) > w.listSize {
+		old := w.segments[0]
+		w.segments = w.segments[1:]
+
+		w.seq++
+		if old.discontinuity {
+			w.discSeq++
+		}
+
+		w.expired = append(w.expired, old)
+	}
+
+	for len(w.expired) > w.listSize {
+		old := w.expired[0]
+		w.expired = w.expired[1:]
+
+		if err := os.Remove(filepath.Join(filepath.Dir(w.playlist), old.name)); err != nil {
+			glog.Warningf("hls: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// writePlaylist atomically rewrites the playlist with the current sliding window of segments.
+//
+// Caller MUST hold the lock.
+func (w *hlsWriter) writePlaylist(end bool) error {
+	b := new(bytes.Buffer)
+
+	// The target duration must never change, and segments are cut so that none of them are ever longer than it.
+	fmt.Fprintln(b, "#EXTM3U")
+	fmt.Fprintln(b, "#EXT-X-VERSION:3")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(w.maxTarget/time.Second))
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", w.seq)
+	if w.discSeq > 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", w.discSeq)
+	}
+
+	for _, seg := range w.segments {
+		if seg.discontinuity {
+			fmt.Fprintln(b, "#EXT-X-DISCONTINUITY")
+		}
+
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", seg.duration.Seconds())
+		fmt.Fprintln(b, seg.name)
+	}
+
+	if end {
+		fmt.Fprintln(b, "#EXT-X-ENDLIST")
+	}
+
+	return errors.Wrap(writeFileAtomic(w.playlist, b.Bytes()), "hls playlist")
+}
+
+// Close ends the current segment, and writes a final playlist that marks the end of the stream.
+//
+// If the current segment has not received any media yet, it is removed rather than being added to the playlist.
+func (w *hlsWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var err error
+
+	switch {
+	case w.f == nil:
+	case !w.hasMedia:
+		f, seg := w.f, w.cur
+		w.f, w.cur = nil, nil
+
+		f.Close()
+		if err2 := os.Remove(f.Name()); err2 != nil {
+			glog.Warningf("hls: %s: %+v", seg.name, err2)
+		}
+
+	default:
+		err = w.finish()
+	}
+
+	if err2 := w.writePlaylist(true); err == nil {
+		err = err2
+	}
+
+	return err
+}
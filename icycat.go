@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -25,10 +26,8 @@ import (
 	"github.com/puellanivis/breton/lib/io/bufpipe"
 	"github.com/puellanivis/breton/lib/metrics"
 	_ "github.com/puellanivis/breton/lib/metrics/http"
-	"github.com/puellanivis/breton/lib/mpeg/framer"
 	"github.com/puellanivis/breton/lib/mpeg/ts"
 	"github.com/puellanivis/breton/lib/mpeg/ts/dvb"
-	"github.com/puellanivis/breton/lib/mpeg/ts/psi"
 	"github.com/puellanivis/breton/lib/os/process"
 )
 
@@ -40,19 +39,177 @@ var (
 
 // Flags contains all of the flags defined for the application.
 var Flags struct {
-	Output    string `flag:",short=o"            desc:"Specifies which file to write the output to"`
-	UserAgent string `flag:",default=icycat/2.0" desc:"Which User-Agent string to use"`
-	Quiet     bool   `flag:",short=q"            desc:"If set, supresses output from subprocesses."`
+	Output    []string `flag:",short=o"            desc:"Specifies which file to write the output to, - or mpegts:- for stdout, with ${VAR} expanded from the environment (may be repeated) (srt:// is not supported in this build)"`
+	UserAgent string   `flag:",default=icycat/2.0" desc:"Which User-Agent string to use"`
+	Username  string   `desc:"If set, use this username for HTTP Basic authentication to the stream."`
+	Password  string   `desc:"If set, use this password for HTTP Basic authentication to the stream."`
+	Proxy     string   `desc:"If set, connect to the stream through this http://, https:// or socks5:// proxy. (default from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)"`
+	Quiet     bool     `flag:",short=q"            desc:"If set, supresses output from subprocesses."`
+	LogFormat string   `flag:"log-format"          desc:"If set to json or logfmt, also write a structured record of each connect, disconnect, reconnect, copy-complete, and mux-error to stderr. (default text)"`
+	Progress  bool     `desc:"If set, show a status line on stderr of the time elapsed, bytes copied, bandwidth, and reconnects. (suppressed by --quiet)"`
+	Config    string   `desc:"If set, load flags from this TOML file. Flags given on the command line override it."`
+
+	UserAgentFile   string `desc:"If set, rotate through the User-Agents in this file, one per line, on each reconnect."`
+	UserAgentRandom bool   `desc:"If set, rotate through the User-Agents in a random order, from --user-agent-file, or else a built-in pool of common browsers."`
+
+	URLFile string `flag:"url-file" desc:"If set, read the stream URLs from this file, one per line, with any indented \"Key: Value\" headers for each, in place of the arguments, and never log them."`
 
 	// --packet-size defaults to 1316, which is 1500 - (1500 mod 188)
 	// Where 1500 is the typical ethernet MTU, and 188 is the mpegts packet size.
 	PacketSize int `flag:",default=1316"         desc:"If outputing to udp, default to using this packet size."`
 
-	Timeout time.Duration `flag:",default=5s"    desc:"The timeout between rapid copy errors."`
+	// For 64 kbps, a --udp-latency of 50ms gives datagrams of two mpegts packets, rather than seven.
+	UDPLatency time.Duration `flag:"udp-latency" desc:"If outputing to udp, send smaller datagrams, so that each one fills within this long at the bitrate of the stream, up to --packet-size."`
+
+	RTPSSRC         uint `flag:"rtp-ssrc"                     desc:"If outputing to rtp, use this SSRC. (default random)"`
+	RTPJitterWindow int  `flag:"rtp-jitter-window,default=16" desc:"If reading from rtp, hold up to this many packets that arrive out of order, before giving up on the missing ones as lost."`
+
+	SAP bool `flag:"sap" desc:"If outputing to an IPv4 multicast udp or rtp address, announce it with SAP/SDP, for discovery by players like VLC."`
+
+	TSProgramNumber uint16 `flag:"ts-program-number,default=1"      desc:"If outputing to mpegts, use this program number."`
+	TSPMTPID        uint16 `flag:"ts-pmt-pid,default=0x1000"        desc:"If outputing to mpegts, send the PMT on this PID."`
+	TSPCRPID        uint16 `flag:"ts-pcr-pid"                       desc:"If outputing to mpegts, send the PCR on this PID. (default --ts-elementary-pid)"`
+	TSElementaryPID uint16 `flag:"ts-elementary-pid,default=0x0100" desc:"If outputing to mpegts, send the audio stream on this PID."`
+
+	PCRInterval time.Duration `flag:"pcr-interval" desc:"If outputing to mpegts, send a PCR at least this often, up to 100ms. (default: only at the start of each PES packet)"`
+
+	// One 90 kHz tick is 1/90000 of a second, so e.g. 40ms is 3600 ticks.
+	TimestampOffset tsOffset `flag:"timestamp-offset" desc:"If outputing to mpegts, shift every PCR, PTS, and DTS by this much: a plain number is in ticks of the 90 kHz MPEG clock, or else a duration, e.g. 40ms, or -1.5s."`
+
+	// The mux rate must allow for the MPEG-TS overhead on top of the audio: about 10% plus 20 kbps, so 192000 for a 128 kbps stream.
+	TSMuxRate uint `flag:"ts-mux-rate" desc:"If outputing to mpegts, pad the output with null packets to this constant rate in bits/second. (should be at least 1.1 * icy-br + 20000)"`
+
+	// Each program N after the first uses --ts-program-number + N, --ts-pmt-pid + N, --ts-elementary-pid + N, and --dvb-service-id + N.
+	MultiProgram bool `flag:"multi-program" desc:"If outputing to mpegts, carry each stream as its own program and DVB service, rather than failing over between them. The first stream is the primary, for all of the features that follow a single stream."`
+
+	VerboseMux bool `flag:"verbose-mux" desc:"If outputing to mpegts, log each PAT, PMT, SDT, and EIT when it is first sent, or whenever it changes, with a hex dump of its packet."`
+	VerifyTS   bool `flag:"verify-ts"   desc:"If outputing to mpegts, re-parse the muxed output, checking its continuity counters and PSI CRCs, and log the first defect found. (costs CPU)"`
+
+	DVBONID        uint16 `flag:"dvb-onid,default=0xFF01"     desc:"If outputing to mpegts, use this DVB original_network_id."`
+	DVBServiceID   uint16 `flag:"dvb-service-id"              desc:"If outputing to mpegts, use this DVB service_id. (default --ts-program-number)"`
+	DVBProvider    string `flag:"dvb-provider,default=icycat" desc:"If outputing to mpegts, use this DVB service provider name."`
+	DVBServiceName string `flag:"dvb-service-name"            desc:"If outputing to mpegts, use this DVB service name. (default from the icy-name header)"`
+	DVBEIT         bool   `flag:"dvb-eit,default=true"        desc:"If outputing to mpegts, send the ICY StreamTitle as the current event in a DVB EIT, described with the icy-genre and icy-url."`
+
+	Append        bool          `desc:"If set, append to existing output files instead of truncating them."`
+	ID3           bool          `flag:"id3" desc:"If set, start each file not recorded as mpegts with an ID3v2 tag from the icy-name, icy-genre, and icy-url headers, and the StreamTitle."`
+	FlushInterval time.Duration `desc:"If set, sync output files to disk this often, so that a crash loses at most this much of the recording. (no effect on sockets or pipes)"`
+
+	Throttle bool `desc:"If set, pace the output to the real-time rate of the stream, from its icy-br, or --rate."`
+	Rate     uint `desc:"If set, pace the output to this rate in bits/second. (implies --throttle)"`
+
+	Duration    time.Duration `desc:"If set, stop copying the stream after this long, and exit cleanly."`
+	MaxFilesize byteSize      `flag:"max-filesize" desc:"If set, stop copying the stream after this much of it, in bytes (e.g. 2G) or time at the icy-br bitrate (e.g. 12h), and exit cleanly."`
+
+	AllowICYProtocol bool `flag:"allow-icy-protocol" desc:"If set, accept SHOUTcast servers that respond with an ICY status line instead of HTTP."`
+
+	AcceptContentType []string `flag:"accept-content-type" desc:"Only accept streams with one of these Content-Types, which may end in /* (may be repeated). (default: audio/*, application/ogg, video/mp2t, video/mpeg)"`
+
+	RequestMetadata bool   `flag:",default=true" desc:"If set, send Icy-MetaData: 1, to ask the stream to send its inline metadata."`
+	Referer         string `desc:"If set, send this Referer header to the stream."`
+
+	InputHeader []string `flag:"input-header" desc:"Send this \"Key: Value\" header with every request to the stream (may be repeated). Headers that look like credentials are not logged, or sent through a redirect to a different host."`
+
+	PreferCodec string `flag:"prefer-codec" desc:"If set, send an Accept header asking the stream for this codec: aac, mp3, ogg, or opus. (for servers that offer several at the same mount)"`
+
+	SourceAddress string        `desc:"If set, connect to the stream from this local IP address, e.g. to choose the uplink of a multi-homed host."`
+	TCPKeepalive  time.Duration `flag:"tcp-keepalive,default=30s" desc:"Send TCP keep-alive probes on the connection to the stream after it has been idle this long, and then at this interval, so that a dead peer is found sooner, and we reconnect. (0 = off)"`
+
+	TLSInsecure bool   `flag:"tls-insecure" desc:"If set, do not verify the TLS certificate of https streams. (dangerous)"`
+	TLSCA       string `flag:"tls-ca"       desc:"If set, also trust the PEM CA certificates in this file for https streams."`
+	TLSCert     string `flag:"tls-cert"     desc:"If set, present the PEM client certificate in this file to https streams. (requires --tls-key)"`
+	TLSKey      string `flag:"tls-key"      desc:"If set, use the PEM private key in this file for the --tls-cert client certificate."`
+
+	MaxRedirects      int  `flag:",default=10" desc:"Follow at most this many HTTP redirects when connecting to the stream."`
+	SameHostRedirects bool `desc:"If set, refuse HTTP redirects to a different host than the stream URL."`
+
+	Timeout        time.Duration `flag:",default=5s"    desc:"The timeout between rapid copy errors."`
+	ConnectTimeout time.Duration `desc:"If set, give up on connecting to a stream if it has not sent its headers within this long."`
+	OutputTimeout  time.Duration `desc:"If a write to the output blocks for this long, then fail the copy and retry. (default --timeout)"`
+
+	AdaptiveTimeout byteSize `flag:"adaptive-timeout" desc:"If set, time out a stream that has gone without data for as long as it takes to send this much of it at its icy-br, e.g. 16k, allowing for the --buffer-size to fill at that rate as well. (default --timeout, if there is no icy-br)"`
+
+	ShutdownTimeout time.Duration `flag:",default=5s" desc:"On shutdown, allow this long to drain and close the outputs and the metrics server, before forcing an exit. (0 to wait forever)"`
+
+	Once bool `desc:"If set, copy the stream until it ends, and then exit, rather than reconnecting. (e.g. to download a recording)"`
+	Loop bool `desc:"If set, when a finite source ends, start it over again from the beginning, indefinitely. (e.g. with --throttle, for a test channel)"`
+
+	FallbackAudio string `flag:"fallback-audio" desc:"If set, loop this file into the output while waiting to reconnect to the stream, so that the output never goes dead. (should be encoded the same as the stream)"`
+
+	ReconnectInitial time.Duration `desc:"The initial delay between reconnect attempts. (default --timeout)"`
+	ReconnectMax     time.Duration `flag:",default=5m" desc:"The maximum delay between reconnect attempts."`
+	ReconnectFactor  float64       `flag:",default=2"  desc:"The factor to grow the reconnect delay by after each consecutive failure."`
+	MaxRetries       int           `desc:"If set, exit after this many consecutive failed reconnects. (default 0 = retry forever)"`
+
+	// A server that accepts the connection, and then hangs up right away, would otherwise count as a working stream.
+	FastFailBytes int           `flag:",default=4096" desc:"A connection that closes having sent fewer than this many bytes within --fast-fail-time is a failed reconnect."`
+	FastFailTime  time.Duration `flag:",default=1s"   desc:"A connection that closes within this long having sent fewer than --fast-fail-bytes is a failed reconnect. (0 disables)"`
+
+	FailoverThreshold int           `flag:",default=1"   desc:"If given multiple streams, fail over to the next one after this many consecutive failures."`
+	FailoverProbe     time.Duration `flag:",default=30s" desc:"While failed over, check this often if the first stream has recovered, and if so, switch back to it."`
+
+	StateFile string `flag:"state-file" desc:"If set, keep the reconnect backoff and failover state in this JSON file, and continue from it on startup, so that frequent restarts do not defeat the backoff."`
+
+	SilenceTimeout   time.Duration `desc:"If set, reconnect after the stream has been near-silent for this long. (MP3 streams only)"`
+	SilenceThreshold float64       `flag:",default=-60" desc:"The level in dBFS below which the stream is considered to be near-silent."`
+
+	TitleStallTimeout   time.Duration `desc:"If set, reconnect after the StreamTitle has not changed for this long, and the bitrate also looks low or constant."`
+	TitleStallBitrate   float64       `flag:",default=0.5"  desc:"With --title-stall-timeout, the bitrate is low if it is below this ratio of the icy-br."`
+	TitleStallVariation float64       `flag:",default=0.01" desc:"With --title-stall-timeout, the bitrate is constant if its coefficient of variation over the last minute is below this."`
+
+	HLSSegmentDuration time.Duration `flag:"hls-segment-duration,default=6s" desc:"If outputing to hls, roll to a new segment after this long."`
+	HLSListSize        int           `flag:"hls-list-size,default=5"         desc:"If outputing to hls, keep this many of the most recent segments in the playlist."`
+
+	// Buffered data is always passed on as soon as it is available,
+	// so a large --buffer-size only allows larger bursts after a network hiccup, it does not add latency.
+	// When the output stalls, the --max-buffer cap will eventually block the copy from the stream,
+	// which then trips the --timeout watchdog, and the stream is reconnected, rather than buffering without limit.
+	BufferSize byteSize `desc:"Read the stream with a buffer of this size, in bytes (e.g. 256k) or time at the icy-br bitrate (e.g. 2s). (default 64k)"`
+	MaxBuffer  byteSize `desc:"If set, limit the data buffered between the stream and the output to this size, in bytes (e.g. 4M) or time at the icy-br bitrate (e.g. 30s). (default 1M with --loop)"`
+
+	MaxClients  int      `flag:"max-clients"  desc:"If set, refuse any more than this many clients at once to a tcp:// relay output, with a 503."`
+	RelayBuffer byteSize `flag:"relay-buffer" desc:"Buffer up to this much of the stream for each relay client, in bytes (e.g. 256k) or time at the icy-br bitrate (e.g. 5s), dropping the oldest of it, if the client falls behind. (default 10s)"`
+
+	// Dropping the buffered data keeps the latency of a live output low after a reconnect, while keeping it is better for a recording.
+	DiscontinuityPolicy string `flag:",default=keep" desc:"At a reconnect, keep the data from the old connection that is still buffered, or drop it."`
+
+	BufferPrefill byteSize `flag:"buffer-prefill" desc:"If outputing to mpegts, buffer this much of the stream, in bytes (e.g. 64k) or time at the icy-br bitrate (e.g. 2s), before starting the mux."`
+	FramerBuffer  byteSize `flag:"framer-buffer"  desc:"If outputing to mpegts, allow this much of the stream, in bytes (e.g. 256k) or time at the icy-br bitrate (e.g. 1s), to be buffered while splitting it into frames. (default 64k)"`
+
+	RotateSize     byteSize      `desc:"If set, roll over to a new output file after this size, in bytes (e.g. 100M) or time at the icy-br bitrate (e.g. 1h)."`
+	RotateInterval time.Duration `desc:"If set, roll over to a new output file at every multiple of this interval of wall-clock time (e.g. 1h)."`
+	SplitOnTitle   bool          `desc:"If set, roll over to a new output file whenever the StreamTitle changes, naming it after the title with %{title} in the filename."`
+	OnRotate       string        `desc:"If set, run this command in the background on each finished output file, with its path as the last argument. (including the last file on exit)"`
+	Manifest       string        `desc:"If set, keep a JSON index in this file of each finished output file, with its start time, duration, size, and StreamTitles."`
+
+	MetadataFile string `desc:"If set, continuously write the most recent ICY StreamTitle to this file."`
+	HeadersJSON  string `flag:"headers-json" desc:"If set, write all of the headers of the stream as JSON to this file (- for stdout) before streaming begins."`
+	DumpRaw      string `flag:"dump-raw"     desc:"If set, also save the bytes of the stream to this file exactly as the server sent them, including any ICY metadata, over every reconnect. (for debugging)"`
+
+	NormalizeMetadata bool `desc:"If set, clean up the ICY StreamTitle into UTF-8, decoding Windows-1252 and undoing mojibake as best as it can."`
+
+	StatusURL      string        `flag:"status-url"                  desc:"If set, poll this URL for the StreamTitle, as JSON (e.g. ICECAST status-json.xsl) or text/plain, for streams without inline metadata."`
+	StatusInterval time.Duration `flag:"status-interval,default=15s" desc:"How often to poll the --status-url."`
+
+	Probe       bool `desc:"If set, connect to the stream, print its headers, resolved URL, and codec, then exit without streaming."`
+	DryRun      bool `desc:"If set, check that the outputs are writable, and that the streams can be connected to, then exit without streaming."`
+	ListSchemes bool `flag:"list-schemes" desc:"If set, list the URL schemes that the streams and outputs can use in this build, then exit."`
+	SelfTest    bool `flag:"self-test"    desc:"If set, mux a few seconds of synthetic silence into each local file output, check that each is a valid MPEG-TS, then exit."`
 
 	Metrics        bool   `desc:"If set, publish metrics to the given metrics-port or metrics-addr."`
 	MetricsPort    int    `desc:"Which port to publish metrics with. (default auto-assign)"`
-	MetricsAddress string `desc:"Which local address to listen on; overrides metrics-port flag."`
+	MetricsAddress string `desc:"Which local address to listen on; overrides metrics-port flag. (an IPv6 address must be in brackets, e.g. [::1]:9100)"`
+	MetricsNetwork string `flag:",default=tcp" desc:"Which network to listen on for metrics: tcp (dual-stack), tcp4, or tcp6."`
+	MetricsTLSCert string `flag:"metrics-tls-cert" desc:"If set, serve metrics over https with the PEM certificate in this file. (requires --metrics-tls-key)"`
+	MetricsTLSKey  string `flag:"metrics-tls-key"  desc:"If set, use the PEM private key in this file for the --metrics-tls-cert certificate."`
+
+	MetricsUser     string `desc:"If set, require HTTP Basic authentication with this username for metrics. (requires --metrics-password)"`
+	MetricsPassword string `desc:"If set, require HTTP Basic authentication with this password for metrics."`
+
+	MetricsPrefix string `desc:"If set, prepend this namespace to the name of every metric, e.g. icycat gives icycat_bandwidth_lifetime_bps."`
+	MetricsLabels string `desc:"If set, add these static labels to every metric, as key=val,... (e.g. station=kexp,instance=a)"`
+
+	WebPlayer bool `flag:"web-player" desc:"If set, serve a web player of the hls output, or else of the stream, with its StreamTitle, at /player on the metrics server. (requires --metrics)"`
 }
 
 func init() {
@@ -62,6 +219,22 @@ func init() {
 var (
 	bwLifetime = metrics.Gauge("bandwidth_lifetime_bps", "bandwidth of the copy to output process (bits/second)")
 	bwRunning  = metrics.Gauge("bandwidth_running_bps", "bandwidth of the copy to output process (bits/second)")
+
+	icyBitrate = metrics.Gauge("icy_bitrate_bps", "bitrate advertised by the stream in its icy-br header (bits/second)")
+	bwRatio    = metrics.Gauge("bandwidth_ratio", "ratio of bandwidth_running_bps to icy_bitrate_bps")
+
+	labelStream = metrics.Label("stream")
+
+	reconnects    = metrics.Counter("reconnects_total", "number of times the input stream has been reopened", metrics.WithLabels(labelStream))
+	silenceEvents = metrics.Counter("silence_events_total", "number of times the input stream has been reopened because of dead air", metrics.WithLabels(labelStream))
+	titleStalls   = metrics.Counter("title_stall_events_total", "number of times the input stream has been reopened because its StreamTitle stalled", metrics.WithLabels(labelStream))
+	fastFails     = metrics.Counter("fast_fail_events_total", "number of times the input stream closed right after connecting, with next to no data", metrics.WithLabels(labelStream))
+	connUptime    = metrics.Gauge("connection_uptime_seconds", "how long the current connection to the input stream has been copying (seconds)", metrics.WithLabels(labelStream))
+
+	muxWriteErrors = metrics.Counter("mux_write_errors_total", "number of errors writing the stream into the mpegts muxer")
+	muxServeErrors = metrics.Counter("mux_serve_errors_total", "number of errors from the mpegts muxer itself")
+	framerErrors   = metrics.Counter("framer_errors_total", "number of errors splitting the stream into frames for the mpegts muxer, including each loss of sync")
+	muxRebuilds    = metrics.Counter("mux_rebuilds_total", "number of times an mpegts output has been torn down and rebuilt after the muxer failed")
 )
 
 type headerer interface {
@@ -75,18 +248,7 @@ func printIcyHeaders(h headerer) (name string) {
 		return ""
 	}
 
-	var headers []string
-
-	for k := range header {
-		key := strings.ToUpper(k)
-
-		if strings.HasPrefix(key, "ICY-") {
-			headers = append(headers, k)
-		}
-	}
-	sort.Strings(headers)
-
-	for _, key := range headers {
+	for _, key := range icyHeaderKeys(header) {
 		val := header[key]
 
 		var v interface{} = val
@@ -100,274 +262,1382 @@ func printIcyHeaders(h headerer) (name string) {
 	return header.Get("Icy-Name")
 }
 
+// icyHeaderKeys returns the sorted keys of all of the ICY headers.
+func icyHeaderKeys(header http.Header) []string {
+	var keys []string
+
+	for k := range header {
+		key := strings.ToUpper(k)
+
+		if strings.HasPrefix(key, "ICY-") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 var (
 	stderr = os.Stderr
-	mux    *ts.Mux
 )
 
 type discontinuityMarker interface {
 	Discontinuity()
 }
 
-func openOutput(ctx context.Context, filename string) (io.WriteCloser, func(), error) {
-	discontinuity := func() {}
+// openOutputs opens each of the given outputs, and returns an io.WriteCloser that writes to all of them.
+// If no outputs are given, then it writes to stdout.
+func openOutputs(ctx context.Context, filenames []string) (io.WriteCloser, func(), error) {
+	if len(filenames) < 1 {
+		filenames = []string{""}
+	}
+
+	if len(filenames) == 1 {
+		out, discontinuity, err := openOutput(ctx, filenames[0])
+		if err != nil || isSocketOutput(filenames[0]) {
+			return out, discontinuity, err
+		}
 
-	if !strings.HasPrefix(filename, "udp:") && !strings.HasPrefix(filename, "mpegts:") {
-		f, err := files.Create(ctx, filename)
+		return &fatalWriter{out, filenames[0]}, discontinuity, nil
+	}
+
+	mw := new(multiWriter)
+
+	var discontinuities []func()
+
+	for _, filename := range filenames {
+		out, discontinuity, err := openOutput(ctx, filename)
 		if err != nil {
+			mw.Close()
 			return nil, nil, err
 		}
 
-		glog.Infof("output: %s", f.Name())
-		return f, discontinuity, nil
+		mw.add(filename, out, isSocketOutput(filename))
+		discontinuities = append(discontinuities, discontinuity)
+	}
+
+	discontinuity := func() {
+		for _, fn := range discontinuities {
+			fn()
+		}
 	}
 
+	return mw, discontinuity, nil
+}
+
+// isSocketOutput returns true if the given output is a network socket, whose write errors are not fatal.
+func isSocketOutput(filename string) bool {
 	filename = strings.TrimPrefix(filename, "mpegts:")
 
-	uri, err := url.Parse(filename)
+	for _, scheme := range []string{"udp:", "rtp:", "unix:", "unixgram:"} {
+		if strings.HasPrefix(filename, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMuxOutput returns true if the given output is muxed into an MPEG-TS, rather than written out as Ogg.
+func isMuxOutput(filename string) bool {
+	return isHLSOutput(filename) || isSocketOutput(filename) || strings.HasPrefix(filename, "mpegts:")
+}
+
+// isSRTOutput returns true if the given output is an SRT URL.
+func isSRTOutput(filename string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(filename, "mpegts:"), "srt:")
+}
+
+// errSRTUnsupported is returned for an srt:// output, since there is no SRT implementation that we can build against,
+// rather than leaving it to fail as an unknown scheme, which does not say why.
+var errSRTUnsupported = errors.New("srt output is not supported in this build")
+
+func openOutput(ctx context.Context, filename string) (io.WriteCloser, func(), error) {
+	if isSRTOutput(filename) {
+		return nil, nil, errors.Wrap(errSRTUnsupported, filename)
+	}
+
+	isHLS := isHLSOutput(filename)
+
+	addr, isRelay, err := relayAddress(filename)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var opts []files.Option
+	if isRelay {
+		w, err := newRelayServer(addr)
+		if err != nil {
+			return nil, nil, err
+		}
 
-	if uri.Scheme == "udp" {
-		// Default packet size: what the flag --packet-size is.
-		pktSize := Flags.PacketSize
+		glog.Infof("output: relaying to clients on %s", w.Name())
 
-		q := uri.Query()
-		if urlPktSize := q.Get(socketfiles.FieldPacketSize); urlPktSize != "" {
-			// If the output URL has a urlPktSize value, override the default.
-			sz, err := strconv.ParseInt(urlPktSize, 0, strconv.IntSize)
+		// The clients have to find their own way through a discontinuity, since they could have connected at any point anyway.
+		return w, func() {}, nil
+	}
+
+	if !isMuxOutput(filename) {
+		if isRotatingOutput(filename) {
+			f, err := newRotatingWriter(ctx, filename, false)
 			if err != nil {
-				return nil, nil, errors.Errorf("bad %s value: %s: %+v", socketfiles.FieldPacketSize, urlPktSize, err)
+				return nil, nil, err
 			}
 
-			pktSize = int(sz)
+			glog.Infof("output: %s", f.Name())
+
+			// Only ever writing whole Ogg pages also means that we only ever rotate on a page boundary.
+			w := newOggWriter(f)
+			return w, w.Discontinuity, nil
 		}
 
-		// Our packet size needs to be an integer multiple of the mpegts packet size.
-		pktSize -= (pktSize % ts.PacketSize)
+		if isReopenable(filename) {
+			f, err := newReopenFile(ctx, filename)
+			if err != nil {
+				return nil, nil, err
+			}
+			addReopener(f)
 
-		// Our packet size needs to be at least the mpegts packet size.
-		if pktSize <= 0 {
-			pktSize = ts.PacketSize
+			glog.Infof("output: %s", f.Name())
+
+			w := newOggWriter(f)
+			return w, w.Discontinuity, nil
+		}
+
+		f, err := createOutput(ctx, filename, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		glog.Infof("output: %s", f.Name())
+
+		w := newOggWriter(withID3(f, filename))
+		return w, w.Discontinuity, nil
+	}
+
+	if err := validateTSFlags(); err != nil {
+		return nil, nil, err
+	}
+
+	if isHLS && Flags.TSMuxRate > 0 {
+		return nil, nil, errors.Errorf("%s: --ts-mux-rate cannot be used with hls", filename)
+	}
+
+	w, err := newMuxOutput(ctx, filename, isHLS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if isReopenable(filename) {
+		addReopener(w)
+	}
+
+	return w, w.Discontinuity, nil
+}
+
+// openMuxPipeline opens the sink, and sets up the ts.Mux with the given number of programs,
+// and the goroutines that feed each of their streams into it.
+func openMuxPipeline(ctx context.Context, filename string, isHLS bool, programs int) (*muxPipeline, error) {
+	f, err := openMuxOutput(ctx, filename, isHLS)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("output: %s", f.Name())
+
+	// failed is closed once the mux has failed, and the whole pipeline needs to be rebuilt.
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	fail := func() {
+		failOnce.Do(func() { close(failed) })
+	}
+
+	var sink namedWriteCloser = newErrorLatch(f, func(err error) {
+		glog.Errorf("mpegts: %s: %+v", f.Name(), err)
+		muxServeErrors.Inc()
+		logEvent("error", "mux-error", "output", filename, "error", err)
+		fail()
+	})
+
+	if Flags.VerifyTS {
+		sink = newTSVerifier(sink)
+	}
+
+	if Flags.VerboseMux {
+		sink = newPSILogger(sink)
+	}
+
+	if Flags.TSMuxRate > 0 {
+		sink = newNullStuffer(sink, Flags.TSMuxRate)
+	}
+
+	if Flags.DVBEIT {
+		sink = newEITWriter(sink)
+	}
+
+	if ticks := Flags.TimestampOffset.Ticks(); ticks != 0 {
+		sink = newTSOffsetter(sink, ticks)
+	}
+
+	if Flags.PCRInterval > 0 {
+		sink = newPCRPacer(sink, tsPCRPID(), Flags.PCRInterval)
+	}
+
+	remap := newPIDRemapper(sink)
+
+	mux := ts.NewMux(remap)
+	addMux(mux)
+
+	var wg sync.WaitGroup
+
+	// ready is closed once the first elementary stream has been set up, or every program has given up on doing so.
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	markReady := func() {
+		readyOnce.Do(func() { close(ready) })
+	}
+
+	feeds := make([]*muxFeed, programs)
+
+	for i := range feeds {
+		prog, err := mux.NewProgram(ctx, tsProgramNumber(i))
+		if err != nil {
+			for _, feed := range feeds[:i] {
+				feed.in.Close()
+			}
+			wg.Wait()
+
+			removeMux(mux)
+			sink.Close()
+			return nil, err
+		}
+
+		name := filename
+		if programs > 1 {
+			name = fmt.Sprintf("%s: program %d", filename, tsProgramNumber(i))
+		}
+
+		feeds[i] = startMuxFeed(ctx, name, i, prog, remap, &wg, fail, markReady)
+	}
+
+	go func() {
+		for _, feed := range feeds {
+			<-feed.started
+		}
+
+		markReady()
+	}()
+
+	if r, ok := f.(*rotatingWriter); ok {
+		// Each new file starts a new recording, so mark the discontinuity in the stream at the boundary.
+		r.OnRotate(func() {
+			for _, feed := range feeds {
+				feed.markDiscontinuity()
+			}
+		})
+	}
+
+	if s, ok := f.(discontinuityMarker); ok {
+		for _, feed := range feeds {
+			streamDiscontinuity := feed.discontinuity
+
+			feed.discontinuity = func() {
+				streamDiscontinuity()
+				s.Discontinuity()
+			}
+		}
+	}
+
+	served := make(chan struct{})
+
+	go func() {
+		defer close(served)
+
+		<-ready
+
+		var ok bool
+		for _, feed := range feeds {
+			if feed.writer() != nil {
+				ok = true
+			}
+		}
+
+		if !ok {
+			// Without an elementary stream, there is nothing to serve.
+			return
+		}
+
+		for err := range mux.Serve(ctx) {
+			muxServeErrors.Inc()
+			logEvent("error", "mux-error", "output", filename, "error", err)
+			glog.Errorf("mux.Serve: %s: %+v", filename, err)
+			fail()
+		}
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		wg.Wait()
+		for err := range mux.Close() {
+			glog.Errorf("mux.Close: %+v", err)
+			muxServeErrors.Inc()
+			logEvent("error", "mux-error", "output", filename, "error", err)
+		}
+		removeMux(mux)
+
+		// Do not close the sink while the mux could still be writing a preamble to it.
+		<-served
+
+		if err := sink.Close(); err != nil {
+			glog.Errorf("%s: %+v", sink.Name(), err)
+		}
+	}()
+
+	p := &muxPipeline{
+		closeWaiter: &closeWaiter{
+			WriteCloser: feeds[0].in,
+			done:        done,
+		},
+		discontinuity: feeds[0].discontinuity,
+		failed:        failed,
+	}
+
+	for i, feed := range feeds {
+		var in io.WriteCloser = feed.in
+		if i == 0 {
+			in = p.closeWaiter
+		}
+
+		p.programs = append(p.programs, in)
+		p.discontinuities = append(p.discontinuities, feed.discontinuity)
+	}
+
+	return p, nil
+}
+
+// muxFeed is the input of one program of a ts.Mux.
+//
+// It splits the stream into whole frames, and once it has seen the first one,
+// it adds an elementary stream of the right stream_type to the program.
+type muxFeed struct {
+	in io.WriteCloser
+
+	// discontinuity resyncs the framer after a reconnect, as well as marking the discontinuity in the elementary stream,
+	// which is all that markDiscontinuity does.
+	discontinuity     func()
+	markDiscontinuity func()
+
+	// started is closed once the elementary stream has been set up, or we have given up on doing so.
+	started chan struct{}
+
+	mu sync.Mutex
+	wr io.WriteCloser
+}
+
+// writer returns the elementary stream of the feed, or nil if it has not been set up.
+func (feed *muxFeed) writer() io.WriteCloser {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	return feed.wr
+}
+
+// startMuxFeed starts the goroutine that feeds the stream written to the returned muxFeed into the given program,
+// which is the index'th program of the mux.
+//
+// The goroutine is added to wg, it calls fail if the elementary stream fails,
+// and it calls ready once the elementary stream has been added to the program.
+func startMuxFeed(ctx context.Context, filename string, index int, prog *ts.Program, remap *pidRemapper, wg *sync.WaitGroup, fail, ready func()) *muxFeed {
+	feed := &muxFeed{
+		started: make(chan struct{}),
+	}
+
+	// We cannot know the stream_type until we have seen the start of the stream,
+	// so the elementary stream is only added to the program once the first data arrives.
+	feed.markDiscontinuity = func() {
+		if s, ok := feed.writer().(discontinuityMarker); ok {
+			s.Discontinuity()
+		}
+	}
+
+	pipe := bufpipe.New(ctx, maxBufferOptions()...)
+	rd := bufio.NewReaderSize(pipe, sniffSize)
+
+	feed.in = pipe
+	if Flags.BufferPrefill != (byteSize{}) {
+		feed.in = newPrefillWriter(pipe, filename)
+	}
+	frames := newFrameScanner(rd)
+
+	// After a reconnect, any partial frame left at the seam must be discarded, and we must resync on the next whole frame.
+	feed.discontinuity = func() {
+		frames.Discontinuity()
+		feed.markDiscontinuity()
+	}
+
+	// newWriter waits for the first whole frame of the stream, and then adds an elementary stream of the right stream_type.
+	newWriter := func() (io.WriteCloser, error) {
+		defer close(feed.started)
+
+		head, err := rd.Peek(sniffSize)
+		if len(head) == 0 {
+			if err == io.EOF {
+				// The input ended before it even started, which is not an error.
+				err = nil
+			}
+
+			return nil, err
+		}
+
+		if isOgg(head) {
+			return nil, errors.New("Ogg streams cannot be muxed into MPEG-TS")
+		}
+
+		if !frames.Scan() {
+			return nil, frames.Err()
+		}
+
+		typ, err := detectStreamType(frames.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		if params := describeFrame(typ, frames.Bytes()); params != "" {
+			glog.Infof("mpegts: %s: stream_type 0x%02X: %s: %s", filename, byte(typ), codecName(typ), params)
+		} else {
+			glog.Infof("mpegts: %s: stream_type 0x%02X: %s", filename, byte(typ), codecName(typ))
+		}
+		setStreamCodec(typ)
+
+		w, err := prog.NewWriter(ctx, typ)
+		if err != nil {
+			return nil, err
+		}
+
+		remap.addProgram(index, prog.PID(), prog.StreamPIDs()[0])
+
+		feed.mu.Lock()
+		feed.wr = w
+		feed.mu.Unlock()
+
+		ready()
+
+		return w, nil
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// However we stop, keep draining the input, so that we do not block the other outputs.
+		defer io.Copy(io.Discard, rd)
+
+		if p, ok := feed.in.(*prefillWriter); ok {
+			select {
+			case <-p.Ready():
+			case <-ctx.Done():
+			}
+		}
+
+		wr, err := newWriter()
+		if err != nil {
+			glog.Errorf("mpegts: %s: %+v", filename, err)
+			return
+		}
+
+		if wr == nil {
+			// The input ended before it even started.
+			return
+		}
+
+		defer func() {
+			if err := wr.Close(); err != nil {
+				glog.Errorf("mux.Writer.Close: %+v", err)
+				muxWriteErrors.Inc()
+				logEvent("error", "mux-error", "output", filename, "error", err)
+			}
+		}()
+
+		for {
+			b := frames.Bytes()
+
+			n, err := wr.Write(b)
+			if err != nil {
+				glog.Errorf("mux.Writer.Write: %+v", err)
+				muxWriteErrors.Inc()
+				logEvent("error", "mux-error", "output", filename, "error", err)
+				fail()
+				return
+			}
+
+			if n < len(b) {
+				glog.Errorf("mux.Writer.Write: %+v", io.ErrShortWrite)
+				muxWriteErrors.Inc()
+				logEvent("error", "mux-error", "output", filename, "error", io.ErrShortWrite)
+			}
+
+			if !frames.Scan() {
+				break
+			}
+		}
+
+		if err := frames.Err(); err != nil {
+			glog.Errorf("framer: %s: %+v", filename, err)
+			framerErrors.Inc()
+			logEvent("error", "mux-error", "output", filename, "error", err)
+
+			// A bufio.Scanner never scans again after an error, so only a rebuild can get the mux going again.
+			fail()
+		}
+	}()
+
+	return feed
+}
+
+type namedWriteCloser interface {
+	io.WriteCloser
+	Name() string
+}
+
+// openMuxOutput opens the sink that the ts.Mux will write the MPEG-TS into.
+func openMuxOutput(ctx context.Context, filename string, isHLS bool) (namedWriteCloser, error) {
+	if isHLS {
+		w, err := newHLSWriter(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
+
+	filename = strings.TrimPrefix(filename, "mpegts:")
+
+	if !isSocketOutput(filename) && isRotatingOutput(filename) {
+		w, err := newRotatingWriter(ctx, filename, true)
+		if err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
+
+	uri, err := url.Parse(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []files.Option
+
+	if isSocketOutput(filename) {
+		opts = append(opts, socketfiles.WithIgnoreErrors(true))
+	}
+
+	q := uri.Query()
+
+	// RTP is sent over UDP, and can be selected either by the rtp: scheme, or with ?rtp=1 on a udp: URL.
+	isRTP := uri.Scheme == "rtp"
+	if uri.Scheme == "udp" && q.Get("rtp") != "" {
+		isRTP, err = strconv.ParseBool(q.Get("rtp"))
+		if err != nil {
+			return nil, errors.Errorf("bad rtp value: %s: %+v", q.Get("rtp"), err)
+		}
+
+		q.Del("rtp")
+	}
+
+	if isRTP {
+		uri.Scheme = "udp"
+	}
+
+	isMulticast := uri.Scheme == "udp" && isMulticastOutput(uri)
+
+	// With --udp-latency, the datagram size is only chosen once the bitrate of the stream is known.
+	withLatency := func(w namedWriteCloser, maxSize int) namedWriteCloser { return w }
+
+	if !isMulticast && q.Get(fieldInterface) != "" {
+		return nil, errors.Errorf("%s is only supported for multicast outputs", fieldInterface)
+	}
+
+	// Each write to a datagram socket is sent as a single datagram, so it must be made of whole mpegts packets.
+	if uri.Scheme == "udp" || uri.Scheme == "unixgram" {
+		// Default packet size: what the flag --packet-size is.
+		pktSize := Flags.PacketSize
+
+		if urlPktSize := q.Get(socketfiles.FieldPacketSize); urlPktSize != "" {
+			// If the output URL has a urlPktSize value, override the default.
+			sz, err := strconv.ParseInt(urlPktSize, 0, strconv.IntSize)
+			if err != nil {
+				return nil, errors.Errorf("bad %s value: %s: %+v", socketfiles.FieldPacketSize, urlPktSize, err)
+			}
+
+			pktSize = int(sz)
+
+		} else if uri.Scheme == "udp" && Flags.UDPLatency > 0 {
+			withLatency = newLatencySizer
+		}
+
+		// Our packet size needs to be an integer multiple of the mpegts packet size.
+		pktSize -= (pktSize % ts.PacketSize)
+
+		// Our packet size needs to be at least the mpegts packet size.
+		if pktSize <= 0 {
+			pktSize = ts.PacketSize
+		}
+
+		q.Set(socketfiles.FieldPacketSize, fmt.Sprint(pktSize))
+
+		if isRTP {
+			// The rtpWriter does its own packetizing, so that each of its Writes is sent as a single datagram.
+			q.Del(socketfiles.FieldPacketSize)
+		}
+
+		uri.RawQuery = q.Encode()
+		filename = uri.String()
+
+		open := func() (namedWriteCloser, error) {
+			if isMulticast {
+				return newMulticastWriter(uri)
+			}
+
+			return files.Create(ctx, filename, opts...)
+		}
+
+		if isRTP {
+			f, err := open()
+			if err != nil {
+				return nil, err
+			}
+
+			return withLatency(newRTPWriter(f, pktSize, uint32(Flags.RTPSSRC)), pktSize), nil
+		}
+
+		if uri.Scheme == "udp" {
+			f, err := open()
+			if err != nil {
+				return nil, err
+			}
+
+			return withLatency(f, pktSize), nil
+		}
+	}
+
+	if isUnixScheme(uri.Scheme) {
+		laddr := q.Get(socketfiles.FieldLocalAddress)
+		if laddr == "" {
+			return files.Create(ctx, filename, opts...)
+		}
+
+		removeStaleSocket(laddr)
+
+		f, err := files.Create(ctx, filename, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &unixSocketWriter{
+			namedWriteCloser: f,
+			laddr:            laddr,
+		}, nil
+	}
+
+	// Every ts.Mux starts with its PSI preamble, so appending to an existing recording remains demuxable.
+	return createOutput(ctx, filename, ts.PacketSize)
+}
+
+// errTooManyRetries is returned when more than --max-retries consecutive reconnects have failed.
+var errTooManyRetries = errors.New("too many consecutive failed reconnects")
+
+// errCopyFailed is returned with --once, when the copy from the stream ends with an error, since we will not be reconnecting.
+var errCopyFailed = errors.New("copy from stream failed")
+
+// ICECASTReader returns an io.Reader that reads an ICECAST stream from the first of the given filenames,
+// failing over to the others in turn, if it fails.
+func ICECASTReader(ctx context.Context, filenames []string, discontinuity func()) (io.Reader, error) {
+	sources := newSourceSet(filenames)
+
+	// never log the credentials.
+	filename := sources.Primary().Name()
+
+	// A static file is resumed with a Range request, rather than copied again from the start.
+	var resume rangeResume
+
+	// Only the primary stream is shown by --progress, the other programs of --multi-program are not.
+	showsProgress := Flags.Progress && programIndex(ctx) == 0
+
+	// pipe is only made after the first open, since its size can depend upon the icy-br of the stream.
+	var pipe *errPipe
+
+	// looping is set when a --loop source has ended, until we have reopened it from the start,
+	// which is a seam, but not a reconnect, so what is still buffered is the end of the source, and is never dropped.
+	var looping bool
+
+	seam := func() {
+		if pipe != nil && Flags.DiscontinuityPolicy == discontinuityDrop && !looping {
+			pipe.Discard()
+		}
+
+		discontinuity()
+	}
+
+	// fallback is only made along with the pipe, but it keeps on playing through every reopen, until one of them succeeds.
+	var fallback *fallbackPlayer
+
+	reopen := func(all bool) (files.Reader, error) {
+		cur, _ := sources.Current()
+
+		offset := resume.next(cur)
+
+		f, err := sources.Open(withRangeOffset(withNextUserAgent(ctx), offset), all)
+		if err != nil {
+			return nil, err
+		}
+
+		// Switching back from the fallback is a seam, even if we resume the stream right where it left off.
+		fromFallback := fallback.Playing()
+		fallback.Stop()
+
+		cur, _ = sources.Current()
+		if resumed := resume.opened(cur, f, offset); !resumed || fromFallback {
+			// We are starting over, so the data is not continuous.
+			seam()
+		}
+
+		if showsProgress {
+			progressOpened(f)
+		}
+
+		return f, nil
+	}
+
+	retry := newBackoff()
+
+	// Only the primary stream is kept in the --state-file, the other programs of --multi-program start over each time.
+	var state *reconnectState
+	if Flags.StateFile != "" && programIndex(ctx) == 0 {
+		state = loadReconnectState(Flags.StateFile)
+		sources.Restore(state)
+
+		_, backoff, retryAt := state.resume()
+		retry.Restore(backoff)
+
+		if wait := time.Until(retryAt); wait > 0 {
+			glog.Infof("--state-file: the last run was backing off, reconnecting in %v", wait.Truncate(time.Millisecond))
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	f, err := reopen(true)
+	if err != nil {
+		// We are about to exit, so leave the next run to wait out the backoff that we would have.
+		delay := retry.Next()
+		_, src := sources.Current()
+		state.backingOff(src.Name(), retry.cur, time.Now().Add(delay))
+
+		return nil, err
+	}
+
+	live, _ := sources.Current()
+	stream := announceSource(ctx, f, true)
+
+	// The watchdog is added to these for each copy, since with --adaptive-timeout, it depends upon the stream that we connected to.
+	var opts []files.CopyOption
+
+	bufferSize := Flags.BufferSize.Bytes(streamBitrate())
+	if bufferSize > 0 {
+		opts = append(opts, files.WithBufferSize(bufferSize))
+	}
+
+	reconnects := reconnects.WithLabels(labelStream.WithValue(stream))
+	silenceEvents := silenceEvents.WithLabels(labelStream.WithValue(stream))
+	titleStalls := titleStalls.WithLabels(labelStream.WithValue(stream))
+	fastFails := fastFails.WithLabels(labelStream.WithValue(stream))
+	uptime := connUptime.WithLabels(labelStream.WithValue(stream))
+	uptime.Set(0) // publish the series now, and avoid racing trackUptime goroutines on its lazy initialization.
+
+	pipe = newErrPipe(ctx, maxBufferOptions()...)
+
+	// The fallback is not stream data, so it goes straight into the pipe, rather than through a dataWriter.
+	fallback = newFallbackPlayer(ctx, pipe)
+
+	var failures int
+
+	// retryAfter is how long the server told us to wait, when it refused our last reconnect with a 429 or 503.
+	var retryAfter time.Duration
+
+	// During an outage, every reconnect fails in the same way, so do not log the same error every time.
+	var errs dedupLogger
+
+	go func() {
+		defer pipe.Close()
+		defer fallback.Stop()
+
+		for {
+			start := time.Now()
+
+			if looping {
+				var err error
+				f, err = reopen(false)
+				if err != nil {
+					errs.Errorf("[%s] %+v", errorClass(err), err)
+					retryAfter = serverRetryAfter(err)
+				}
+
+				looping = false
+			}
+
+			// If the reopen failed, then there is nothing to copy, and we go straight to the backoff.
+			if f != nil {
+				if cur, _ := sources.Current(); cur != live {
+					live = cur
+					announceSource(ctx, f, false)
+				}
+
+				if glog.V(1) {
+					glog.Infof("copying to buffer: %s", f.Name())
+				}
+
+				f := f
+				stopProbe := sources.ProbePrimary(ctx, func() { f.Close() })
+
+				var w io.Writer = dataWriter{pipe}
+				if showsProgress {
+					w = io.MultiWriter(w, progressPosition{})
+				}
+
+				var silence *silenceDetector
+				if Flags.SilenceTimeout > 0 {
+					silence = newSilenceDetector(Flags.SilenceTimeout, Flags.SilenceThreshold, func() {
+						silenceEvents.Inc()
+						f.Close()
+					})
+
+					w = io.MultiWriter(w, silence)
+				}
+
+				var stall *titleStallDetector
+				if Flags.TitleStallTimeout > 0 {
+					stall = newTitleStallDetector(func() {
+						titleStalls.Inc()
+						f.Close()
+					})
+
+					w = io.MultiWriter(w, stall)
+				}
+
+				stop := trackUptime(uptime, start)
+				timeout := streamTimeout(f, bufferSize)
+				if glog.V(2) {
+					glog.Infof("%s: watchdog timeout: %v", f.Name(), timeout)
+				}
+
+				n, err := copyStream(ctx, w, f, append(opts, files.WithWatchdogTimeout(timeout))...)
+				stop()
+				stopProbe()
+				streamDown()
+
+				if err != nil {
+					logEvent("error", "disconnect", "stream", f.Name(), "bytes", n, "duration", time.Since(start), "class", errorClass(err), "error", err)
+				} else {
+					logEvent("info", "disconnect", "stream", f.Name(), "bytes", n, "duration", time.Since(start))
+				}
+
+				if ctx.Err() != nil {
+					// We are shutting down, so this is not a failure of the stream.
+					if n > 0 {
+						sources.Succeeded()
+					}
+					return
+				}
+
+				resume.copied(n)
+
+				if Flags.Loop && err == nil && n > 0 && (resume.total <= 0 || resume.complete()) {
+					if glog.V(1) {
+						glog.Infof("%s: ended after %d bytes, looping back to the start", f.Name(), n)
+					}
+					logEvent("info", "loop", "stream", f.Name(), "bytes", n)
+
+					// Playing all the way through is as good a copy as any.
+					failures = 0
+					sources.Succeeded()
+					errs.Reset()
+
+					resume.rewind()
+					looping = true
+					continue
+				}
+
+				if resume.complete() {
+					glog.Infof("%s: complete after %d bytes", f.Name(), resume.offset)
+					logEvent("info", "copy-complete", "stream", f.Name(), "bytes", resume.offset)
+					return
+				}
+
+				if err != nil {
+					errs.Errorf("[%s] %v", countError(err), err)
+
+					if n > 0 {
+						glog.Errorf("%d bytes copied in %v", n, time.Since(start))
+					}
+
+				} else {
+					// The server closed the stream on us, which is just as reconnect-worthy, unless it is all that we wanted.
+					if !Flags.Once {
+						countError(io.EOF)
+					}
+
+					if glog.V(2) {
+						glog.Infof("%d bytes copied in %v", n, time.Since(start))
+					}
+				}
+
+				if Flags.Once {
+					if err != nil {
+						pipe.CloseWithError(errors.Wrap(errCopyFailed, f.Name()))
+						return
+					}
+
+					glog.Infof("%s: finished after %d bytes", f.Name(), n)
+					logEvent("info", "copy-complete", "stream", f.Name(), "bytes", n)
+					return
+				}
+
+				alive := time.Since(start)
+				retry.Succeeded(alive)
+
+				switch {
+				case silence != nil && silence.Fired(), stall != nil && stall.Fired():
+					// Dead air, or a stuck playlist, is as much a failure of the source as not getting any data at all.
+					sources.Failed()
+				case n > 0 && n < int64(Flags.FastFailBytes) && alive < Flags.FastFailTime:
+					// Even though we did get something, the connection is not working, so keep on backing off.
+					fastFails.Inc()
+					errs.Errorf("%s: closed after only %d bytes in %v", f.Name(), n, alive)
+					logEvent("warning", "fast-fail", "stream", f.Name(), "bytes", n, "duration", alive)
+					sources.Failed()
+				case n > 0:
+					failures = 0
+					sources.Succeeded()
+					errs.Reset()
+				default:
+					sources.Failed()
+				}
+			}
+
+			if Flags.MaxRetries > 0 && failures >= Flags.MaxRetries {
+				pipe.CloseWithError(errors.Wrapf(errTooManyRetries, "%s: %d", filename, failures))
+				return
+			}
+
+			if fallback != nil && !fallback.Playing() {
+				// We have lost the stream, so the fallback fills in from now, until a reopen succeeds.
+				discontinuity()
+				fallback.Start()
+			}
+
+			delay := retry.Next()
+
+			if retryAfter > delay {
+				if glog.V(1) {
+					glog.Infof("honoring Retry-After of %v, rather than reconnecting in %v", retryAfter, delay)
+				}
+
+				delay = retryAfter
+			}
+			retryAfter = 0
+
+			if sources.TakeSwitched() {
+				// We are switching back to the primary, which we know is up, so there is no need to wait.
+				delay = 0
+				retry.Reset()
+			}
+
+			if glog.V(2) {
+				glog.Infof("reconnecting in %v", delay)
+			}
+			logEvent("info", "reconnect", "stream", filename, "attempt", failures+1, "delay", delay)
+
+			_, src := sources.Current()
+			state.backingOff(src.Name(), retry.cur, start.Add(delay))
+
+			wait := time.NewTimer(time.Until(start.Add(delay)))
+
+			select {
+			case <-wait.C:
+			case <-ctx.Done():
+				wait.Stop()
+				return
+			}
+
+			failures++
+			reconnects.Inc()
+			progress.reconnects.Add(1)
+
+			var err error
+			f, err = reopen(false)
+			if err != nil {
+				errs.Errorf("[%s] %+v", errorClass(err), err)
+				retryAfter = serverRetryAfter(err)
+			}
+		}
+	}()
+
+	return pipe, nil
+}
+
+// trackUptime keeps the gauge updated with the time since start, until the returned function is called.
+func trackUptime(g *metrics.GaugeValue, start time.Time) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				g.Set(0)
+				return
+			case <-ticker.C:
+				g.SetToDuration(time.Since(start))
+			}
 		}
+	}()
 
-		q.Set(socketfiles.FieldPacketSize, fmt.Sprint(pktSize))
+	return func() {
+		close(done)
+	}
+}
 
-		uri.RawQuery = q.Encode()
-		filename = uri.String()
+// announceSource prints the headers of the given stream, and updates the DVB service to describe it.
+// If first is true, then it also writes out the --headers-json.
+//
+// It returns the name of the stream.
+func announceSource(ctx context.Context, f files.Reader, first bool) (stream string) {
+	index := programIndex(ctx)
 
-		opts = append(opts, socketfiles.WithIgnoreErrors(true))
+	stream = f.Name()
+	if index == 0 {
+		setPlayerStream(f.Name())
 	}
 
-	f, err := files.Create(ctx, filename, opts...)
-	if err != nil {
-		return nil, nil, err
+	h, ok := f.(headerer)
+	if !ok {
+		return stream
 	}
-	glog.Infof("output: %s", f.Name())
 
-	mux = ts.NewMux(f)
+	if name := printIcyHeaders(h); name != "" {
+		stream = name
+	}
 
-	var wg sync.WaitGroup
+	if index > 0 {
+		// The other programs only describe their own DVB service.
+		DVBProgramService(index, &dvb.ServiceDescriptor{
+			Type:     dvb.ServiceTypeRadio,
+			Provider: Flags.DVBProvider,
+			Name:     stream,
+		})
 
-	wr, err := mux.Writer(ctx, 1, ts.ProgramTypeAudio)
-	if err != nil {
-		f.Close()
-		return nil, nil, err
+		return stream
 	}
 
-	if s, ok := wr.(discontinuityMarker); ok {
-		discontinuity = s.Discontinuity
+	setID3Info(h)
+	setRelayInfo(h)
+	setEventInfo(h)
+
+	if first && Flags.HeadersJSON != "" {
+		if err := writeHeadersJSON(ctx, Flags.HeadersJSON, f.Name(), h); err != nil {
+			glog.Errorf("writeHeadersJSON: %+v", err)
+		}
 	}
 
-	pipe := bufpipe.New(ctx)
-	s := framer.NewScanner(pipe)
+	name := stream
+	if Flags.DVBServiceName != "" {
+		name = Flags.DVBServiceName
+	}
 
-	wg.Add(1)
-	go func() {
-		defer func() {
-			if err := wr.Close(); err != nil {
-				glog.Errorf("mux.Writer.Close: %+v", err)
-			}
+	ServiceDesc := &dvb.ServiceDescriptor{
+		Type:     dvb.ServiceTypeRadio,
+		Provider: Flags.DVBProvider,
+		Name:     name,
+	}
 
-			wg.Done()
-		}()
+	DVBService(ServiceDesc)
 
-		for s.Scan() {
-			b := s.Bytes()
+	return stream
+}
 
-			n, err := wr.Write(b)
-			if err != nil {
-				glog.Errorf("mux.Writer.Write: %+v", err)
-				return
-			}
+// openSource opens the given source, and ensures that the connection has actually been made.
+//
+// With --connect-timeout, it gives up if it has not gotten the headers of the stream in time.
+// This cannot be a context deadline, since the stream is read with the same context that it is opened with,
+// so instead, the context is canceled only if the timeout fires before we have connected.
+func openSource(ctx context.Context, src source) (files.Reader, error) {
+	ctx, err := withStreamClient(ctx, src)
+	if err != nil {
+		return nil, err
+	}
 
-			if n < len(b) {
-				glog.Errorf("mux.Writer.Write: %+v", io.ErrShortWrite)
-			}
-		}
+	if Flags.ConnectTimeout <= 0 {
+		return connectSource(ctx, src)
+	}
 
-		if err := s.Err(); err != nil {
-			glog.Errorf("framer.Scanner: %s: %+v", filename, err)
+	ctx, cancel := context.WithCancel(ctx)
+	t := time.AfterFunc(Flags.ConnectTimeout, cancel)
+
+	f, err := connectSource(ctx, src)
+	if !t.Stop() {
+		// Even if we did just connect, the context is now canceled, which would end the stream right away.
+		if err == nil {
+			f.Close()
+			err = context.Canceled
 		}
-	}()
 
-	out := newTriggerWriter(pipe)
+		return nil, &connectTimeoutError{err}
+	}
 
-	go func() {
-		<-out.Trigger()
-		for err := range mux.Serve(ctx) {
-			glog.Fatalf("mux.Serve: %+v", err)
-		}
-	}()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
-	go func() {
-		wg.Wait()
-		for err := range mux.Close() {
-			glog.Errorf("mux.Close: %+v", err)
-		}
-	}()
+	// The stream is read with this context, so it can only be released once the stream is closed.
+	return cancelOnClose(f, cancel), nil
+}
 
-	return out, discontinuity, nil
+// cancelReader cancels the context that a stream was opened with, once it is closed.
+type cancelReader struct {
+	files.Reader
+	cancel context.CancelFunc
 }
 
-// DVBService sets the dvb.ServiceDescriptor to be used by the muxer.
-func DVBService(desc *dvb.ServiceDescriptor) {
-	if mux != nil {
-		service := &dvb.Service{
-			ID: 0x0001,
-		}
-		service.Descriptors = append(service.Descriptors, desc)
+func (r *cancelReader) Close() error {
+	err := r.Reader.Close()
+	r.cancel()
+	return err
+}
 
-		sdt := &dvb.ServiceDescriptorTable{
-			Syntax: &psi.SectionSyntax{
-				TableIDExtension: 1,
-				Current:          true,
-			},
-			OriginalNetworkID: 0xFF01,
-			Services:          []*dvb.Service{service},
-		}
-		mux.SetDVBSDT(sdt)
+// cancelHeaderReader is a cancelReader of a stream that has headers.
+type cancelHeaderReader struct {
+	*cancelReader
+	headerer
+}
 
-		switch {
-		case glog.V(5) == true:
-			glog.Infof("dvb.sdt: %v", sdt)
+// cancelOnClose wraps f, so that closing it also calls cancel.
+func cancelOnClose(f files.Reader, cancel context.CancelFunc) files.Reader {
+	r := &cancelReader{
+		Reader: f,
+		cancel: cancel,
+	}
 
-		case glog.V(2) == true:
-			glog.Infof("DVB Service Description: %v", desc)
-		}
+	if h, ok := f.(headerer); ok {
+		return &cancelHeaderReader{r, h}
 	}
+
+	return r
 }
 
-// ICECASTReader returns an io.Reader from the given filename that reads an ICECAST stream.
-func ICECASTReader(ctx context.Context, filename string, discontinuity func()) (io.Reader, error) {
-	reopen := func() (files.Reader, error) {
-		discontinuity()
+// connectSource opens the given source, whose context already has its stream client.
+func connectSource(ctx context.Context, src source) (files.Reader, error) {
+	// BUG: if you attempt to load a SHOUTcast 1.9.x address,
+	// it will return an HTTP version field of "ICY" not "HTTP/x.y",
+	// and Go’s net/http library will barf and return an error.
+	// There is no way at this time to tell it to treat said HTTP version as "HTTP/1.0",
+	// so with --allow-icy-protocol we hijack the connection through an icyConn,
+	// which looks to see if it starts with ICY, and replaces that with HTTP/1.0…
+	//
+	// BETTER: net/http should allow one to say "ICY" maps to HTTP/1.0,
+	// it already has short-circuits for "HTTP/1.0" and "HTTP/1.1" after all.
+	f, err := files.Open(ctx, src.filename)
+	if err != nil {
+		return nil, maskError(err, src)
+	}
 
-		// BUG: if you attempt to load a SHOUTcast 1.9.x address,
-		// it will return an HTTP version field of "ICY" not "HTTP/x.y",
-		// and Go’s net/http library will barf and return an error.
-		// There is no way at this time to tell it to treat said HTTP version as "HTTP/1.0"
-		// without possibly hijacking the stream through a text transform that looks to see if it
-		// starts with ICY, and replaces that with HTTP/1.0…
-		//
-		// BETTER: net/http should allow one to say "ICY" maps to HTTP/1.0,
-		// it already has short-circuits for "HTTP/1.0" and "HTTP/1.1" after all.
-		f, err := files.Open(ctx, filename)
-		if err != nil {
-			return nil, err
+	if h, ok := f.(headerer); ok {
+		// HTTP files are opened lazily, so this is where we actually find out if we could connect.
+		if _, err := h.Header(); err != nil {
+			f.Close()
+			return nil, maskError(err, src)
 		}
 
-		if glog.V(2) && f.Name() != filename {
-			glog.Infof("catting %s", f.Name())
+		if err := checkContentType(h); err != nil {
+			f.Close()
+			return nil, maskError(err, src)
 		}
 
-		return f, err
-	}
+		checkPreferredCodec(h)
 
-	f, err := reopen()
-	if err != nil {
-		return nil, err
+		if programIndex(ctx) == 0 {
+			setExpectedBitrate(h)
+		}
 	}
 
-	if h, ok := f.(headerer); ok {
-		name := printIcyHeaders(h)
-		if name == "" {
-			name = f.Name()
-		}
+	f = maskReader(f, src)
 
-		ServiceDesc := &dvb.ServiceDescriptor{
-			Type:     dvb.ServiceTypeRadio,
-			Provider: "icycat",
-			Name:     name,
+	if glog.V(1) {
+		if name := resolvedName(f); name != src.Name() {
+			glog.Infof("final url: %s", name)
 		}
-
-		DVBService(ServiceDesc)
 	}
 
-	opts := []files.CopyOption{
-		files.WithWatchdogTimeout(Flags.Timeout),
+	return f, nil
+}
+
+// resolvedName returns the name of the given file after any redirects.
+func resolvedName(f files.Reader) string {
+	if info, err := f.Stat(); err == nil && info.Name() != "" {
+		return info.Name()
 	}
 
-	pipe := bufpipe.New(ctx)
+	return f.Name()
+}
 
-	go func() {
-		defer pipe.Close()
+// copyStream copies the ICECAST stream from f into w, stripping out any inline metadata.
+//
+// Since we reopen on every reconnect, copyStream closes f when it is done.
+func copyStream(ctx context.Context, w io.Writer, f files.Reader, opts ...files.CopyOption) (int64, error) {
+	var rd io.Reader = f
 
-		for {
-			start := time.Now()
-			wait := time.After(Flags.Timeout)
+	if rawDump != nil && programIndex(ctx) == 0 {
+		// This comes before the metadata is stripped out, so that the dump has the stream exactly as it was sent.
+		rd = io.TeeReader(rd, rawDump)
+	}
+
+	if h, ok := f.(headerer); ok {
+		metaint, err := getMetaInt(h)
+		if err != nil {
+			glog.Error(err)
+		}
 
-			if glog.V(1) {
-				glog.Infof("copying to buffer: %s", f.Name())
+		if metaint > 0 {
+			if glog.V(2) {
+				glog.Infof("icy-metaint: %d", metaint)
 			}
 
-			n, err := files.Copy(ctx, pipe, f, opts...)
+			rd = newMetaReader(rd, metaint, titleSetter(ctx))
+		}
+	}
 
-			// We reopen in every loop, so after files.Copy, we have to Close it.
-			if err2 := f.Close(); err == nil {
-				err = err2
-			}
+	n, err := files.Copy(ctx, w, rd, opts...)
 
-			if err != nil {
-				glog.Error(err)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
 
-				if n > 0 {
-					glog.Errorf("%d bytes copied in %v", n, time.Since(start))
-				}
+	return n, err
+}
 
-			} else if glog.V(2) {
-				glog.Infof("%d bytes copied in %v", n, time.Since(start))
-			}
+// validateMetricsNetwork returns an error if --metrics-network is not one that we can listen on.
+func validateMetricsNetwork() error {
+	switch Flags.MetricsNetwork {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
 
-			select {
-			case <-wait:
-			case <-ctx.Done():
-				return
-			}
+	return errors.Errorf("bad --metrics-network: %q: must be one of tcp, tcp4, or tcp6", Flags.MetricsNetwork)
+}
 
-			f, err = reopen()
-			if err != nil {
-				glog.Errorf("%+v", err)
-			}
-		}
-	}()
+// listenMetrics listens for the metrics server on the --metrics-network, at the --metrics-address, or else the --metrics-port.
+func listenMetrics() (net.Listener, error) {
+	addr := Flags.MetricsAddress
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", Flags.MetricsPort)
+	}
 
-	return pipe, nil
+	return net.Listen(Flags.MetricsNetwork, addr)
 }
 
 func main() {
 	ctx, finish := process.Init("icycat", Version, Buildstamp)
 	defer finish()
 
+	if Flags.Config != "" {
+		if err := loadConfig(ctx, Flags.Config); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	var exitStatus int
+	defer func() {
+		if exitStatus != 0 {
+			process.Exit(exitStatus)
+		}
+	}()
+
 	ctx = httpfiles.WithUserAgent(ctx, Flags.UserAgent)
 
+	if err := loadUserAgents(ctx); err != nil {
+		glog.Fatal(err)
+	}
+
+	if err := loadFallbackAudio(ctx); err != nil {
+		glog.Fatal(err)
+	}
+
+	if Flags.DumpRaw != "" {
+		d, err := openRawDump(ctx, Flags.DumpRaw)
+		if err != nil {
+			glog.Fatalf("--dump-raw: %+v", err)
+		}
+		defer d.Close()
+
+		rawDump = d
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if Flags.Duration > 0 {
+		// The reader, including any reconnect in progress, stops at the deadline, just as on a SIGTERM.
+		ctx, cancel = context.WithTimeout(ctx, Flags.Duration)
+		defer cancel()
+	}
+
+	if Flags.ListSchemes {
+		// This needs no stream, so it comes before we insist on one.
+		if err := listSchemes(os.Stdout); err != nil {
+			glog.Error(err)
+			exitStatus = 1
+		}
+		return
+	}
+
+	if Flags.SelfTest {
+		// This needs no stream either, but it does need the outputs.
+		if err := expandOutputs(Flags.Output); err != nil {
+			glog.Fatal(err)
+		}
+
+		if err := selfTest(ctx, Flags.Output); err != nil {
+			glog.Error(err)
+			exitStatus = 1
+		}
+		return
+	}
+
 	args := flag.Args()
+
+	if Flags.URLFile != "" {
+		if len(args) > 0 {
+			glog.Fatal("--url-file cannot be used along with streams given as arguments")
+		}
+
+		// Keeping the URLs out of the arguments keeps them out of ps, as well as the logs.
+		urls, err := loadURLFile(ctx, Flags.URLFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		args = urls
+	}
+
 	if len(args) < 1 {
 		flag.Usage()
 		process.Exit(1)
@@ -377,40 +1647,131 @@ func main() {
 		stderr = nil
 	}
 
+	if err := validateLogFormat(); err != nil {
+		glog.Fatal(err)
+	}
+
+	if err := validateDiscontinuityPolicy(); err != nil {
+		glog.Fatal(err)
+	}
+
+	if err := validatePreferCodec(); err != nil {
+		glog.Fatal(err)
+	}
+
+	parseInputHeaders()
+
+	// Every use of the outputs, from --dry-run to --sap, needs to see the same expanded names.
+	if err := expandOutputs(Flags.Output); err != nil {
+		glog.Fatal(err)
+	}
+
 	if glog.V(2) {
 		if err := flag.Set("stderrthreshold", "INFO"); err != nil {
 			glog.Error(err)
 		}
 	}
 
+	if Flags.TLSInsecure {
+		msg := "WARNING: --tls-insecure is set, TLS certificates of https streams will NOT be verified"
+		fmt.Fprintln(os.Stderr, msg)
+		glog.Warning(msg)
+	}
+
+	if _, err := getBaseTransport(); err != nil {
+		glog.Fatal(err)
+	}
+
+	if Flags.Probe {
+		if err := probe(ctx, args); err != nil {
+			glog.Error(err)
+			exitStatus = 1
+		}
+		return
+	}
+
+	if Flags.DryRun {
+		if err := dryRun(ctx, Flags.Output, args); err != nil {
+			glog.Error(err)
+			exitStatus = 1
+		}
+		return
+	}
+
 	if Flags.MetricsPort != 0 || Flags.MetricsAddress != "" {
 		Flags.Metrics = true
 	}
 
+	if Flags.WebPlayer && !Flags.Metrics {
+		glog.Warning("--web-player has no effect without --metrics")
+	}
+
 	if Flags.Metrics {
-		go func() {
-			addr := Flags.MetricsAddress
-			if addr == "" {
-				addr = fmt.Sprintf(":%d", Flags.MetricsPort)
-			}
+		if err := validateMetricsNetwork(); err != nil {
+			glog.Fatal(err)
+		}
+
+		tlsConfig, err := newMetricsTLSConfig()
+		if err != nil {
+			glog.Fatal(err)
+		}
 
-			l, err := net.Listen("tcp", addr)
+		handler, err := newMetricsHandler()
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		go func() {
+			l, err := listenMetrics()
 			if err != nil {
 				glog.Fatal("net.Listen: ", err)
 			}
 
-			msg := fmt.Sprintf("metrics available at: http://%s/metrics", l.Addr())
+			scheme := "http"
+			if tlsConfig != nil {
+				scheme = "https"
+			}
+
+			msg := fmt.Sprintf("metrics available at: %s://%s/metrics", scheme, l.Addr())
 			fmt.Fprintln(os.Stderr, msg)
 			glog.Info(msg)
 
 			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 				http.Redirect(w, req, "/metrics", http.StatusMovedPermanently)
 			})
+			registerHealthHandlers()
+
+			if Flags.WebPlayer {
+				var playlist string
+				for _, filename := range Flags.Output {
+					if isHLSOutput(filename) {
+						playlist = hlsPlaylistName(filename)
+						break
+					}
+				}
 
-			srv := &http.Server{}
+				registerPlayerHandlers(playlist)
+
+				msg := fmt.Sprintf("web player available at: %s://%s/player", scheme, l.Addr())
+				fmt.Fprintln(os.Stderr, msg)
+				glog.Info(msg)
+			}
+
+			srv := &http.Server{
+				Handler:   handler,
+				TLSConfig: tlsConfig,
+			}
+
+			serve := srv.Serve
+			if tlsConfig != nil {
+				serve = func(l net.Listener) error {
+					// The certificate is already in the TLSConfig.
+					return srv.ServeTLS(l, "", "")
+				}
+			}
 
 			go func() {
-				if err := srv.Serve(l); err != nil {
+				if err := serve(l); err != nil {
 					if err != http.ErrServerClosed {
 						glog.Fatal("http.Server.Serve: ", err)
 					}
@@ -419,7 +1780,7 @@ func main() {
 
 			<-ctx.Done()
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, cancel := shutdownContext()
 			defer cancel()
 
 			if err := srv.Shutdown(ctx); err != nil {
@@ -430,17 +1791,99 @@ func main() {
 		}()
 	}
 
-	out, discontinuity, err := openOutput(ctx, Flags.Output)
-	if err != nil {
+	// On SIGTERM, ctx is canceled, which stops the reader, and the copy below then drains whatever is still buffered.
+	// The outputs must outlive ctx, so that closing them can flush the mux, and we end on a whole MPEG-TS packet.
+	octx, ocancel := context.WithCancel(context.Background())
+	defer ocancel()
+
+	// Deferred this early, the drain is only done once every output has been closed.
+	defer boundShutdown(ctx, ocancel)()
+
+	if err := validateStdout(Flags.Output); err != nil {
 		glog.Fatal(err)
 	}
+
+	// This has to be ready before the first SIGHUP, or else the process package treats it as a request to terminate.
+	reopenOnHangup(ctx)
+
+	// With --multi-program, each of the streams goes into its own program, rather than failing over between them.
+	streams := args
+
+	var programs []io.WriteCloser
+	var programDiscontinuities []func()
+
+	var out io.WriteCloser
+	var discontinuity func()
+	var err error
+
+	if Flags.MultiProgram && len(streams) > 1 {
+		programs, programDiscontinuities, err = openMultiProgramOutputs(octx, Flags.Output, len(streams))
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		out, discontinuity = programs[0], programDiscontinuities[0]
+
+		// Only the first stream is read as the primary, the rest are started after the outputs are all set up.
+		args = streams[:1]
+
+	} else {
+		out, discontinuity, err = openOutputs(octx, Flags.Output)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	outputTimeout := Flags.OutputTimeout
+	if outputTimeout <= 0 {
+		outputTimeout = Flags.Timeout
+	}
+	out = newWatchdogWriter(out, outputTimeout)
+
+	if Flags.MaxFilesize != (byteSize{}) {
+		// Stop just as with --duration, so that everything up to the limit is still flushed out.
+		out = newSizeLimitWriter(out, cancel)
+	}
+
+	if Flags.Throttle || Flags.Rate > 0 {
+		// The throttle must go outside the watchdog, or else the watchdog would count the pacing as a stall.
+		out = newThrottleWriter(ctx, out, float64(Flags.Rate))
+	}
+	// Closing the outputs finishes the last file of a rotating output, so wait for its --on-rotate after that.
+	defer waitOnRotate()
 	defer func() {
 		if err := out.Close(); err != nil {
 			glog.Error(err)
 		}
 	}()
 
-	arg, args := args[0], args[1:]
+	if len(programs) > 1 {
+		// The other programs must be closed before the primary one, which waits on the whole ts.Mux.
+		defer startPrograms(ctx, streams, programs, programDiscontinuities)()
+	}
+
+	if Flags.SAP {
+		stopSAP, err := startSAP(ctx, Flags.Output)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer stopSAP()
+	}
+
+	if Flags.StatusURL != "" {
+		if Flags.StatusInterval <= 0 {
+			glog.Fatalf("bad --status-interval: %v", Flags.StatusInterval)
+		}
+
+		go pollStatus(ctx, Flags.StatusURL)
+	}
+
+	if Flags.Progress && stderr != nil {
+		out = progressWriter{out}
+
+		stopProgress := showProgress(ctx, stderr)
+		defer stopProgress()
+	}
 
 	var opts []files.CopyOption
 
@@ -448,30 +1891,38 @@ func main() {
 		opts = append(opts,
 			files.WithMetricsScale(8), // bits instead of bytes
 			files.WithBandwidthMetrics(bwLifetime),
-			files.WithIntervalBandwidthMetrics(bwRunning, 10, 1*time.Second),
+			files.WithIntervalBandwidthMetrics(ratioObserver{bwRunning}, 10, 1*time.Second),
 		)
 	}
 
-	in, err := ICECASTReader(ctx, arg, discontinuity)
+	in, err := ICECASTReader(ctx, args, discontinuity)
 	if err != nil {
 		glog.Fatalf("ICECASTReader: %+v", err)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			glog.Error(ctx.Err())
-			return
-		default:
-		}
+	if size := Flags.BufferSize.Bytes(streamBitrate()); size > 0 {
+		opts = append(opts, files.WithBufferSize(size))
+	}
 
+	var failures int
+	var errs dedupLogger
+
+	for {
 		start := time.Now()
 		wait := time.After(Flags.Timeout)
 
-		n, err := files.Copy(ctx, out, in, opts...)
+		n, err := files.Copy(octx, out, in, opts...)
+		// Whatever the reason that the copy ended, nothing is flowing until it starts again.
+		streamDown()
 
-		if err != nil && err != io.EOF {
+		if cause := errors.Cause(err); cause == errTooManyRetries || cause == errCopyFailed || cause == errOutputFailed {
 			glog.Error(err)
+			exitStatus = 1
+			return
+		}
+
+		if err != nil && err != io.EOF {
+			errs.Errorf("[%s] %v", countError(err), err)
 
 			if n > 0 {
 				glog.Errorf("%d bytes copied in %v", n, time.Since(start))
@@ -481,10 +1932,29 @@ func main() {
 			glog.Infof("%d bytes copied in %v", n, time.Since(start))
 		}
 
-		if err == io.EOF {
+		// files.Copy only returns a nil error once the reader has been closed, which happens when ctx is canceled.
+		if err == nil || err == io.EOF {
+			if ctx.Err() != nil {
+				glog.Infof("shutting down: %v", ctx.Err())
+			}
 			break
 		}
 
+		if n > 0 {
+			failures = 0
+			errs.Reset()
+		}
+
+		if err != nil {
+			failures++
+		}
+
+		if Flags.MaxRetries > 0 && failures > Flags.MaxRetries {
+			glog.Errorf("%+v", errors.Wrapf(errTooManyRetries, "%s: %d", strings.Join(Flags.Output, ","), Flags.MaxRetries))
+			exitStatus = 1
+			return
+		}
+
 		// minimum Flags.Timeout wait.
 		select {
 		case <-wait:
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+var (
+	icyStatus  = []byte("ICY ")
+	httpStatus = []byte("HTTP/1.0 ")
+)
+
+// icyConn is a net.Conn that rewrites a leading SHOUTcast `ICY 200 OK` status line into `HTTP/1.0 200 OK`,
+// so that net/http will parse the response.
+//
+// Every byte after the status token is passed through untouched.
+// An HTTPS connection will start with a TLS record, and so will never be rewritten.
+type icyConn struct {
+	net.Conn
+
+	checked bool
+	pending []byte
+}
+
+func (c *icyConn) Read(b []byte) (n int, err error) {
+	if !c.checked {
+		c.checked = true
+
+		head := make([]byte, len(icyStatus))
+
+		n, err := io.ReadFull(c.Conn, head)
+		head = head[:n]
+
+		if bytes.Equal(head, icyStatus) {
+			head = httpStatus
+		}
+
+		c.pending = head
+
+		if err != nil && n == 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+
+			return 0, err
+		}
+	}
+
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
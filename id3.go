@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// id3Info holds the ICY headers of the current stream that go into an ID3v2 tag.
+var id3Info struct {
+	sync.Mutex
+	name, genre, url string
+}
+
+// setID3Info records the ICY headers of the stream, for the ID3v2 tags of any files started from now on.
+func setID3Info(h headerer) {
+	header, err := h.Header()
+	if err != nil {
+		return
+	}
+
+	id3Info.Lock()
+	defer id3Info.Unlock()
+
+	id3Info.name = header.Get("Icy-Name")
+	id3Info.genre = header.Get("Icy-Genre")
+	id3Info.url = header.Get("Icy-Url")
+}
+
+// id3Tag returns an ID3v2.4 tag describing the stream, and its current StreamTitle.
+//
+// The icy-name goes into both the artist and album, since a station has no better candidate for either,
+// and most players show one or the other.
+func id3Tag() []byte {
+	id3Info.Lock()
+	name, genre, url := id3Info.name, id3Info.genre, id3Info.url
+	id3Info.Unlock()
+
+	var frames bytes.Buffer
+
+	textFrame := func(id, text string) {
+		if text == "" {
+			return
+		}
+
+		// encoding 0x03 is UTF-8, which is only allowed from ID3v2.4.
+		id3Frame(&frames, id, append([]byte{0x03}, text...))
+	}
+
+	textFrame("TIT2", StreamTitle())
+	textFrame("TPE1", name)
+	textFrame("TALB", name)
+	textFrame("TRSN", name)
+	textFrame("TCON", genre)
+
+	if url != "" {
+		// encoding, language, an empty short description, then the text.
+		data := append([]byte{0x03}, "XXX"...)
+		data = append(data, 0x00)
+		data = append(data, url...)
+
+		id3Frame(&frames, "COMM", data)
+	}
+
+	if frames.Len() == 0 {
+		return nil
+	}
+
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00}
+	tag = append(tag, syncsafe(frames.Len())...)
+
+	return append(tag, frames.Bytes()...)
+}
+
+// id3Frame appends an ID3v2.4 frame to buf.
+func id3Frame(buf *bytes.Buffer, id string, data []byte) {
+	buf.WriteString(id)
+	buf.Write(syncsafe(len(data)))
+	buf.Write([]byte{0x00, 0x00}) // flags
+	buf.Write(data)
+}
+
+// syncsafe encodes n as an ID3v2 syncsafe integer, which has only 7 bits in each byte, so that it is never mistaken for an MPEG frame sync.
+func syncsafe(n int) []byte {
+	return []byte{
+		byte(n>>21) & 0x7F,
+		byte(n>>14) & 0x7F,
+		byte(n>>7) & 0x7F,
+		byte(n) & 0x7F,
+	}
+}
+
+// id3Writer writes an ID3v2 tag at the start of a file, just before the first write to it.
+//
+// The tag is not written until then, since the outputs are opened before we have connected to the stream, and know its headers.
+type id3Writer struct {
+	files.Writer
+
+	pending bool
+}
+
+// withID3 wraps a file being recorded without mpegts in an id3Writer, if --id3 is set, and it is a local file.
+func withID3(w files.Writer, filename string) files.Writer {
+	if !Flags.ID3 || isStdoutOutput(filename) {
+		return w
+	}
+
+	if _, ok := localPath(filename); !ok {
+		return w
+	}
+
+	return newID3Writer(w)
+}
+
+// newID3Writer returns w, wrapped to start with an ID3v2 tag, unless w already has something in it, because we are appending to it.
+func newID3Writer(w files.Writer) files.Writer {
+	if fi, err := w.Stat(); err == nil && fi.Size() > 0 {
+		return w
+	}
+
+	return &id3Writer{
+		Writer:  w,
+		pending: true,
+	}
+}
+
+func (w *id3Writer) Write(b []byte) (n int, err error) {
+	if w.pending {
+		w.pending = false
+
+		// An ID3v2 tag has no place at the start of an Ogg file.
+		if tag := id3Tag(); tag != nil && !isOgg(b) {
+			if glog.V(2) {
+				glog.Infof("%s: writing id3 tag of %d bytes", w.Name(), len(tag))
+			}
+
+			if _, err := w.Writer.Write(tag); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return w.Writer.Write(b)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// inputHeaders are the --input-header headers that are sent with every request to the stream.
+var inputHeaders http.Header
+
+// parseInputHeaders parses each --input-header as a "Key: Value" pair.
+//
+// A malformed entry is only warned about, and left out, so that one typo does not stop the rest from being sent.
+func parseInputHeaders() {
+	for _, entry := range Flags.InputHeader {
+		key, val, ok := strings.Cut(entry, ":")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+
+		switch {
+		case !ok:
+			glog.Warningf("--input-header: ignoring %q: must be of the form \"Key: Value\"", entry)
+			continue
+		case !isHeaderToken(key):
+			glog.Warningf("--input-header: ignoring %q: bad header name: %q", entry, key)
+			continue
+		case strings.ContainsAny(val, "\r\n\x00"):
+			glog.Warningf("--input-header: ignoring %q: bad header value", key)
+			continue
+		}
+
+		key = textproto.CanonicalMIMEHeaderKey(key)
+
+		if key == "Host" {
+			// net/http only ever sends the Host of the URL, and ignores any Host header.
+			glog.Warningf("--input-header: ignoring %q: the Host cannot be changed", key)
+			continue
+		}
+
+		if inputHeaders == nil {
+			inputHeaders = make(http.Header)
+		}
+
+		inputHeaders.Add(key, val)
+	}
+}
+
+// isHeaderToken returns true if the name is a valid HTTP header field name, which is a token in RFC 9110.
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// sensitiveHeaderWords mark a header as one that could carry credentials, when any of them appears in its name.
+var sensitiveHeaderWords = []string{
+	"auth",
+	"cookie",
+	"key",
+	"password",
+	"secret",
+	"session",
+	"token",
+}
+
+// isSensitiveHeader returns true if the value of the header should never be logged,
+// or sent on to a different host through a redirect.
+func isSensitiveHeader(key string) bool {
+	key = strings.ToLower(key)
+
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setHeaders sets the given headers on the request, replacing any value that we would have sent otherwise.
+//
+// Sensitive headers are only sent to the original host of the stream, just like the credentials.
+// If secret is true, then every one of the headers is treated as sensitive.
+func setHeaders(req *http.Request, header http.Header, host string, secret bool) {
+	for key, vals := range header {
+		sensitive := secret || isSensitiveHeader(key)
+
+		if sensitive && req.URL.Host != host {
+			continue
+		}
+
+		req.Header[key] = append([]string(nil), vals...)
+
+		if glog.V(2) {
+			val := strings.Join(vals, ", ")
+			if sensitive {
+				val = "[redacted]"
+			}
+
+			glog.Infof("request header: %s: %s", key, val)
+		}
+	}
+}
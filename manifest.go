@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// manifestSegment is the JSON structure of each finished output file in the --manifest.
+type manifestSegment struct {
+	Filename string          `json:"filename"`
+	Start    time.Time       `json:"start"`
+	Duration float64         `json:"duration"`
+	Bytes    int             `json:"bytes"`
+	Titles   []manifestTitle `json:"titles,omitempty"`
+}
+
+// manifestTitle is a StreamTitle that was active during a segment, from the given offset in seconds from the start of the segment.
+type manifestTitle struct {
+	Title  string  `json:"title"`
+	Offset float64 `json:"offset"`
+}
+
+var manifest struct {
+	sync.Mutex
+	loaded   bool
+	Segments []manifestSegment `json:"segments"`
+}
+
+// addManifestSegment appends a finished output file to the --manifest, and atomically replaces the manifest file,
+// so that whoever reads it never sees a partial index.
+//
+// If the manifest file already exists, then the segments are appended to the ones already listed in it,
+// so that an archive keeps a single index across restarts.
+func addManifestSegment(seg manifestSegment) {
+	if Flags.Manifest == "" {
+		return
+	}
+
+	manifest.Lock()
+	defer manifest.Unlock()
+
+	if !manifest.loaded {
+		manifest.loaded = true
+
+		if err := loadManifest(Flags.Manifest); err != nil {
+			glog.Warningf("--manifest: %s: %+v: starting a new manifest", Flags.Manifest, err)
+			manifest.Segments = nil
+		}
+	}
+
+	manifest.Segments = append(manifest.Segments, seg)
+
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		glog.Errorf("--manifest: %+v", err)
+		return
+	}
+
+	b = append(b, '\n')
+
+	if err := writeFileAtomic(Flags.Manifest, b); err != nil {
+		glog.Errorf("--manifest: %s: %+v", Flags.Manifest, err)
+		return
+	}
+
+	if glog.V(2) {
+		glog.Infof("--manifest: %s: added %s", Flags.Manifest, seg.Filename)
+	}
+}
+
+// loadManifest reads the segments from an existing manifest file, if there is one.
+//
+// Caller MUST hold the lock.
+func loadManifest(filename string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return errors.Wrap(json.Unmarshal(b, &manifest), "manifest json")
+}
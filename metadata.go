@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+var nowPlaying struct {
+	sync.Mutex
+	title   string
+	seen    bool
+	changed time.Time
+}
+
+// StreamTitle returns the most recent ICY StreamTitle received from the input stream.
+func StreamTitle() string {
+	nowPlaying.Lock()
+	defer nowPlaying.Unlock()
+
+	return nowPlaying.title
+}
+
+// titleChangedAt returns when the StreamTitle last changed, and false if no StreamTitle has been received at all.
+func titleChangedAt() (time.Time, bool) {
+	nowPlaying.Lock()
+	defer nowPlaying.Unlock()
+
+	return nowPlaying.changed, nowPlaying.seen
+}
+
+// setStreamTitle records a StreamTitle received from the input stream,
+// and if it has changed, then it updates the --metadata-file.
+func setStreamTitle(title string) {
+	nowPlaying.Lock()
+	changed := !nowPlaying.seen || title != nowPlaying.title
+	nowPlaying.title = title
+	nowPlaying.seen = true
+	if changed {
+		nowPlaying.changed = time.Now()
+	}
+	nowPlaying.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if glog.V(1) {
+		glog.Infof("StreamTitle: %q", title)
+	}
+
+	DVBServiceTitle(title)
+	DVBEventTitle(title)
+
+	if Flags.MetadataFile != "" {
+		if err := writeMetadataFile(Flags.MetadataFile, title); err != nil {
+			glog.Errorf("writeMetadataFile: %+v", err)
+		}
+	}
+}
+
+// writeMetadataFile atomically replaces the contents of filename with the given title.
+func writeMetadataFile(filename, title string) error {
+	var data []byte
+	if title != "" {
+		data = []byte(title + "\n")
+	}
+
+	return errors.Wrap(writeFileAtomic(filename, data), "metadata file")
+}
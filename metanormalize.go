@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cp1252 maps the bytes 0x80 to 0x9F of Windows-1252 to their runes.
+// The five bytes that it leaves undefined are mapped to the C1 control of the same value, as in Latin-1.
+var cp1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// cp1252Bytes maps runes back into Windows-1252, for those that are not simply the same as their Latin-1 byte.
+var cp1252Bytes = func() map[rune]byte {
+	m := make(map[rune]byte)
+	for i, r := range cp1252 {
+		m[r] = byte(0x80 + i)
+	}
+	return m
+}()
+
+// decodeCP1252 decodes b as Windows-1252, which is a superset of the printable characters of Latin-1,
+// and never fails, since every byte has a rune.
+func decodeCP1252(b []byte) string {
+	var s strings.Builder
+
+	for _, c := range b {
+		switch {
+		case c >= 0x80 && c < 0xA0:
+			s.WriteRune(cp1252[c-0x80])
+		default:
+			s.WriteRune(rune(c))
+		}
+	}
+
+	return s.String()
+}
+
+// fixMojibake undoes UTF-8 that has been decoded as Windows-1252 or Latin-1, and encoded into UTF-8 again, e.g. "Ã©" for "é".
+//
+// It only does so if each rune does map back to a single byte, and those bytes are then valid UTF-8, with at least one multi-byte sequence.
+// Otherwise, it returns false, and the string is left just as it is.
+func fixMojibake(s string) (string, bool) {
+	b := make([]byte, 0, len(s))
+	var multi bool
+
+	for _, r := range s {
+		c, ok := cp1252Bytes[r]
+		switch {
+		case ok:
+		case r < 0x100:
+			c = byte(r)
+		default:
+			return s, false
+		}
+
+		if c >= 0x80 {
+			multi = true
+		}
+
+		b = append(b, c)
+	}
+
+	if !multi || !utf8.Valid(b) {
+		return s, false
+	}
+
+	return string(b), true
+}
+
+// normalizeTitle makes a best effort at turning a raw ICY StreamTitle into clean UTF-8 text, for --normalize-metadata.
+//
+// A title that is not valid UTF-8 is taken to be Windows-1252, which most often it is,
+// while a valid one may still be mojibake, which we undo up to a couple of times over.
+// Any StreamTitle='…' wrapper that the station has left inside of the value, control characters, and surrounding space are trimmed off.
+//
+// If all of that leaves nothing at all, then the raw title is kept.
+func normalizeTitle(raw string) string {
+	title := raw
+
+	if !utf8.ValidString(title) {
+		title = decodeCP1252([]byte(title))
+	}
+
+	for i := 0; i < 2; i++ {
+		fixed, ok := fixMojibake(title)
+		if !ok {
+			break
+		}
+		title = fixed
+	}
+
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title)
+
+	title = strings.TrimSpace(title)
+
+	if rest, ok := strings.CutPrefix(title, "StreamTitle='"); ok {
+		rest = strings.TrimSuffix(rest, ";")
+		rest = strings.TrimSuffix(rest, "'")
+
+		title = strings.TrimSpace(rest)
+	}
+
+	if title == "" {
+		return raw
+	}
+
+	return title
+}
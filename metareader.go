@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// metaReader wraps an ICY stream, and strips out the inline metadata blocks,
+// which are interleaved into the stream every icy-metaint bytes of audio.
+type metaReader struct {
+	r io.Reader
+
+	metaint   int
+	remaining int // bytes of audio left before the next metadata block.
+
+	title string // the last StreamTitle, so that onTitle is only called when it changes.
+
+	onTitle func(title string)
+}
+
+func newMetaReader(r io.Reader, metaint int, onTitle func(string)) *metaReader {
+	return &metaReader{
+		r:         r,
+		metaint:   metaint,
+		remaining: metaint,
+		onTitle:   onTitle,
+	}
+}
+
+func (r *metaReader) Read(b []byte) (n int, err error) {
+	if r.remaining <= 0 {
+		if err := r.readMetadata(); err != nil {
+			return 0, err
+		}
+
+		r.remaining = r.metaint
+	}
+
+	if len(b) > r.remaining {
+		b = b[:r.remaining]
+	}
+
+	n, err = r.r.Read(b)
+	r.remaining -= n
+
+	return n, err
+}
+
+// readMetadata reads a whole metadata block, even if it spans across multiple Reads of the underlying stream.
+func (r *metaReader) readMetadata() error {
+	var l [1]byte
+	if _, err := io.ReadFull(r.r, l[:]); err != nil {
+		return err
+	}
+
+	if l[0] == 0 {
+		// An empty metadata block means that nothing has changed.
+		return nil
+	}
+
+	buf := make([]byte, int(l[0])*16)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return errors.Wrap(err, "icy metadata")
+	}
+
+	meta := parseMetadata(buf)
+
+	title, ok := meta["StreamTitle"]
+	if !ok {
+		return nil
+	}
+
+	if Flags.NormalizeMetadata {
+		title = normalizeTitle(title)
+	}
+
+	changed := title != r.title
+	r.title = title
+
+	if changed && r.onTitle != nil {
+		r.onTitle(title)
+	}
+
+	return nil
+}
+
+// parseMetadata parses an ICY metadata block of the form: `StreamTitle='…';StreamUrl='…';`
+//
+// The values are not escaped, so a value is only terminated by a `';` sequence, or the end of the block.
+func parseMetadata(b []byte) map[string]string {
+	b = bytes.TrimRight(b, "\x00")
+
+	meta := make(map[string]string)
+
+	for len(b) > 0 {
+		i := bytes.Index(b, []byte("='"))
+		if i < 0 {
+			break
+		}
+
+		key := strings.TrimSpace(string(b[:i]))
+		b = b[i+2:]
+
+		var val []byte
+
+		j := bytes.Index(b, []byte("';"))
+		if j < 0 {
+			val, b = bytes.TrimSuffix(b, []byte("'")), nil
+		} else {
+			val, b = b[:j], b[j+2:]
+		}
+
+		meta[key] = string(val)
+	}
+
+	return meta
+}
+
+// getMetaInt returns the icy-metaint value from the headers, or 0 if the stream has no inline metadata.
+func getMetaInt(h headerer) (int, error) {
+	header, err := h.Header()
+	if err != nil {
+		return 0, err
+	}
+
+	val := header.Get("Icy-Metaint")
+	if val == "" {
+		return 0, nil
+	}
+
+	metaint, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return 0, errors.Errorf("bad icy-metaint value: %s: %+v", val, err)
+	}
+
+	if metaint < 0 {
+		return 0, errors.Errorf("bad icy-metaint value: %d", metaint)
+	}
+
+	return metaint, nil
+}
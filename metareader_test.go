@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+)
+
+// icyBlock is one block of an ICY stream: metaint bytes of audio, followed by a metadata block.
+type icyBlock struct {
+	audio []byte
+	meta  []byte // without the length byte, and already padded to a multiple of 16 bytes.
+}
+
+// metadataBlock pads the given metadata out to a multiple of 16 bytes, or to exactly blocks*16 bytes, if blocks > 0.
+func metadataBlock(meta string, blocks int) []byte {
+	if blocks <= 0 {
+		blocks = (len(meta) + 15) / 16
+	}
+
+	b := make([]byte, blocks*16)
+	copy(b, meta)
+	return b
+}
+
+// icyStream returns the blocks encoded as an ICY stream, along with the chunks of it that fall on block boundaries.
+func icyStream(blocks []icyBlock) (stream []byte, chunks [][]byte) {
+	for _, blk := range blocks {
+		stream = append(stream, blk.audio...)
+		chunks = append(chunks, blk.audio)
+
+		meta := append([]byte{byte(len(blk.meta) / 16)}, blk.meta...)
+		stream = append(stream, meta...)
+		chunks = append(chunks, meta)
+	}
+
+	return stream, chunks
+}
+
+// chunkReader returns exactly one of its chunks on each Read.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.chunks) < 1 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+		return n, nil
+	}
+
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestMetaReader(t *testing.T) {
+	defer func(normalize bool) {
+		Flags.NormalizeMetadata = normalize
+	}(Flags.NormalizeMetadata)
+	Flags.NormalizeMetadata = false
+
+	const metaint = 64
+
+	audio := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, metaint)
+	}
+
+	long := "StreamTitle='" + strings.Repeat("x", 255*16-len("StreamTitle='';")) + "';"
+
+	tests := []struct {
+		name   string
+		blocks []icyBlock
+		titles []string
+	}{
+		{
+			name: "empty metadata",
+			blocks: []icyBlock{
+				{audio('a'), nil},
+				{audio('b'), nil},
+			},
+		},
+		{
+			name: "one title",
+			blocks: []icyBlock{
+				{audio('a'), metadataBlock("StreamTitle='Artist - Song';", 0)},
+				{audio('b'), nil},
+			},
+			titles: []string{"Artist - Song"},
+		},
+		{
+			name: "unchanged title",
+			blocks: []icyBlock{
+				{audio('a'), metadataBlock("StreamTitle='Song';", 0)},
+				{audio('b'), metadataBlock("StreamTitle='Song';StreamUrl='http://example.com/';", 0)},
+				{audio('c'), metadataBlock("StreamTitle='Next';", 0)},
+			},
+			titles: []string{"Song", "Next"},
+		},
+		{
+			name: "longest metadata",
+			blocks: []icyBlock{
+				{audio('a'), nil},
+				{audio('b'), metadataBlock(long, 255)},
+				{audio('c'), nil},
+			},
+			titles: []string{strings.Repeat("x", 255*16-len("StreamTitle='';"))},
+		},
+		{
+			name: "no title",
+			blocks: []icyBlock{
+				{audio('a'), metadataBlock("StreamUrl='http://example.com/';", 0)},
+				{audio('b'), metadataBlock("StreamTitle='';", 0)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		stream, chunks := icyStream(tt.blocks)
+
+		var expected []byte
+		for _, blk := range tt.blocks {
+			expected = append(expected, blk.audio...)
+		}
+
+		readers := []struct {
+			name string
+			r    io.Reader
+		}{
+			{"one byte", iotest.OneByteReader(bytes.NewReader(stream))},
+			{"block aligned", &chunkReader{chunks: chunks}},
+			{"whole", bytes.NewReader(stream)},
+		}
+
+		for _, rr := range readers {
+			var titles []string
+			r := newMetaReader(rr.r, metaint, func(title string) {
+				titles = append(titles, title)
+			})
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Errorf("%s: %s: unexpected error: %+v", tt.name, rr.name, err)
+				continue
+			}
+
+			if !bytes.Equal(got, expected) {
+				t.Errorf("%s: %s: got %d bytes of audio %q, expected %d bytes %q", tt.name, rr.name, len(got), got, len(expected), expected)
+			}
+
+			if strings.Join(titles, "\n") != strings.Join(tt.titles, "\n") {
+				t.Errorf("%s: %s: got titles %q, expected %q", tt.name, rr.name, titles, tt.titles)
+			}
+		}
+	}
+}
+
+func TestMetaReaderShortMetadata(t *testing.T) {
+	stream := append(bytes.Repeat([]byte{'a'}, 16), 2)
+	stream = append(stream, "StreamTitle='"...)
+
+	r := newMetaReader(iotest.OneByteReader(bytes.NewReader(stream)), 16, nil)
+
+	if _, err := io.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
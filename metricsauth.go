@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// basicAuthHandler requires HTTP Basic authentication with the given credentials for every request,
+// except for the /healthz and /readyz probes, which do not reveal anything about the stream.
+type basicAuthHandler struct {
+	next http.Handler
+
+	user, password [sha256.Size]byte
+}
+
+// newMetricsHandler returns the handler for the metrics server,
+// which requires --metrics-user and --metrics-password, if they are set.
+func newMetricsHandler() (http.Handler, error) {
+	next, err := withMetricsRelabel(http.DefaultServeMux)
+	if err != nil {
+		return nil, err
+	}
+
+	if Flags.MetricsUser == "" && Flags.MetricsPassword == "" {
+		return next, nil
+	}
+
+	if Flags.MetricsUser == "" || Flags.MetricsPassword == "" {
+		return nil, errors.New("--metrics-user and --metrics-password must be given together")
+	}
+
+	return &basicAuthHandler{
+		next:     next,
+		user:     sha256.Sum256([]byte(Flags.MetricsUser)),
+		password: sha256.Sum256([]byte(Flags.MetricsPassword)),
+	}, nil
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/healthz", "/readyz":
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	user, password, ok := req.BasicAuth()
+	if ok {
+		// Comparing hashes keeps the comparison constant-time, even when the lengths differ.
+		userHash, passwordHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+
+		userOK := subtle.ConstantTimeCompare(userHash[:], h.user[:])
+		passwordOK := subtle.ConstantTimeCompare(passwordHash[:], h.password[:])
+
+		ok = userOK&passwordOK == 1
+	}
+
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="icycat", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	validLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// relabelGatherer renames every metric with the --metrics-prefix, and adds the --metrics-labels to each of them,
+// as they are gathered, since the metrics themselves are all registered at init, before the flags are parsed.
+type relabelGatherer struct {
+	next prometheus.Gatherer
+
+	prefix string
+	labels []*dto.LabelPair
+}
+
+// newRelabelGatherer returns a Gatherer for the --metrics-prefix and --metrics-labels,
+// or nil if neither is set, so that the metrics are served exactly as they are registered.
+func newRelabelGatherer(next prometheus.Gatherer) (*relabelGatherer, error) {
+	if Flags.MetricsPrefix == "" && Flags.MetricsLabels == "" {
+		return nil, nil
+	}
+
+	g := &relabelGatherer{
+		next:   next,
+		prefix: Flags.MetricsPrefix,
+	}
+
+	if g.prefix != "" {
+		if !strings.HasSuffix(g.prefix, "_") && !strings.HasSuffix(g.prefix, ":") {
+			g.prefix += "_"
+		}
+
+		if !validMetricName.MatchString(g.prefix) {
+			return nil, errors.Errorf("bad --metrics-prefix: %q", Flags.MetricsPrefix)
+		}
+	}
+
+	labels, err := parseMetricsLabels(Flags.MetricsLabels)
+	if err != nil {
+		return nil, err
+	}
+	g.labels = labels
+
+	return g, nil
+}
+
+// parseMetricsLabels parses a comma separated list of key=val pairs into label pairs, sorted by name.
+func parseMetricsLabels(s string) ([]*dto.LabelPair, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+
+	var labels []*dto.LabelPair
+	for _, pair := range strings.Split(s, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+
+		switch {
+		case !ok:
+			return nil, errors.Errorf("bad --metrics-labels: %q: must be of the form key=val", pair)
+		case !validLabelName.MatchString(key), strings.HasPrefix(key, "__"):
+			return nil, errors.Errorf("bad --metrics-labels: bad label name: %q", key)
+		case seen[key]:
+			return nil, errors.Errorf("bad --metrics-labels: label given more than once: %q", key)
+		}
+		seen[key] = true
+
+		labels = append(labels, &dto.LabelPair{
+			Name:  &key,
+			Value: &val,
+		})
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	return labels, nil
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.next.Gather()
+
+	for _, family := range families {
+		if g.prefix != "" {
+			name := g.prefix + family.GetName()
+			family.Name = &name
+		}
+
+		if len(g.labels) < 1 {
+			continue
+		}
+
+		for _, m := range family.Metric {
+			m.Label = g.addLabels(m.Label)
+		}
+	}
+
+	return families, err
+}
+
+// addLabels returns the labels of a metric, with the --metrics-labels added in.
+//
+// A label that the metric already has keeps its own value, since two labels of the same name would be invalid.
+func (g *relabelGatherer) addLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	has := make(map[string]bool)
+	for _, l := range labels {
+		has[l.GetName()] = true
+	}
+
+	for _, l := range g.labels {
+		if !has[l.GetName()] {
+			labels = append(labels, l)
+		}
+	}
+
+	// The exposition format does not care, but a Gatherer is expected to return its labels sorted.
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	return labels
+}
+
+// relabelHandler serves the /metrics/ page from a relabelGatherer, and everything else from next.
+type relabelHandler struct {
+	next    http.Handler
+	metrics http.Handler
+}
+
+// withMetricsRelabel returns a handler that serves the metrics with the --metrics-prefix and --metrics-labels,
+// or just next, if neither is set.
+func withMetricsRelabel(next http.Handler) (http.Handler, error) {
+	g, err := newRelabelGatherer(prometheus.DefaultGatherer)
+	if err != nil {
+		return nil, err
+	}
+
+	if g == nil {
+		return next, nil
+	}
+
+	return &relabelHandler{
+		next:    next,
+		metrics: promhttp.HandlerFor(g, promhttp.HandlerOpts{}),
+	}, nil
+}
+
+func (h *relabelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/metrics/" {
+		h.metrics.ServeHTTP(w, req)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/puellanivis/breton/lib/files/socketfiles"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// fieldInterface is the query field on a udp: URL that selects which network interface multicast is sent out of.
+	fieldInterface = "iface"
+
+	// defaultMulticastTTL is the TTL that the kernel uses for multicast, which does not pass beyond the first router.
+	defaultMulticastTTL = 1
+)
+
+// isMulticastOutput returns true if the given URL is to an IPv4 or IPv6 multicast group.
+func isMulticastOutput(uri *url.URL) bool {
+	ip := hostIP(uri.Host)
+	return ip != nil && ip.IsMulticast()
+}
+
+// hostIP returns the IP address of the given host:port, or nil if it is not an IP literal.
+//
+// An IPv6 literal must be in brackets, and may have a zone, as in: [ff02::1%eth0]:1234
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+
+	host, _, _ = strings.Cut(host, "%")
+
+	return net.ParseIP(host)
+}
+
+// udpNetwork returns udp6 if the given host:port is an IPv6 literal, and otherwise udp4.
+func udpNetwork(hostport string) string {
+	if ip := hostIP(hostport); ip != nil && ip.To4() == nil {
+		return "udp6"
+	}
+
+	return "udp4"
+}
+
+// multicastTTL returns the ?ttl= of the given query, or defaultMulticastTTL if it is not set.
+func multicastTTL(q url.Values) (int, error) {
+	val := q.Get(socketfiles.FieldTTL)
+	if val == "" {
+		return defaultMulticastTTL, nil
+	}
+
+	ttl, err := strconv.ParseInt(val, 0, 0)
+	if err != nil || ttl < 1 || ttl > 255 {
+		return 0, errors.Errorf("bad %s value: %s: must be between 1 and 255", socketfiles.FieldTTL, val)
+	}
+
+	return int(ttl), nil
+}
+
+// multicastInterface returns the network interface named by ?iface=,
+// or else the one that has the address given by ?localaddr=,
+// or nil if neither is set, and the routing table should decide.
+func multicastInterface(q url.Values) (*net.Interface, error) {
+	if name := q.Get(fieldInterface); name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, errors.Errorf("bad %s value: %s: %+v", fieldInterface, name, err)
+		}
+
+		return ifi, nil
+	}
+
+	laddr := q.Get(socketfiles.FieldLocalAddress)
+	if laddr == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(laddr)
+	if ip == nil {
+		return nil, errors.Errorf("bad %s value: %s: not an IP address", socketfiles.FieldLocalAddress, laddr)
+	}
+
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ifis {
+		addrs, err := ifis[i].Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifis[i], nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("bad %s value: %s: no interface has this address", socketfiles.FieldLocalAddress, laddr)
+}
+
+// interfaceIPv4 returns the first IPv4 address of the given interface, or nil if it has none.
+func interfaceIPv4(ifi *net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+
+	return nil
+}
+
+// multicastWriter sends datagrams to a multicast group.
+//
+// The socketfiles udp: scheme can only set the unicast TTL, and cannot choose the outgoing interface,
+// so multicast outputs are sent through this instead.
+// As with socketfiles.WithIgnoreErrors, errors from sending are dropped,
+// since a multicast group may have no listeners, and we should keep sending regardless.
+type multicastWriter struct {
+	mu sync.Mutex
+
+	name string
+	conn *net.UDPConn
+
+	// If buf is not nil, then Writes are collected into datagrams of exactly len(buf) bytes.
+	buf []byte
+	off int
+}
+
+// newMulticastWriter opens the given udp: URL to a multicast group.
+//
+// The group may be IPv4, or IPv6, as in: udp://[ff02::1%25eth0]:1234
+// A link-local IPv6 group needs either a zone, or an iface=, to know which link to send it out on.
+//
+// It recognizes these query fields:
+//
+//	ttl=N             send with this multicast TTL, or IPv6 hop limit (default 1, which does not pass the first router)
+//	iface=NAME        send out of this network interface (default: decided by the routing table)
+//	localaddr=IP      send from this address, and out of the interface that has it
+//	localport=N       send from this port (default: any)
+//	tos=N             send with this IP type-of-service, or IPv6 traffic class
+//	pkt_size=N        collect writes into datagrams of this many bytes (default: each Write is one datagram)
+func newMulticastWriter(uri *url.URL) (*multicastWriter, error) {
+	q := uri.Query()
+
+	for _, field := range []string{socketfiles.FieldBufferSize, socketfiles.FieldMaxBitrate, socketfiles.FieldMaxPacketSize} {
+		if q.Get(field) != "" {
+			return nil, errors.Errorf("%s is not supported for multicast outputs", field)
+		}
+	}
+
+	ttl, err := multicastTTL(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ifi, err := multicastInterface(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var pktSize int
+	if val := q.Get(socketfiles.FieldPacketSize); val != "" {
+		sz, err := strconv.ParseInt(val, 0, strconv.IntSize)
+		if err != nil {
+			return nil, errors.Errorf("bad %s value: %s: %+v", socketfiles.FieldPacketSize, val, err)
+		}
+
+		pktSize = int(sz)
+	}
+
+	var tos int
+	if val := q.Get(socketfiles.FieldTOS); val != "" {
+		t, err := strconv.ParseInt(val, 0, 0)
+		if err != nil {
+			return nil, errors.Errorf("bad %s value: %s: %+v", socketfiles.FieldTOS, val, err)
+		}
+
+		tos = int(t)
+	}
+
+	network := udpNetwork(uri.Host)
+
+	raddr, err := net.ResolveUDPAddr(network, uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if raddr.Zone == "" && ifi != nil && (raddr.IP.IsLinkLocalMulticast() || raddr.IP.IsInterfaceLocalMulticast()) {
+		// The kernel will not send to a link-local group without knowing which link.
+		raddr.Zone = ifi.Name
+	}
+
+	var laddr *net.UDPAddr
+
+	host, port := q.Get(socketfiles.FieldLocalAddress), q.Get(socketfiles.FieldLocalPort)
+	if host != "" || port != "" {
+		laddr, err = net.ResolveUDPAddr(network, net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	setOptions := setMulticastOptions
+	if network == "udp6" {
+		setOptions = setMulticastOptions6
+	}
+
+	if err := setOptions(conn, ttl, ifi, tos); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if glog.V(1) {
+		iface := "default"
+		if ifi != nil {
+			iface = ifi.Name
+		}
+
+		glog.Infof("multicast: %s: ttl %d, interface %s, from %s", raddr, ttl, iface, conn.LocalAddr())
+	}
+
+	w := &multicastWriter{
+		name: uri.String(),
+		conn: conn,
+	}
+
+	if pktSize > 0 {
+		w.buf = make([]byte, pktSize)
+	}
+
+	return w, nil
+}
+
+// setMulticastOptions sets the TTL, outgoing interface, and type-of-service of an IPv4 multicast socket.
+func setMulticastOptions(conn *net.UDPConn, ttl int, ifi *net.Interface, tos int) error {
+	p := ipv4.NewPacketConn(conn)
+
+	if err := p.SetMulticastTTL(ttl); err != nil {
+		return errors.Errorf("could not set multicast ttl: %+v", err)
+	}
+
+	if ifi != nil {
+		if err := p.SetMulticastInterface(ifi); err != nil {
+			return errors.Errorf("could not set multicast interface: %s: %+v", ifi.Name, err)
+		}
+	}
+
+	if tos > 0 {
+		if err := p.SetTOS(tos); err != nil {
+			return errors.Errorf("could not set tos: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// setMulticastOptions6 sets the hop limit, outgoing interface, and traffic class of an IPv6 multicast socket.
+func setMulticastOptions6(conn *net.UDPConn, hops int, ifi *net.Interface, tclass int) error {
+	p := ipv6.NewPacketConn(conn)
+
+	if err := p.SetMulticastHopLimit(hops); err != nil {
+		return errors.Errorf("could not set multicast hop limit: %+v", err)
+	}
+
+	if ifi != nil {
+		if err := p.SetMulticastInterface(ifi); err != nil {
+			return errors.Errorf("could not set multicast interface: %s: %+v", ifi.Name, err)
+		}
+	}
+
+	if tclass > 0 {
+		if err := p.SetTrafficClass(tclass); err != nil {
+			return errors.Errorf("could not set traffic class: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// Name returns the URL that the multicastWriter was opened with.
+func (w *multicastWriter) Name() string {
+	return w.name
+}
+
+func (w *multicastWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf == nil {
+		w.send(b)
+		return len(b), nil
+	}
+
+	for len(b) > 0 {
+		l := copy(w.buf[w.off:], b)
+		w.off += l
+		n += l
+
+		b = b[l:]
+
+		if w.off < len(w.buf) {
+			break
+		}
+
+		w.send(w.buf)
+		w.off = 0
+	}
+
+	return n, nil
+}
+
+// SetPacketSize sets the size of the datagrams that writes are collected into, and returns the previous size.
+// A size of zero sends each Write as its own datagram.
+func (w *multicastWriter) SetPacketSize(size int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prev := len(w.buf)
+
+	if w.off > size {
+		// Too much is already buffered for the new size, so send it as it is.
+		w.send(w.buf[:w.off])
+		w.off = 0
+	}
+
+	switch {
+	case size <= 0:
+		w.buf = nil
+	case size <= len(w.buf):
+		w.buf = w.buf[:size]
+	default:
+		w.buf = append(w.buf, make([]byte, size-len(w.buf))...)
+	}
+
+	return prev
+}
+
+// send sends a single datagram, dropping any error.
+//
+// Caller MUST hold the lock.
+func (w *multicastWriter) send(b []byte) {
+	if _, err := w.conn.Write(b); err != nil {
+		if glog.V(2) {
+			glog.Infof("multicast: %s: dropped: %+v", w.name, err)
+		}
+	}
+}
+
+// Close sends any remaining buffered data as a short datagram, and closes the socket.
+func (w *multicastWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.off > 0 {
+		w.send(w.buf[:w.off])
+		w.off = 0
+	}
+
+	return w.conn.Close()
+}
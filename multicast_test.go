@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHostIP(t *testing.T) {
+	tests := []struct {
+		hostport string
+		ip       string
+		network  string
+	}{
+		{"[::1]:1234", "::1", "udp6"},
+		{"[ff02::1%eth0]:1234", "ff02::1", "udp6"},
+		{"[ff02::1]:1234", "ff02::1", "udp6"},
+		{"127.0.0.1:1234", "127.0.0.1", "udp4"},
+		{"239.0.0.1:1234", "239.0.0.1", "udp4"},
+		{"[::ffff:239.0.0.1]:1234", "239.0.0.1", "udp4"},
+		{"example.com:1234", "", "udp4"},
+		{"::1", "", "udp4"},
+	}
+
+	for _, tt := range tests {
+		ip := hostIP(tt.hostport)
+
+		switch {
+		case tt.ip == "" && ip != nil:
+			t.Errorf("hostIP(%q) = %v, expected nil", tt.hostport, ip)
+		case tt.ip != "" && !ip.Equal(net.ParseIP(tt.ip)):
+			t.Errorf("hostIP(%q) = %v, expected %s", tt.hostport, ip, tt.ip)
+		}
+
+		if got := udpNetwork(tt.hostport); got != tt.network {
+			t.Errorf("udpNetwork(%q) = %q, expected %q", tt.hostport, got, tt.network)
+		}
+	}
+}
+
+func TestIsMulticastOutput(t *testing.T) {
+	tests := []struct {
+		uri       string
+		multicast bool
+	}{
+		{"udp://239.0.0.1:1234", true},
+		{"udp://[ff02::1%25eth0]:1234", true},
+		{"udp://[ff0e::1]:1234", true},
+		{"udp://127.0.0.1:1234", false},
+		{"udp://[::1]:1234", false},
+		{"udp://example.com:1234", false},
+	}
+
+	for _, tt := range tests {
+		uri, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %+v", tt.uri, err)
+		}
+
+		if got := isMulticastOutput(uri); got != tt.multicast {
+			t.Errorf("isMulticastOutput(%q) = %v, expected %v", tt.uri, got, tt.multicast)
+		}
+	}
+}
+
+func TestMulticastTTL(t *testing.T) {
+	tests := []struct {
+		val     string
+		ttl     int
+		wantErr bool
+	}{
+		{"", defaultMulticastTTL, false},
+		{"0", 0, true},
+		{"1", 1, false},
+		{"255", 255, false},
+		{"256", 0, true},
+		{"-1", 0, true},
+		{"0x10", 16, false},
+		{"many", 0, true},
+	}
+
+	for _, tt := range tests {
+		q := make(url.Values)
+		if tt.val != "" {
+			q.Set("ttl", tt.val)
+		}
+
+		ttl, err := multicastTTL(q)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("multicastTTL(ttl=%q) error = %v, expected error: %v", tt.val, err, tt.wantErr)
+			continue
+		}
+
+		if ttl != tt.ttl {
+			t.Errorf("multicastTTL(ttl=%q) = %d, expected %d", tt.val, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestValidateMetricsNetwork(t *testing.T) {
+	defer func(network string) {
+		Flags.MetricsNetwork = network
+	}(Flags.MetricsNetwork)
+
+	for _, network := range []string{"tcp", "tcp4", "tcp6"} {
+		Flags.MetricsNetwork = network
+
+		if err := validateMetricsNetwork(); err != nil {
+			t.Errorf("validateMetricsNetwork(%q) = %v, expected no error", network, err)
+		}
+	}
+
+	for _, network := range []string{"", "udp", "unix", "tcp7"} {
+		Flags.MetricsNetwork = network
+
+		if err := validateMetricsNetwork(); err == nil {
+			t.Errorf("validateMetricsNetwork(%q) = nil, expected an error", network)
+		}
+	}
+}
+
+func TestListenMetricsIPv6Loopback(t *testing.T) {
+	defer func(network, addr string) {
+		Flags.MetricsNetwork, Flags.MetricsAddress = network, addr
+	}(Flags.MetricsNetwork, Flags.MetricsAddress)
+
+	Flags.MetricsNetwork = "tcp6"
+	Flags.MetricsAddress = "[::1]:0"
+
+	l, err := listenMetrics()
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %+v", err)
+	}
+	defer l.Close()
+
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("listenMetrics() listening on %v, expected [::1]", l.Addr())
+	}
+
+	const msg = "ping"
+
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer conn.Close()
+
+		b, _ := io.ReadAll(conn)
+		got <- string(b)
+	}()
+
+	conn, err := net.Dial("tcp6", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%v): %+v", l.Addr(), err)
+	}
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write: %+v", err)
+	}
+	conn.Close()
+
+	select {
+	case s := <-got:
+		if s != msg {
+			t.Errorf("received %q, expected %q", s, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection")
+	}
+}
+
+func TestMulticastWriterIPv6Loopback(t *testing.T) {
+	l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %+v", err)
+	}
+	defer l.Close()
+
+	uri, err := url.Parse("udp://" + l.LocalAddr().String() + "?pkt_size=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newMulticastWriter(uri)
+	if err != nil {
+		t.Fatalf("newMulticastWriter(%s): %+v", uri, err)
+	}
+
+	if _, err := w.Write([]byte("abcdef")); err != nil {
+		t.Fatalf("Write: %+v", err)
+	}
+
+	// Closing sends what is left over as a short datagram.
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %+v", err)
+	}
+
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for _, expected := range []string{"abcd", "ef"} {
+		buf := make([]byte, 64)
+
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %+v", err)
+		}
+
+		if got := string(buf[:n]); got != expected {
+			t.Errorf("received datagram %q, expected %q", got, expected)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+type programKey struct{}
+
+// withProgram returns a context.Context for reading the stream of the index'th program, with --multi-program.
+func withProgram(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, programKey{}, index)
+}
+
+// programIndex returns the index of the program that the stream read with the given context is carried in.
+//
+// The first program is the primary stream, which is the only one that drives everything that follows a single stream,
+// such as the --metadata-file, the EIT, the expected bitrate, and the --web-player.
+func programIndex(ctx context.Context) int {
+	index, _ := ctx.Value(programKey{}).(int)
+	return index
+}
+
+// titleSetter returns the function that records the StreamTitles of the stream read with the given context.
+//
+// The StreamTitles of the other programs only go into the name of their own DVB services.
+func titleSetter(ctx context.Context) func(string) {
+	index := programIndex(ctx)
+	if index == 0 {
+		return setStreamTitle
+	}
+
+	var last string
+
+	return func(title string) {
+		if title == last {
+			return
+		}
+		last = title
+
+		if glog.V(1) {
+			glog.Infof("program %d: StreamTitle: %q", tsProgramNumber(index), title)
+		}
+
+		DVBProgramTitle(index, title)
+	}
+}
+
+// validateMultiProgram checks that n programs can be carried with --multi-program,
+// without running out of program numbers or PIDs, or their PIDs colliding.
+func validateMultiProgram(n int) error {
+	if err := validateTSFlags(); err != nil {
+		return err
+	}
+
+	if Flags.TSPCRPID != 0 {
+		return errors.New("--ts-pcr-pid cannot be used with --multi-program, since each program carries its own PCR")
+	}
+
+	if Flags.PCRInterval > 0 {
+		return errors.New("--pcr-interval cannot be used with --multi-program")
+	}
+
+	last := uint16(n - 1)
+
+	if int(Flags.TSProgramNumber)+n-1 > 0xFFFF {
+		return errors.Errorf("bad --ts-program-number: %d programs from %d would overflow", n, Flags.TSProgramNumber)
+	}
+
+	if err := validatePID("--ts-pmt-pid", Flags.TSPMTPID+last); err != nil {
+		return errors.Errorf("%+v: for %d programs", err, n)
+	}
+
+	if err := validatePID("--ts-elementary-pid", Flags.TSElementaryPID+last); err != nil {
+		return errors.Errorf("%+v: for %d programs", err, n)
+	}
+
+	if Flags.TSPMTPID <= Flags.TSElementaryPID+last && Flags.TSElementaryPID <= Flags.TSPMTPID+last {
+		return errors.Errorf("the PMT PIDs from --ts-pmt-pid 0x%04X, and the elementary PIDs from --ts-elementary-pid 0x%04X, overlap for %d programs", Flags.TSPMTPID, Flags.TSElementaryPID, n)
+	}
+
+	return nil
+}
+
+// openMultiProgramOutputs opens each of the given outputs as a single MPEG-TS carrying n programs,
+// and returns an io.WriteCloser for each program, which writes its stream to all of the outputs.
+//
+// Unlike with a single program, an output is not rebuilt if its ts.Mux fails.
+func openMultiProgramOutputs(ctx context.Context, filenames []string, n int) ([]io.WriteCloser, []func(), error) {
+	if len(filenames) < 1 {
+		return nil, nil, errors.New("--multi-program requires at least one mpegts output")
+	}
+
+	if err := validateMultiProgram(n); err != nil {
+		return nil, nil, err
+	}
+
+	outs := make([]*multiWriter, n)
+	for i := range outs {
+		outs[i] = new(multiWriter)
+	}
+
+	discontinuities := make([][]func(), n)
+
+	closeAll := func() {
+		for _, out := range outs {
+			out.Close()
+		}
+	}
+
+	for _, filename := range filenames {
+		if isSRTOutput(filename) {
+			closeAll()
+			return nil, nil, errors.Wrap(errSRTUnsupported, filename)
+		}
+
+		if !isMuxOutput(filename) {
+			closeAll()
+			return nil, nil, errors.Errorf("--multi-program requires every output to be mpegts: %s", filename)
+		}
+
+		isHLS := isHLSOutput(filename)
+		if isHLS && Flags.TSMuxRate > 0 {
+			closeAll()
+			return nil, nil, errors.Errorf("%s: --ts-mux-rate cannot be used with hls", filename)
+		}
+
+		p, err := openMuxPipeline(ctx, filename, isHLS, n)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		for i := range outs {
+			outs[i].add(filename, p.programs[i], isSocketOutput(filename))
+			discontinuities[i] = append(discontinuities[i], p.discontinuities[i])
+		}
+	}
+
+	ws := make([]io.WriteCloser, n)
+	fns := make([]func(), n)
+
+	for i := range outs {
+		ws[i] = outs[i]
+
+		fns[i] = func(fns []func()) func() {
+			return func() {
+				for _, fn := range fns {
+					fn()
+				}
+			}
+		}(discontinuities[i])
+	}
+
+	return ws, fns, nil
+}
+
+// startPrograms copies each of the given streams, other than the primary stream, into the program of the same index in outs,
+// reconnecting to each of them on its own, just as with the primary stream.
+//
+// The returned function stops all of the copies, and waits for them to close their programs,
+// which must be done before the primary program is closed, since that waits for the whole ts.Mux to finish.
+func startPrograms(ctx context.Context, streams []string, outs []io.WriteCloser, discontinuities []func()) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	for i := 1; i < len(streams); i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			outputTimeout := Flags.OutputTimeout
+			if outputTimeout <= 0 {
+				outputTimeout = Flags.Timeout
+			}
+			out := newWatchdogWriter(outs[index], outputTimeout)
+
+			defer func() {
+				if err := out.Close(); err != nil {
+					glog.Errorf("program %d: %+v", tsProgramNumber(index), err)
+				}
+			}()
+
+			copyProgram(withProgram(ctx, index), streams[index], out, discontinuities[index])
+		}(i)
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// copyProgram copies the stream into the program until ctx is canceled, or the stream gives up.
+func copyProgram(ctx context.Context, stream string, out io.Writer, discontinuity func()) {
+	index := programIndex(ctx)
+
+	in, err := ICECASTReader(ctx, []string{stream}, discontinuity)
+	if err != nil {
+		glog.Errorf("program %d: ICECASTReader: %+v", tsProgramNumber(index), err)
+		return
+	}
+
+	var errs dedupLogger
+
+	for {
+		wait := time.After(Flags.Timeout)
+
+		n, err := files.Copy(ctx, out, in)
+		if err == nil || err == io.EOF || ctx.Err() != nil {
+			return
+		}
+
+		if cause := errors.Cause(err); cause == errTooManyRetries || cause == errCopyFailed {
+			glog.Errorf("program %d: %+v", tsProgramNumber(index), err)
+			return
+		}
+
+		errs.Errorf("program %d: %v", tsProgramNumber(index), err)
+
+		if n > 0 {
+			errs.Reset()
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
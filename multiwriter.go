@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// errOutputFailed is returned when a write to an output that is not a network socket fails, e.g. with a full disk,
+// since reconnecting to the stream cannot fix that.
+var errOutputFailed = errors.New("write to output failed")
+
+type destination struct {
+	io.WriteCloser
+	name string
+
+	// bestEffort destinations only log their write errors, rather than returning them.
+	bestEffort bool
+}
+
+// multiWriter is an io.WriteCloser that duplicates its writes to all of its destinations.
+//
+// A failing destination does not stop writes to the other destinations,
+// but the write errors of any destination that is not bestEffort are wrapped in errOutputFailed.
+type multiWriter struct {
+	dsts []*destination
+}
+
+func (w *multiWriter) add(name string, wr io.WriteCloser, bestEffort bool) {
+	w.dsts = append(w.dsts, &destination{
+		WriteCloser: wr,
+		name:        name,
+		bestEffort:  bestEffort,
+	})
+}
+
+func (w *multiWriter) Write(b []byte) (n int, err error) {
+	for _, dst := range w.dsts {
+		m, err2 := dst.Write(b)
+		if err2 == nil && m < len(b) {
+			err2 = io.ErrShortWrite
+		}
+
+		if err2 != nil {
+			if dst.bestEffort {
+				glog.Errorf("%s: %+v", dst.name, err2)
+				continue
+			}
+
+			if err == nil {
+				err = errors.Wrapf(errOutputFailed, "%s: %+v", dst.name, err2)
+			}
+		}
+	}
+
+	return len(b), err
+}
+
+// fatalWriter wraps the write errors of a single output that is not a network socket in errOutputFailed,
+// just as a multiWriter does for each of its destinations.
+type fatalWriter struct {
+	io.WriteCloser
+	name string
+}
+
+func (w *fatalWriter) Write(b []byte) (n int, err error) {
+	n, err = w.WriteCloser.Write(b)
+	if err != nil {
+		err = errors.Wrapf(errOutputFailed, "%s: %+v", w.name, err)
+	}
+
+	return n, err
+}
+
+func (w *multiWriter) Close() error {
+	var err error
+
+	for _, dst := range w.dsts {
+		if err2 := dst.Close(); err == nil {
+			err = err2
+		}
+	}
+
+	return err
+}
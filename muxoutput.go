@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// muxPipeline is one instance of the chain from the input pipe, through the ts.Mux, and into the sink.
+//
+// It writes to the first program of the ts.Mux, and closing it waits for the whole mux to finish.
+type muxPipeline struct {
+	*closeWaiter
+
+	discontinuity func()
+
+	// failed is closed once the ts.Mux has failed, and it will not recover on its own.
+	failed <-chan struct{}
+
+	// programs and discontinuities are the inputs of each of the programs of the ts.Mux, starting with the first.
+	programs        []io.WriteCloser
+	discontinuities []func()
+}
+
+// errorLatch sits right before the sink, and keeps write errors from reaching the ts.Mux,
+// which cannot recover from one: after an error on its first preamble, it never starts its elementary streams.
+//
+// Instead, the first error is latched and reported, and every write after it is dropped.
+type errorLatch struct {
+	namedWriteCloser
+
+	mu     sync.Mutex
+	err    error
+	failed func(error)
+}
+
+func newErrorLatch(w namedWriteCloser, failed func(error)) *errorLatch {
+	return &errorLatch{
+		namedWriteCloser: w,
+		failed:           failed,
+	}
+}
+
+func (w *errorLatch) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return len(b), nil
+	}
+
+	if _, err := w.namedWriteCloser.Write(b); err != nil {
+		w.err = err
+		w.failed(err)
+	}
+
+	return len(b), nil
+}
+
+// muxOutput is an MPEG-TS output that rebuilds its whole pipeline if the ts.Mux fails,
+// rather than taking the whole process down with it.
+//
+// The failed pipeline is torn down on the next write, and after a backoff, a new one is opened in its place.
+// Until then, the stream is dropped for this output, while the input and any other outputs carry on.
+type muxOutput struct {
+	ctx      context.Context
+	filename string
+	isHLS    bool
+
+	mu      sync.Mutex
+	cur     *muxPipeline
+	opened  time.Time
+	retryAt time.Time
+	backoff *backoff
+}
+
+func newMuxOutput(ctx context.Context, filename string, isHLS bool) (*muxOutput, error) {
+	p, err := openMuxPipeline(ctx, filename, isHLS, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &muxOutput{
+		ctx:      ctx,
+		filename: filename,
+		isHLS:    isHLS,
+
+		cur:     p,
+		opened:  time.Now(),
+		backoff: newBackoff(),
+	}, nil
+}
+
+// Name returns the name of the output.
+func (w *muxOutput) Name() string {
+	return w.filename
+}
+
+// Reopen closes the current pipeline, which flushes out everything still in the ts.Mux into the old file,
+// and then opens a new one at the same path, which starts over with the PSI preamble.
+func (w *muxOutput) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur != nil {
+		if err := w.cur.Close(); err != nil {
+			glog.Errorf("mpegts: %s: %+v", w.filename, err)
+		}
+		w.cur = nil
+	}
+
+	p, err := openMuxPipeline(withReopen(w.ctx), w.filename, w.isHLS, 1)
+	if err != nil {
+		// The next write tries again after the backoff, just as if the ts.Mux had failed.
+		w.retryAt = time.Now().Add(w.backoff.Next())
+		return err
+	}
+
+	w.cur = p
+	w.opened = time.Now()
+	return nil
+}
+
+// Discontinuity marks a discontinuity in the current pipeline.
+func (w *muxOutput) Discontinuity() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur != nil {
+		w.cur.discontinuity()
+	}
+}
+
+// rebuild tears down the current pipeline if it has failed, and opens a new one once the backoff has passed.
+// It returns false if there is no pipeline to write to yet.
+//
+// Caller MUST hold the lock.
+func (w *muxOutput) rebuild() (bool, error) {
+	if w.cur != nil {
+		select {
+		case <-w.cur.failed:
+		default:
+			return true, nil
+		}
+
+		glog.Warningf("mpegts: %s: muxer failed, rebuilding the output", w.filename)
+		muxRebuilds.Inc()
+		logEvent("warning", "mux-rebuild", "output", w.filename)
+
+		if err := w.cur.Close(); err != nil {
+			glog.Errorf("mpegts: %s: %+v", w.filename, err)
+		}
+		w.cur = nil
+
+		w.backoff.Succeeded(time.Since(w.opened))
+		w.retryAt = time.Now().Add(w.backoff.Next())
+	}
+
+	if isStdoutOutput(w.filename) {
+		// Closing the old pipeline closed the standard output, so there is nothing to reopen.
+		return false, errors.Errorf("%s: cannot rebuild an output to stdout", w.filename)
+	}
+
+	if time.Now().Before(w.retryAt) {
+		return false, nil
+	}
+
+	// The old pipeline might have already written some of the stream into the file, so do not truncate it.
+	p, err := openMuxPipeline(withReopen(w.ctx), w.filename, w.isHLS, 1)
+	if err != nil {
+		glog.Errorf("mpegts: %s: rebuilding the output: %+v", w.filename, err)
+		w.retryAt = time.Now().Add(w.backoff.Next())
+		return false, nil
+	}
+
+	w.cur = p
+	w.opened = time.Now()
+	return true, nil
+}
+
+func (w *muxOutput) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ok, err := w.rebuild()
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return len(b), nil
+	}
+
+	return w.cur.Write(b)
+}
+
+// Close closes the current pipeline, and waits for it to finish.
+func (w *muxOutput) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur == nil {
+		return nil
+	}
+
+	err := w.cur.Close()
+	w.cur = nil
+
+	return err
+}
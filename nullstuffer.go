@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+const (
+	pidNull = 0x1FFF
+
+	// stuffingInterval is how often the nullStuffer tops up the output to the mux rate.
+	stuffingInterval = 10 * time.Millisecond
+
+	// muxOverhead is a rough allowance for the MPEG-TS and PES headers, and the PSI/SI tables,
+	// over and above the bitrate of the audio itself.
+	muxOverhead = 1.1
+	muxTables   = 20000
+)
+
+// minMuxRate returns the lowest --ts-mux-rate that can carry a stream of the given bitrate without overflowing.
+func minMuxRate(bps float64) uint {
+	return uint(bps*muxOverhead) + muxTables
+}
+
+// nullStuffer sits right before the sink, and pads the MPEG-TS out to a constant bitrate with null packets.
+//
+// The mux rate needs to be greater than the audio bitrate, plus the overhead of the MPEG-TS itself:
+// for a 128 kbps stream, this is about 160 kbps, so a mux rate of 192 kbps or more would be sane.
+// If the stream sends more than the mux rate, then no stuffing is done, and the output is not constant bitrate.
+type nullStuffer struct {
+	namedWriteCloser
+
+	rate uint
+
+	mu       sync.Mutex
+	start    time.Time
+	sent     int64
+	overflow bool
+
+	pkt [ts.PacketSize]byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newNullStuffer(w namedWriteCloser, rate uint) *nullStuffer {
+	s := &nullStuffer{
+		namedWriteCloser: w,
+
+		rate: rate,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	b := s.pkt[:]
+	b[0] = 0x47
+	b[1] = byte(pidNull >> 8)
+	b[2] = byte(pidNull & 0xFF)
+	// Null packets are payload only, and their continuity_counter is undefined.
+	b[3] = 0x10
+
+	for i := 4; i < len(b); i++ {
+		b[i] = 0xFF
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *nullStuffer) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(stuffingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.stuff(); err != nil {
+			glog.Errorf("null stuffer: %+v", err)
+		}
+	}
+}
+
+// target returns the number of packets that should have been sent by now.
+//
+// Caller MUST hold the lock.
+func (s *nullStuffer) target() int64 {
+	elapsed := time.Since(s.start)
+
+	return int64(elapsed.Seconds() * float64(s.rate) / (ts.PacketSize * 8))
+}
+
+// stuff writes enough null packets to bring the output back up to the mux rate.
+func (s *nullStuffer) stuff() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Until the first write, the stream has not started, and there is nothing to pad out.
+	if s.start.IsZero() {
+		return nil
+	}
+
+	behind := s.target() - s.sent
+	if behind <= 0 {
+		s.overflowed(-behind)
+		return nil
+	}
+
+	s.overflow = false
+
+	// If the output stalled for over a second, sending it all at once would just be a burst, not a constant bitrate.
+	perSecond := int64(s.rate / (ts.PacketSize * 8))
+	if behind > perSecond {
+		if glog.V(2) {
+			glog.Infof("null stuffer: %s: %d packets behind, resyncing", s.Name(), behind)
+		}
+
+		s.sent += behind - perSecond/10
+		behind = perSecond / 10
+	}
+
+	for ; behind > 0; behind-- {
+		if _, err := s.namedWriteCloser.Write(s.pkt[:]); err != nil {
+			return err
+		}
+
+		s.sent++
+	}
+
+	return nil
+}
+
+// overflowed warns once if the stream has gotten more than a second ahead of the mux rate.
+//
+// Caller MUST hold the lock.
+func (s *nullStuffer) overflowed(ahead int64) {
+	if s.overflow || ahead < int64(s.rate/(ts.PacketSize*8)) {
+		return
+	}
+
+	s.overflow = true
+
+	if bps := streamBitrate(); bps > 0 {
+		glog.Warningf("--ts-mux-rate %d is too low for the stream at %v bps: need at least %d", s.rate, bps, minMuxRate(bps))
+		return
+	}
+
+	glog.Warningf("--ts-mux-rate %d is too low for the stream", s.rate)
+}
+
+func (s *nullStuffer) Write(b []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(b)%ts.PacketSize != 0 {
+		return 0, errors.Errorf("null stuffer: partial mpegts packet: %d bytes", len(b)%ts.PacketSize)
+	}
+
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+
+	n, err = s.namedWriteCloser.Write(b)
+	s.sent += int64(n / ts.PacketSize)
+
+	return n, err
+}
+
+// Close stops the stuffing, and closes the underlying writer.
+func (s *nullStuffer) Close() error {
+	close(s.stop)
+	<-s.done
+
+	return s.namedWriteCloser.Close()
+}
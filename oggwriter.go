@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// oggHeaderSize is the size of the fixed part of an Ogg page header, up to and including the page_segments count.
+	oggHeaderSize = 27
+
+	// oggCRCOffset is where the CRC_checksum is in the Ogg page header.
+	oggCRCOffset = 22
+)
+
+// oggPageLength returns the length of the Ogg page at the start of b.
+//
+// It returns a length of zero if more data is needed to tell, and ok is false if b does not start with a valid Ogg page.
+func oggPageLength(b []byte) (n int, ok bool) {
+	if len(b) < len(magicOgg) {
+		return 0, bytes.HasPrefix(magicOgg, b)
+	}
+
+	if !isOgg(b) {
+		return 0, false
+	}
+
+	if len(b) < oggHeaderSize {
+		return 0, true
+	}
+
+	// stream_structure_version must be zero, and only the lowest three bits of header_type_flag are defined.
+	if b[4] != 0 || b[5]&^0x07 != 0 {
+		return 0, false
+	}
+
+	segments := int(b[26])
+	if len(b) < oggHeaderSize+segments {
+		return 0, true
+	}
+
+	n = oggHeaderSize + segments
+	for _, l := range b[oggHeaderSize : oggHeaderSize+segments] {
+		n += int(l)
+	}
+
+	if len(b) < n {
+		return 0, true
+	}
+
+	if binary.LittleEndian.Uint32(b[oggCRCOffset:]) != oggCRC(b[:n]) {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// oggCRC calculates the CRC of an Ogg page, as if its CRC_checksum field were zero.
+//
+// This is the same polynomial as the CRC32 of MPEG-TS, but it starts from zero, rather than all ones.
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+
+	for i, c := range page {
+		if i >= oggCRCOffset && i < oggCRCOffset+4 {
+			c = 0
+		}
+
+		crc = crc<<8 ^ crc32MPEG2Table[byte(crc>>24)^c]
+	}
+
+	return crc
+}
+
+// oggWriter sits in front of a plain file output, and if the stream turns out to be Ogg,
+// it only ever writes whole Ogg pages, so that a reconnect does not leave a torn page in the file.
+//
+// On a discontinuity, any partial page from the old connection is discarded,
+// and the writer resyncs on the first whole page from the new connection.
+// Ogg allows one stream to be chained after another, so the result is a valid Ogg file.
+//
+// If the stream is not Ogg, then everything is passed straight through.
+type oggWriter struct {
+	io.WriteCloser
+
+	mu sync.Mutex
+
+	detected bool
+	ogg      bool
+
+	buf       []byte
+	resyncing bool
+	dropped   int
+}
+
+func newOggWriter(w io.WriteCloser) *oggWriter {
+	return &oggWriter{
+		WriteCloser: w,
+	}
+}
+
+// Discontinuity discards any partial page, since the rest of it will never arrive.
+func (w *oggWriter) Discontinuity() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.ogg {
+		return
+	}
+
+	if len(w.buf) > 0 {
+		if glog.V(1) {
+			glog.Infof("ogg: discarded partial page of %d bytes at reconnect", len(w.buf))
+		}
+	}
+
+	w.buf = w.buf[:0]
+	w.resyncing = true
+}
+
+func (w *oggWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.detected && !w.ogg {
+		return w.WriteCloser.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+
+	if !w.detected {
+		if len(w.buf) < len(magicOgg) {
+			return len(b), nil
+		}
+
+		w.detected = true
+		w.ogg = isOgg(w.buf)
+
+		if !w.ogg {
+			buf := w.buf
+			w.buf = nil
+
+			if _, err := w.WriteCloser.Write(buf); err != nil {
+				return 0, err
+			}
+
+			return len(b), nil
+		}
+
+		if glog.V(1) {
+			glog.Info("ogg: writing whole pages only")
+		}
+	}
+
+	if err := w.writePages(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writePages writes out every whole page that has been buffered.
+//
+// Caller MUST hold the lock.
+func (w *oggWriter) writePages() error {
+	off := 0
+	defer func() {
+		w.buf = append(w.buf[:0], w.buf[off:]...)
+	}()
+
+	for off < len(w.buf) {
+		n, ok := oggPageLength(w.buf[off:])
+
+		if !ok {
+			if !w.resyncing {
+				glog.Warning("ogg: lost sync")
+				w.resyncing = true
+			}
+
+			// Skip ahead to the next possible page.
+			i := bytes.Index(w.buf[off+1:], magicOgg)
+			if i < 0 {
+				// Hold on to the tail, in case it is the start of the capture pattern.
+				skip := len(w.buf) - off - (len(magicOgg) - 1)
+				if skip > 0 {
+					w.dropped += skip
+					off += skip
+				}
+				return nil
+			}
+
+			w.dropped += i + 1
+			off += i + 1
+			continue
+		}
+
+		if n == 0 {
+			// need more data
+			return nil
+		}
+
+		if w.resyncing {
+			if w.dropped > 0 {
+				if glog.V(1) {
+					glog.Infof("ogg: resynced, discarded %d bytes", w.dropped)
+				}
+			}
+
+			w.resyncing = false
+			w.dropped = 0
+		}
+
+		if _, err := w.WriteCloser.Write(w.buf[off : off+n]); err != nil {
+			return err
+		}
+
+		off += n
+	}
+
+	return nil
+}
+
+// Close closes the underlying writer.
+// Any partial page is discarded, unless we never saw enough of the stream to know whether it was Ogg.
+func (w *oggWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.detected && len(w.buf) > 0 {
+		if _, err := w.WriteCloser.Write(w.buf); err != nil {
+			w.WriteCloser.Close()
+			return err
+		}
+	}
+
+	if w.ogg && len(w.buf) > 0 {
+		if glog.V(1) {
+			glog.Infof("ogg: discarded partial page of %d bytes at end of stream", len(w.buf))
+		}
+	}
+
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// onRotateCmds tracks the --on-rotate commands that are still running, so that we can wait for them before exiting.
+var onRotateCmds sync.WaitGroup
+
+// runOnRotate runs the --on-rotate command on a finished file, with its path as the last argument.
+//
+// The command runs in the background, so that a slow upload or transcode does not hold up the stream.
+// Its stdout and stderr both go to our stderr, unless --quiet is set, since our stdout may be carrying the stream.
+func runOnRotate(filename string) {
+	args := strings.Fields(Flags.OnRotate)
+	if len(args) == 0 {
+		return
+	}
+
+	if path, ok := localPath(filename); ok {
+		filename = path
+	}
+
+	// Not started with our context, because the last file is finished as we are shutting down, and it must not be canceled.
+	cmd := exec.Command(args[0], append(args[1:], filename)...)
+
+	if stderr != nil {
+		cmd.Stdout = stderr
+		cmd.Stderr = stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		glog.Errorf("--on-rotate: %s: %+v", filename, err)
+		return
+	}
+
+	if glog.V(1) {
+		glog.Infof("--on-rotate: %s: started pid %d", filename, cmd.Process.Pid)
+	}
+
+	onRotateCmds.Add(1)
+	go func() {
+		defer onRotateCmds.Done()
+
+		start := time.Now()
+
+		if err := cmd.Wait(); err != nil {
+			glog.Errorf("--on-rotate: %s: %+v", filename, err)
+			return
+		}
+
+		if glog.V(1) {
+			glog.Infof("--on-rotate: %s: finished in %v", filename, time.Since(start))
+		}
+	}()
+}
+
+// waitOnRotate waits for any --on-rotate commands that are still running to finish.
+func waitOnRotate() {
+	done := make(chan struct{})
+
+	go func() {
+		onRotateCmds.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	glog.Info("waiting for --on-rotate commands to finish")
+	<-done
+}
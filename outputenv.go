@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// expandOutputs expands the references to environment variables in each of the -o outputs, in place.
+func expandOutputs(outputs []string) error {
+	for i, output := range outputs {
+		expanded, err := expandOutput(output)
+		if err != nil {
+			return err
+		}
+
+		outputs[i] = expanded
+	}
+
+	return nil
+}
+
+// expandOutput expands the ${VAR} and $VAR references to environment variables in an output, with $$ for a literal $.
+//
+// The environment is expanded once, at startup, and only then are the strftime tokens of a rotating output expanded,
+// each time that a new file is started. So, the value of a variable is always taken literally:
+// in any output that is a strftime template, a % in the value is escaped, so that it is never taken as a token.
+//
+// An unset variable is an error, rather than silently becoming an empty part of the path.
+func expandOutput(output string) (string, error) {
+	if !strings.Contains(output, "$") {
+		return output, nil
+	}
+
+	name := strings.TrimPrefix(output, "mpegts:")
+
+	// Network outputs and hls playlists are never strftime templates, and a % in a URL is a percent-encoding.
+	escape := !isSocketOutput(name) && !isHLSOutput(name) && !strings.HasPrefix(name, "tcp:")
+
+	var missing []string
+
+	expanded := os.Expand(output, func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			missing = append(missing, key)
+			return ""
+		}
+
+		if escape {
+			val = strings.ReplaceAll(val, "%", "%%")
+		}
+
+		return val
+	})
+
+	if len(missing) > 0 {
+		return "", errors.Errorf("output %q: environment variable not set: %s", output, strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+	"github.com/puellanivis/breton/lib/mpeg/ts/pcr"
+)
+
+// maxPCRInterval is the longest that DVB allows between PCRs, as per ETSI TR 101 290.
+const maxPCRInterval = 100 * time.Millisecond
+
+// validatePCRInterval checks that --pcr-interval is within what DVB allows.
+func validatePCRInterval() error {
+	if Flags.PCRInterval < 0 || Flags.PCRInterval > maxPCRInterval {
+		return errors.Errorf("bad --pcr-interval: %v: must be no more than %v", Flags.PCRInterval, maxPCRInterval)
+	}
+
+	return nil
+}
+
+// pcrPacer sits between the pidRemapper and the sink, and ensures that there is a PCR at least every interval.
+//
+// The ts.Mux only sends a PCR at the start of each PES packet, so if the audio frames arrive slowly,
+// then it inserts an adaptation-field-only packet on the PCR PID, with a PCR extrapolated from the last one.
+// Since the ts.Mux takes its PCR from the wall clock, extrapolating by the wall clock keeps them consistent.
+type pcrPacer struct {
+	namedWriteCloser
+
+	pid      uint16
+	interval time.Duration
+
+	mu   sync.Mutex
+	last pcr.PCR
+	at   time.Time
+	cc   byte
+
+	pkt [ts.PacketSize]byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPCRPacer(w namedWriteCloser, pid uint16, interval time.Duration) *pcrPacer {
+	p := &pcrPacer{
+		namedWriteCloser: w,
+
+		pid:      pid,
+		interval: interval,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+func (p *pcrPacer) run() {
+	defer close(p.done)
+
+	for {
+		t := time.NewTimer(p.pace())
+
+		select {
+		case <-p.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// pace writes an extrapolated PCR, if the last one is about to be too old,
+// and returns how long until it should be called again.
+func (p *pcrPacer) pace() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Leave a margin for the timer to fire late.
+	due := p.interval * 9 / 10
+
+	// Until the first PCR, the stream has not started, and there is nothing to extrapolate from.
+	if p.at.IsZero() {
+		return due
+	}
+
+	since := time.Since(p.at)
+	if since < due {
+		return due - since
+	}
+
+	p.last.Set(p.last.Duration() + since)
+	p.at = p.at.Add(since)
+
+	if err := p.writePCR(); err != nil {
+		glog.Errorf("pcr pacer: %+v", err)
+	}
+
+	return due
+}
+
+// writePCR writes an adaptation-field-only packet on the PCR PID carrying the last PCR.
+//
+// Caller MUST hold the lock.
+func (p *pcrPacer) writePCR() error {
+	const (
+		flagAF  = 0x20
+		flagPCR = 0x10
+	)
+
+	b := p.pkt[:]
+
+	b[0] = 0x47
+	b[1] = byte(p.pid>>8) & 0x1F
+	b[2] = byte(p.pid)
+	// An adaptation field only packet does not increment the continuity_counter,
+	// but it must still repeat the current one, if this PID also carries payload.
+	b[3] = flagAF | p.cc
+	b[4] = ts.PacketSize - 5
+	b[5] = flagPCR
+
+	v, err := p.last.Marshal()
+	if err != nil {
+		return err
+	}
+	copy(b[6:12], v)
+
+	for i := 12; i < len(b); i++ {
+		b[i] = 0xFF
+	}
+
+	_, err = p.namedWriteCloser.Write(b)
+	return err
+}
+
+func (p *pcrPacer) Write(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	const (
+		flagAF  = 0x20
+		flagPCR = 0x10
+	)
+
+	for off := 0; off+ts.PacketSize <= len(b); off += ts.PacketSize {
+		pkt := b[off : off+ts.PacketSize]
+
+		if getPID(pkt[1:]) != p.pid {
+			continue
+		}
+
+		p.cc = pkt[3] & 0x0F
+
+		if pkt[3]&flagAF != 0 && pkt[4] >= 7 && pkt[5]&flagPCR != 0 {
+			if err := p.last.Unmarshal(pkt[6:12]); err == nil {
+				p.at = time.Now()
+			}
+		}
+	}
+
+	return p.namedWriteCloser.Write(b)
+}
+
+// Close stops the pacing, and closes the underlying writer.
+func (p *pcrPacer) Close() error {
+	close(p.stop)
+	<-p.done
+
+	return p.namedWriteCloser.Close()
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+const (
+	// PIDs below 0x0020 are reserved by MPEG-TS and DVB for their own tables, and 0x1FFF is the null packet.
+	minUserPID = 0x0020
+	maxUserPID = 0x1FFE
+)
+
+// validatePID returns an error if pid cannot be used for a PMT or elementary stream.
+func validatePID(name string, pid uint16) error {
+	if pid < minUserPID || pid > maxUserPID {
+		return errors.Errorf("bad %s: 0x%04X: must be between 0x%04X and 0x%04X", name, pid, minUserPID, maxUserPID)
+	}
+
+	return nil
+}
+
+// validateTSFlags checks that the MPEG-TS program number and PID flags are legal and do not collide.
+func validateTSFlags() error {
+	if Flags.TSProgramNumber == 0 {
+		return errors.New("bad --ts-program-number: program number 0 is reserved for the network information table")
+	}
+
+	if err := validatePID("--ts-pmt-pid", Flags.TSPMTPID); err != nil {
+		return err
+	}
+
+	if err := validatePID("--ts-elementary-pid", Flags.TSElementaryPID); err != nil {
+		return err
+	}
+
+	if Flags.TSPMTPID == Flags.TSElementaryPID {
+		return errors.Errorf("--ts-pmt-pid and --ts-elementary-pid cannot both be 0x%04X", Flags.TSPMTPID)
+	}
+
+	if Flags.TSPCRPID != 0 {
+		if err := validatePID("--ts-pcr-pid", Flags.TSPCRPID); err != nil {
+			return err
+		}
+
+		if Flags.TSPCRPID == Flags.TSPMTPID {
+			return errors.Errorf("--ts-pmt-pid and --ts-pcr-pid cannot both be 0x%04X", Flags.TSPMTPID)
+		}
+	}
+
+	return validatePCRInterval()
+}
+
+// tsProgramNumber returns the program_number of the index'th program, with --multi-program.
+func tsProgramNumber(index int) uint16 {
+	return Flags.TSProgramNumber + uint16(index)
+}
+
+// tsPMTPID returns the PID that the PMT of the index'th program is sent on.
+func tsPMTPID(index int) uint16 {
+	return Flags.TSPMTPID + uint16(index)
+}
+
+// tsElementaryPID returns the PID that the audio of the index'th program is sent on.
+func tsElementaryPID(index int) uint16 {
+	return Flags.TSElementaryPID + uint16(index)
+}
+
+// tsPCRPID returns the PID that the PCR is sent on.
+func tsPCRPID() uint16 {
+	if Flags.TSPCRPID != 0 {
+		return Flags.TSPCRPID
+	}
+
+	return Flags.TSElementaryPID
+}
+
+// pidRemapper sits between a ts.Mux and its sink, and rewrites the PIDs that the ts.Mux allocated into the ones requested.
+//
+// The PAT and PMT are rewritten to refer to the new PIDs,
+// and if a separate PCR PID is requested, then the PCR from each elementary stream packet is also sent on the PCR PID.
+//
+// Even when nothing needs to be remapped, the PAT, PMT, and SDT still get their CRC32 filled in,
+// since the psi package only ever marshals them with a placeholder.
+type pidRemapper struct {
+	namedWriteCloser
+
+	mu sync.Mutex
+
+	passthru bool
+
+	pmts map[uint16]bool
+	pids map[uint16]uint16
+
+	// PCRs are taken from pcrSrc and duplicated onto pcrPID.
+	pcrSrc uint16
+	pcrPID uint16
+
+	buf [ts.PacketSize]byte
+	pcr [ts.PacketSize]byte
+}
+
+func newPIDRemapper(w namedWriteCloser) *pidRemapper {
+	return &pidRemapper{
+		namedWriteCloser: w,
+		passthru:         true,
+		pmts:             make(map[uint16]bool),
+		pids:             make(map[uint16]uint16),
+	}
+}
+
+// addProgram sets up the remapping of the PMT and elementary stream PIDs that the ts.Mux allocated for the index'th program.
+func (w *pidRemapper) addProgram(index int, pmtPID, esPID uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pmts[pmtPID] = true
+
+	w.pids[pmtPID] = tsPMTPID(index)
+	w.pids[esPID] = tsElementaryPID(index)
+
+	if pcrPID := tsPCRPID(); index == 0 && pcrPID != Flags.TSElementaryPID {
+		w.pcrSrc = esPID
+		w.pcrPID = pcrPID
+	}
+
+	w.passthru = w.pcrPID == 0
+	for from, to := range w.pids {
+		if from != to {
+			w.passthru = false
+		}
+	}
+}
+
+func getPID(b []byte) uint16 {
+	return binary.BigEndian.Uint16(b) & 0x1FFF
+}
+
+func setPID(b []byte, pid uint16) {
+	b[0] = b[0]&0xE0 | byte(pid>>8)&0x1F
+	b[1] = byte(pid)
+}
+
+func (w *pidRemapper) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.passthru && !w.hasPlaceholderCRC(b) {
+		return w.namedWriteCloser.Write(b)
+	}
+
+	for len(b) >= ts.PacketSize {
+		pkt := w.buf[:]
+		copy(pkt, b)
+
+		if err := w.remap(pkt); err != nil {
+			return n, err
+		}
+
+		n += ts.PacketSize
+		b = b[ts.PacketSize:]
+	}
+
+	if len(b) > 0 {
+		return n, errors.Errorf("pid remapper: partial mpegts packet: %d bytes", len(b))
+	}
+
+	return n, nil
+}
+
+// remap rewrites and writes a single MPEG-TS packet.
+//
+// Caller MUST hold the lock.
+func (w *pidRemapper) remap(pkt []byte) error {
+	pid := getPID(pkt[1:])
+
+	switch {
+	case pid == pidPAT:
+		w.remapPAT(pkt)
+
+	case w.pmts[pid]:
+		w.remapPMT(pkt)
+
+	case pid == pidSDT:
+		if sec := psiSection(pkt); sec != nil {
+			putCRC(sec)
+		}
+	}
+
+	if to, ok := w.pids[pid]; ok {
+		setPID(pkt[1:], to)
+	}
+
+	if _, err := w.namedWriteCloser.Write(pkt); err != nil {
+		return err
+	}
+
+	if w.pcrPID != 0 && pid == w.pcrSrc {
+		if pcr := w.pcrPacket(pkt); pcr != nil {
+			if _, err := w.namedWriteCloser.Write(pcr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasPlaceholderCRC returns true if any of the MPEG-TS packets carries a PAT, PMT, or SDT, whose CRC32 still needs to be filled in.
+//
+// Caller MUST hold the lock.
+func (w *pidRemapper) hasPlaceholderCRC(b []byte) bool {
+	for ; len(b) >= ts.PacketSize; b = b[ts.PacketSize:] {
+		if pid := getPID(b[1:]); pid == pidPAT || pid == pidSDT || w.pmts[pid] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// psiSection returns the PSI section in the given packet, if the packet contains the whole of one.
+func psiSection(pkt []byte) []byte {
+	const (
+		flagPUSI    = 0x40
+		flagAF      = 0x20
+		flagPayload = 0x10
+
+		// table_id through last_section_number, and the CRC32.
+		minSectionLength = 8 + 4
+	)
+
+	if pkt[1]&flagPUSI == 0 || pkt[3]&flagPayload == 0 {
+		return nil
+	}
+
+	off := 4
+	if pkt[3]&flagAF != 0 {
+		off += 1 + int(pkt[off])
+	}
+
+	if off >= len(pkt) {
+		return nil
+	}
+
+	// skip the pointer_field
+	off += 1 + int(pkt[off])
+
+	if off+3 > len(pkt) {
+		return nil
+	}
+
+	end := off + 3 + int(binary.BigEndian.Uint16(pkt[off+1:])&0x0FFF)
+	if end > len(pkt) || end-off < minSectionLength {
+		return nil
+	}
+
+	return pkt[off:end]
+}
+
+// remapPAT rewrites the program_map_PIDs of a PAT.
+//
+// It also notes every PMT PID that the ts.Mux lists, since a PMT can go out before its program has been added to the remapper.
+func (w *pidRemapper) remapPAT(pkt []byte) {
+	sec := psiSection(pkt)
+	if sec == nil {
+		return
+	}
+
+	for b := sec[8 : len(sec)-4]; len(b) >= 4; b = b[4:] {
+		if binary.BigEndian.Uint16(b) != 0 {
+			w.pmts[getPID(b[2:])] = true
+		}
+
+		if to, ok := w.pids[getPID(b[2:])]; ok {
+			setPID(b[2:], to)
+		}
+	}
+
+	putCRC(sec)
+}
+
+// remapPMT rewrites the PCR_PID, and the elementary_PIDs of a PMT.
+func (w *pidRemapper) remapPMT(pkt []byte) {
+	sec := psiSection(pkt)
+	if sec == nil {
+		return
+	}
+
+	body := sec[:len(sec)-4]
+
+	if w.pcrPID != 0 {
+		setPID(body[8:], w.pcrPID)
+	} else if to, ok := w.pids[getPID(body[8:])]; ok {
+		setPID(body[8:], to)
+	}
+
+	progInfoLen := int(binary.BigEndian.Uint16(body[10:]) & 0x0FFF)
+	if 12+progInfoLen > len(body) {
+		return
+	}
+
+	for b := body[12+progInfoLen:]; len(b) >= 5; {
+		if to, ok := w.pids[getPID(b[1:])]; ok {
+			setPID(b[1:], to)
+		}
+
+		esInfoLen := int(binary.BigEndian.Uint16(b[3:]) & 0x0FFF)
+		if 5+esInfoLen > len(b) {
+			break
+		}
+
+		b = b[5+esInfoLen:]
+	}
+
+	putCRC(sec)
+}
+
+// pcrPacket returns an adaptation-field-only packet on the PCR PID, carrying the PCR from the given packet, if it has one.
+func (w *pidRemapper) pcrPacket(pkt []byte) []byte {
+	const (
+		flagAF  = 0x20
+		flagPCR = 0x10
+	)
+
+	if pkt[3]&flagAF == 0 || pkt[4] < 7 || pkt[5]&flagPCR == 0 {
+		return nil
+	}
+
+	b := w.pcr[:]
+
+	b[0] = 0x47
+	b[1] = byte(w.pcrPID>>8) & 0x1F
+	b[2] = byte(w.pcrPID)
+	// An adaptation field only packet does not increment the continuity_counter, so it can always be zero.
+	b[3] = flagAF
+	b[4] = ts.PacketSize - 5
+	b[5] = flagPCR
+	copy(b[6:12], pkt[6:12])
+
+	for i := 12; i < len(b); i++ {
+		b[i] = 0xFF
+	}
+
+	return b
+}
+
+// putCRC writes the CRC32 of the PSI section into its last four bytes.
+func putCRC(sec []byte) {
+	body := sec[:len(sec)-4]
+
+	binary.BigEndian.PutUint32(sec[len(body):], crc32MPEG2(body))
+}
+
+var crc32MPEG2Table = func() (tbl [256]uint32) {
+	const poly = 0x04C11DB7
+
+	for i := range tbl {
+		crc := uint32(i) << 24
+
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+
+		tbl[i] = crc
+	}
+
+	return tbl
+}()
+
+// crc32MPEG2 calculates the CRC32 used by MPEG-TS PSI sections, which is not the same as the IEEE CRC32 in hash/crc32.
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+
+	for _, c := range b {
+		crc = crc<<8 ^ crc32MPEG2Table[byte(crc>>24)^c]
+	}
+
+	return crc
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+)
+
+// maxPlaylistSize is the most that we will read of a playlist, it should be plenty for even the largest PLS or M3U.
+const maxPlaylistSize = 64 * 1024
+
+var playlistTypes = map[string]bool{
+	"audio/x-scpls":                 true,
+	"audio/scpls":                   true,
+	"audio/mpegurl":                 true,
+	"audio/x-mpegurl":               true,
+	"application/mpegurl":           true,
+	"application/x-mpegurl":         true,
+	"application/vnd.apple.mpegurl": true,
+}
+
+var playlistExts = map[string]bool{
+	".pls":  true,
+	".m3u":  true,
+	".m3u8": true,
+}
+
+// isPlaylist returns true if the given file is a PLS or M3U playlist, either by its Content-Type, or by its extension.
+func isPlaylist(f files.Reader) bool {
+	if h, ok := f.(headerer); ok {
+		if header, err := h.Header(); err == nil {
+			typ, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+			if playlistTypes[strings.ToLower(typ)] {
+				return true
+			}
+		}
+	}
+
+	name := f.Name()
+	if uri, err := url.Parse(name); err == nil && uri.Path != "" {
+		name = uri.Path
+	}
+
+	return playlistExts[strings.ToLower(path.Ext(name))]
+}
+
+// readPlaylist reads and closes the given playlist file, and returns the stream URLs listed in it.
+//
+// Relative URLs are resolved relative to the URL of the playlist itself.
+func readPlaylist(f files.Reader) ([]string, error) {
+	b, err := io.ReadAll(io.LimitReader(f, maxPlaylistSize))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "playlist")
+	}
+
+	var entries []string
+
+	if isPLS(b) {
+		entries = parsePLS(b)
+	} else {
+		if bytes.Contains(b, []byte("#EXT-X-TARGETDURATION")) || bytes.Contains(b, []byte("#EXT-X-STREAM-INF")) {
+			return nil, errors.Errorf("%s: HLS playlists are not supported as input", f.Name())
+		}
+
+		entries = parseM3U(b)
+	}
+
+	if len(entries) < 1 {
+		return nil, errors.Errorf("%s: playlist has no entries", f.Name())
+	}
+
+	base, err := url.Parse(f.Name())
+	if err != nil {
+		return entries, nil
+	}
+
+	for i, entry := range entries {
+		if uri, err := url.Parse(entry); err == nil {
+			entries[i] = base.ResolveReference(uri).String()
+		}
+	}
+
+	return entries, nil
+}
+
+func isPLS(b []byte) bool {
+	b = bytes.TrimSpace(bytes.TrimPrefix(b, []byte("\xEF\xBB\xBF")))
+
+	return bytes.HasPrefix(bytes.ToLower(b), []byte("[playlist]"))
+}
+
+// parsePLS returns the FileN= entries of a PLS playlist, ordered by N.
+func parsePLS(b []byte) []string {
+	type entry struct {
+		n   int
+		url string
+	}
+
+	var list []entry
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(key) < 5 || !strings.EqualFold(key[:4], "File") || val == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(key[4:])
+		if err != nil {
+			continue
+		}
+
+		list = append(list, entry{n, val})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].n < list[j].n })
+
+	var entries []string
+	for _, e := range list {
+		entries = append(entries, e.url)
+	}
+
+	return entries
+}
+
+// parseM3U returns the non-comment lines of an M3U playlist.
+func parseM3U(b []byte) []string {
+	var entries []string
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\xEF\xBB\xBF"))
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entries = append(entries, line)
+	}
+
+	return entries
+}
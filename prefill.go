@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// prefillWriter sits in front of the pipe into a ts.Mux, and holds off the start of the mux
+// until --buffer-prefill of the stream has been buffered, so that downstream decoders start with some slack.
+//
+// If the stream ends before then, Close releases whatever was buffered anyways.
+type prefillWriter struct {
+	io.WriteCloser
+
+	name string
+
+	mu        sync.Mutex
+	n         int
+	threshold int // -1 until the first write.
+
+	once  sync.Once
+	ready chan struct{}
+}
+
+func newPrefillWriter(w io.WriteCloser, name string) *prefillWriter {
+	return &prefillWriter{
+		WriteCloser: w,
+		name:        name,
+		threshold:   -1,
+		ready:       make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once the prefill is complete.
+func (w *prefillWriter) Ready() <-chan struct{} {
+	return w.ready
+}
+
+func (w *prefillWriter) release() {
+	w.once.Do(func() {
+		close(w.ready)
+	})
+}
+
+// getThreshold returns the number of bytes to prefill.
+//
+// This is only worked out on the first write, since it needs the icy-br of the stream,
+// which we do not know yet when the outputs are opened.
+//
+// Caller MUST hold the lock.
+func (w *prefillWriter) getThreshold() int {
+	if w.threshold >= 0 {
+		return w.threshold
+	}
+
+	bps := streamBitrate()
+	w.threshold = Flags.BufferPrefill.Bytes(bps)
+
+	// The pipe would block forever, if it had to hold more than --max-buffer before it is read from.
+	if max := Flags.MaxBuffer.Bytes(bps); max > 0 && w.threshold > max {
+		glog.Warningf("mpegts: %s: --buffer-prefill is larger than --max-buffer, prefilling only %d bytes", w.name, max)
+		w.threshold = max
+	}
+
+	return w.threshold
+}
+
+func (w *prefillWriter) Write(b []byte) (n int, err error) {
+	select {
+	case <-w.ready:
+		return w.WriteCloser.Write(b)
+	default:
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	threshold := w.getThreshold()
+
+	if w.n+len(b) < threshold {
+		n, err = w.WriteCloser.Write(b)
+		w.n += n
+		return n, err
+	}
+
+	// Only write up to the threshold before releasing, since with --max-buffer, writing any more could block forever.
+	n, err = w.WriteCloser.Write(b[:threshold-w.n])
+	w.n += n
+	if err != nil {
+		return n, err
+	}
+
+	if glog.V(1) {
+		glog.Infof("mpegts: %s: prefilled %d bytes", w.name, w.n)
+	}
+	w.release()
+
+	n2, err := w.WriteCloser.Write(b[n:])
+	return n + n2, err
+}
+
+// Close releases the mux, if it is still waiting for the prefill, and closes the underlying writer.
+func (w *prefillWriter) Close() error {
+	w.release()
+
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// probe connects to each of the given streams in turn, and prints out what we can tell about them to stdout,
+// without opening any output, or streaming anything.
+func probe(ctx context.Context, filenames []string) error {
+	var failed int
+
+	for i, filename := range filenames {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		if err := probeOne(ctx, filename); err != nil {
+			glog.Errorf("probe: [%s] %+v", errorClass(err), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d streams could not be probed", failed, len(filenames))
+	}
+
+	return nil
+}
+
+func probeOne(ctx context.Context, filename string) error {
+	sources := newSourceSet([]string{filename})
+
+	f, err := sources.Open(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, src := sources.Current()
+	fmt.Printf("url: %s\n", src.Name())
+
+	fmt.Printf("resolved-url: %s\n", resolvedName(f))
+
+	var rd io.Reader = f
+
+	if h, ok := f.(headerer); ok {
+		printIcyHeaders(h)
+
+		header, err := h.Header()
+		if err != nil {
+			return err
+		}
+
+		if ct := header.Get("Content-Type"); ct != "" {
+			fmt.Printf("content-type: %s\n", ct)
+		}
+
+		for _, key := range icyHeaderKeys(header) {
+			fmt.Printf("%s: %s\n", strings.ToLower(key), strings.Join(header[key], ", "))
+		}
+
+		metaint, err := getMetaInt(h)
+		if err != nil {
+			return err
+		}
+
+		if metaint > 0 {
+			rd = newMetaReader(f, metaint, nil)
+		}
+	}
+
+	// Reading from the stream does not time out on its own.
+	t := time.AfterFunc(Flags.Timeout, func() { f.Close() })
+	defer t.Stop()
+
+	codec, err := probeCodec(rd)
+	if err != nil {
+		return errors.Errorf("%s: %+v", src.Name(), err)
+	}
+
+	fmt.Printf("codec: %s\n", codec)
+
+	return nil
+}
+
+// probeCodec reads the start of the stream, and returns a description of its codec.
+func probeCodec(r io.Reader) (string, error) {
+	rd := bufio.NewReaderSize(r, sniffSize)
+
+	head, err := rd.Peek(sniffSize)
+	if len(head) == 0 {
+		return "", err
+	}
+
+	if isOgg(head) {
+		return "Ogg", nil
+	}
+
+	frames := newFrameScanner(rd)
+	if !frames.Scan() {
+		if err := frames.Err(); err != nil {
+			return "", err
+		}
+
+		return "", io.ErrUnexpectedEOF
+	}
+
+	typ, err := detectStreamType(frames.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	desc := fmt.Sprintf("%s (stream_type 0x%02X)", codecName(typ), byte(typ))
+	if params := describeFrame(typ, frames.Bytes()); params != "" {
+		desc += ": " + params
+	}
+
+	return desc, nil
+}
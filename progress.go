@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/puellanivis/breton/lib/files"
+)
+
+// progressWindow is how many seconds the bandwidth shown by --progress is averaged over,
+// the same as the bandwidth_running_bps metric.
+const progressWindow = 10
+
+// progress holds the statistics that are shown by --progress.
+var progress struct {
+	bytes      atomic.Int64
+	reconnects atomic.Int64
+
+	// position is how far into the stream we have read, out of its length,
+	// which is only known for a finite source, and is otherwise 0.
+	position atomic.Int64
+	length   atomic.Int64
+}
+
+// progressOpened records the length of a newly opened source, and where in it we are starting from.
+//
+// A live stream has no length, and so --progress only shows the byte count for it.
+func progressOpened(f files.Reader) {
+	start, length := finiteLength(f)
+
+	progress.position.Store(start)
+	progress.length.Store(length)
+}
+
+// finiteLength returns the offset that a finite source starts from, and its complete length, or else 0 and 0.
+func finiteLength(f files.Reader) (start, length int64) {
+	h, ok := f.(headerer)
+	if !ok {
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, 0
+		}
+
+		return 0, fi.Size()
+	}
+
+	header, _ := h.Header()
+
+	// The Content-Length of a stream with inline metadata is not the length of the audio that we copy.
+	if header.Get("Icy-Metaint") != "" {
+		return 0, 0
+	}
+
+	if start, total, ok := contentRange(header); ok {
+		return start, total
+	}
+
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, 0
+	}
+
+	return 0, n
+}
+
+// progressPosition counts the bytes read from the stream, so that --progress can show how far into a finite source we are.
+type progressPosition struct{}
+
+func (progressPosition) Write(b []byte) (n int, err error) {
+	progress.position.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// progressWriter counts the bytes written through it for --progress.
+type progressWriter struct {
+	io.WriteCloser
+}
+
+func (w progressWriter) Write(b []byte) (n int, err error) {
+	n, err = w.WriteCloser.Write(b)
+	progress.bytes.Add(int64(n))
+	return n, err
+}
+
+// formatBytes returns n as a human readable size, in binary units.
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	f := float64(n)
+	i := -1
+	for ; f >= 1<<10 && i < len(units)-1; i++ {
+		f /= 1 << 10
+	}
+
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+// showProgress writes a status line to w every second, overwriting the previous one, until the returned function is called.
+func showProgress(ctx context.Context, w io.Writer) (stop func()) {
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		// The byte counts at each of the last progressWindow ticks.
+		var window [progressWindow]int64
+		var ticks int
+
+		// The read positions at each of the same ticks, from which the ETA is estimated.
+		var positions [progressWindow]int64
+
+		line := func() string {
+			n := progress.bytes.Load()
+			pos, length := progress.position.Load(), progress.length.Load()
+
+			oldest := ticks - len(window)
+			if oldest < 0 {
+				oldest = 0
+			}
+
+			var bps, readBps float64
+			if secs := ticks - oldest; secs > 0 {
+				bps = float64(n-window[oldest%len(window)]) * 8 / float64(secs)
+				readBps = float64(pos-positions[oldest%len(positions)]) * 8 / float64(secs)
+			}
+
+			status := fmt.Sprintf("%s elapsed, %s copied, %.1f kbps, %d reconnects",
+				time.Since(start).Truncate(time.Second),
+				formatBytes(n),
+				bps/1000,
+				progress.reconnects.Load(),
+			)
+
+			if length <= 0 {
+				return status
+			}
+
+			if pos > length {
+				pos = length
+			}
+
+			eta := "--"
+			if readBps > 0 {
+				eta = (time.Duration(float64(length-pos) * 8 / readBps * float64(time.Second))).Truncate(time.Second).String()
+			}
+
+			return fmt.Sprintf("%s of %s (%.1f%%), ETA %s, %s", formatBytes(pos), formatBytes(length), float64(pos)*100/float64(length), eta, status)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				// Leave the final status in place, and move on to a new line.
+				fmt.Fprintf(w, "\r%s\033[K\n", line())
+				return
+
+			case <-ticker.C:
+			}
+
+			ticks++
+			fmt.Fprintf(w, "\r%s\033[K", line())
+			window[ticks%len(window)] = progress.bytes.Load()
+			positions[ticks%len(positions)] = progress.position.Load()
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+const (
+	// pidSDT is the fixed PID of the DVB Service Description Table.
+	pidSDT = 0x0011
+
+	tablePAT = 0x00
+	tablePMT = 0x02
+	tableSDT = 0x42
+
+	tagService = 0x48
+)
+
+// psiLogger sits right before the sink, and with --verbose-mux, logs each PSI table that goes out in the MPEG-TS,
+// along with a hex dump of its packet, so that it can be compared against what ffprobe or a packet capture shows.
+//
+// The ts.Mux repeats its tables regularly, so each one is only logged when it first appears, and whenever it changes.
+type psiLogger struct {
+	namedWriteCloser
+
+	mu   sync.Mutex
+	pmts map[uint16]bool
+
+	// last is keyed by the PID, table_id, and section_number, since the EIT sends two sections on the same PID.
+	last map[uint32][]byte
+}
+
+func newPSILogger(w namedWriteCloser) *psiLogger {
+	return &psiLogger{
+		namedWriteCloser: w,
+		pmts:             make(map[uint16]bool),
+		last:             make(map[uint32][]byte),
+	}
+}
+
+func (w *psiLogger) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	for off := 0; off+ts.PacketSize <= len(b); off += ts.PacketSize {
+		w.inspect(b[off : off+ts.PacketSize])
+	}
+	w.mu.Unlock()
+
+	return w.namedWriteCloser.Write(b)
+}
+
+// inspect logs the packet, if it carries a PSI section that we have not seen before.
+//
+// Caller MUST hold the lock.
+func (w *psiLogger) inspect(pkt []byte) {
+	pid := getPID(pkt[1:])
+
+	switch {
+	case pid == pidPAT, pid == pidSDT, pid == pidEIT, w.pmts[pid]:
+	default:
+		return
+	}
+
+	sec := psiSection(pkt)
+	if sec == nil {
+		return
+	}
+
+	key := uint32(pid)<<16 | uint32(sec[0])<<8 | uint32(sec[6])
+	if bytes.Equal(w.last[key], sec) {
+		return
+	}
+	w.last[key] = append([]byte(nil), sec...)
+
+	var desc string
+
+	switch sec[0] {
+	case tablePAT:
+		desc = w.describePAT(sec)
+	case tablePMT:
+		desc = describePMT(sec)
+	case tableSDT:
+		desc = describeSDT(sec)
+	case tableEITPresentFollowing:
+		desc = describeEIT(sec)
+	default:
+		desc = fmt.Sprintf("table_id=0x%02X", sec[0])
+	}
+
+	glog.Infof("mux: %s: pid 0x%04X: %s\n%s", w.Name(), pid, desc, hex.Dump(pkt))
+}
+
+// psiHeader describes the fields common to the long form of all PSI sections.
+func psiHeader(name string, sec []byte) string {
+	return fmt.Sprintf("%s id=%d version=%d section=%d/%d",
+		name,
+		binary.BigEndian.Uint16(sec[3:]),
+		(sec[5]>>1)&0x1F,
+		sec[6], sec[7],
+	)
+}
+
+// describePAT describes a PAT, and notes the PMT PIDs that it lists, so that we know to log their PMTs.
+//
+// Caller MUST hold the lock.
+func (w *psiLogger) describePAT(sec []byte) string {
+	var progs []string
+
+	for b := sec[8 : len(sec)-4]; len(b) >= 4; b = b[4:] {
+		prog := binary.BigEndian.Uint16(b)
+		pid := getPID(b[2:])
+
+		if prog != 0 {
+			w.pmts[pid] = true
+		}
+
+		progs = append(progs, fmt.Sprintf("program %d -> pid 0x%04X", prog, pid))
+	}
+
+	return psiHeader("PAT", sec) + ": " + strings.Join(progs, ", ")
+}
+
+func describePMT(sec []byte) string {
+	body := sec[:len(sec)-4]
+	if len(body) < 12 {
+		return psiHeader("PMT", sec)
+	}
+
+	desc := fmt.Sprintf("%s pcr_pid=0x%04X", psiHeader("PMT", sec), getPID(body[8:]))
+
+	progInfoLen := int(binary.BigEndian.Uint16(body[10:]) & 0x0FFF)
+	if 12+progInfoLen > len(body) {
+		return desc
+	}
+
+	var streams []string
+
+	for b := body[12+progInfoLen:]; len(b) >= 5; {
+		streams = append(streams, fmt.Sprintf("stream_type 0x%02X on pid 0x%04X", b[0], getPID(b[1:])))
+
+		esInfoLen := int(binary.BigEndian.Uint16(b[3:]) & 0x0FFF)
+		if 5+esInfoLen > len(b) {
+			break
+		}
+
+		b = b[5+esInfoLen:]
+	}
+
+	return desc + ": " + strings.Join(streams, ", ")
+}
+
+func describeSDT(sec []byte) string {
+	body := sec[:len(sec)-4]
+	if len(body) < 11 {
+		return psiHeader("SDT", sec)
+	}
+
+	desc := fmt.Sprintf("%s onid=0x%04X", psiHeader("SDT", sec), binary.BigEndian.Uint16(body[8:]))
+
+	var services []string
+
+	for b := body[11:]; len(b) >= 5; {
+		id := binary.BigEndian.Uint16(b)
+		loopLen := int(binary.BigEndian.Uint16(b[3:]) & 0x0FFF)
+		if 5+loopLen > len(b) {
+			break
+		}
+
+		service := fmt.Sprintf("service_id %d", id)
+
+		for d := b[5 : 5+loopLen]; len(d) >= 2; {
+			l := int(d[1])
+			if 2+l > len(d) {
+				break
+			}
+
+			if d[0] == tagService {
+				provider, name := serviceNames(d[2 : 2+l])
+				service += fmt.Sprintf(" provider=%q name=%q", provider, name)
+			}
+
+			d = d[2+l:]
+		}
+
+		services = append(services, service)
+		b = b[5+loopLen:]
+	}
+
+	return desc + ": " + strings.Join(services, ", ")
+}
+
+// serviceNames returns the provider and service names from the body of a DVB service descriptor.
+func serviceNames(d []byte) (provider, name string) {
+	// service_type, then the length-prefixed provider name, and the length-prefixed service name.
+	if len(d) < 2 || 2+int(d[1]) > len(d) {
+		return "", ""
+	}
+
+	provider = string(d[2 : 2+int(d[1])])
+	d = d[2+int(d[1]):]
+
+	if len(d) < 1 || 1+int(d[0]) > len(d) {
+		return provider, ""
+	}
+
+	return provider, string(d[1 : 1+int(d[0])])
+}
+
+func describeEIT(sec []byte) string {
+	body := sec[:len(sec)-4]
+	desc := psiHeader("EIT", sec)
+
+	// event_id, start_time, duration, running_status and free_CA_mode, descriptors_loop_length
+	const eventHeader = 12
+
+	// transport_stream_id, original_network_id, segment_last_section_number, and last_table_id come before the events.
+	if len(body) < 14+eventHeader {
+		return desc + ": no event"
+	}
+
+	b := body[14:]
+
+	desc += fmt.Sprintf(": event_id %d", binary.BigEndian.Uint16(b))
+
+	loopLen := int(binary.BigEndian.Uint16(b[10:]) & 0x0FFF)
+	if eventHeader+loopLen > len(b) {
+		return desc
+	}
+
+	for d := b[eventHeader : eventHeader+loopLen]; len(d) >= 2; {
+		l := int(d[1])
+		if 2+l > len(d) {
+			break
+		}
+
+		// language code, then the length-prefixed event name.
+		if d[0] == tagShortEvent && l >= 4 && 4+int(d[5]) <= l {
+			desc += fmt.Sprintf(" name=%q", d[6:6+int(d[5])])
+		}
+
+		d = d[2+l:]
+	}
+
+	return desc
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/metrics"
+)
+
+var relayClients = metrics.Gauge("relay_clients", "number of clients connected to the tcp:// relay outputs")
+
+const (
+	// relayMetaInt is the icy-metaint that we send to relay clients that ask for inline metadata.
+	relayMetaInt = 16000
+
+	// defaultRelayBuffer is the default --relay-buffer, as time at the icy-br bitrate.
+	defaultRelayBuffer = 10 * time.Second
+
+	// maxMetaBlock is the largest ICY metadata block, since its length is sent as a single byte of 16 byte blocks.
+	maxMetaBlock = 255 * 16
+)
+
+// relayHeaders are the headers of the stream that are passed on to relay clients.
+var relayHeaders = []string{
+	"Content-Type",
+	"Icy-Name",
+	"Icy-Genre",
+	"Icy-Url",
+	"Icy-Description",
+	"Icy-Br",
+}
+
+var relayInfo struct {
+	sync.Mutex
+	header http.Header
+}
+
+// setRelayInfo records the headers of the stream that we are currently copying, for the relay clients that connect after it.
+func setRelayInfo(h headerer) {
+	header, err := h.Header()
+	if err != nil {
+		return
+	}
+
+	relayInfo.Lock()
+	defer relayInfo.Unlock()
+
+	relayInfo.header = make(http.Header)
+	for _, key := range relayHeaders {
+		if val := header.Get(key); val != "" {
+			relayInfo.header.Set(key, val)
+		}
+	}
+}
+
+// relayAddress returns the address to listen on, if the given output is a relay server:
+// a tcp: URL without a host, e.g. tcp://:8000, or with ?listen=1, e.g. tcp://127.0.0.1:8000?listen=1.
+//
+// Any other tcp: URL connects out to that address, as before.
+func relayAddress(filename string) (string, bool, error) {
+	if !strings.HasPrefix(filename, "tcp:") {
+		return "", false, nil
+	}
+
+	uri, err := url.Parse(filename)
+	if err != nil {
+		return "", false, err
+	}
+
+	q := uri.Query()
+
+	listen := uri.Hostname() == ""
+	if val := q.Get("listen"); val != "" {
+		listen, err = strconv.ParseBool(val)
+		if err != nil {
+			return "", false, errors.Errorf("bad listen value: %s: %+v", val, err)
+		}
+	}
+
+	return uri.Host, listen, nil
+}
+
+// relayServer is an output that listens on a TCP address, and relays the stream to every client that connects to it,
+// along with the ICY headers of the stream, much as a minimal ICECAST server would.
+//
+// The stream is passed on as it is, so a client that connects in the middle of the stream
+// has to sync up to the next frame on its own, just as it would with any other ICECAST server.
+//
+// Writes never fail or block: each client has its own bounded buffer, and a client that falls behind loses the oldest of it,
+// while a client that stops reading altogether is dropped by the write timeout.
+type relayServer struct {
+	l net.Listener
+
+	mu      sync.Mutex
+	clients map[*relayClient]struct{}
+	closed  bool
+
+	wg sync.WaitGroup
+}
+
+// relayClient is the buffer of the stream that has yet to be sent to a single client.
+type relayClient struct {
+	conn net.Conn
+
+	// ready is signaled whenever there is something new in the queue, or the client has been closed.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	queue  [][]byte
+	size   int
+	max    int
+	behind bool
+	closed bool
+}
+
+func newRelayClient(conn net.Conn) *relayClient {
+	max := Flags.RelayBuffer.Bytes(streamBitrate())
+	if max <= 0 {
+		max = (&byteSize{d: defaultRelayBuffer}).Bytes(streamBitrate())
+	}
+
+	return &relayClient{
+		conn:  conn,
+		ready: make(chan struct{}, 1),
+		max:   max,
+	}
+}
+
+// push queues b to be sent to the client, dropping the oldest of what is queued, if that would go over its limit.
+//
+// It returns the number of bytes dropped, if the client has only just now fallen behind.
+func (c *relayClient) push(b []byte) (dropped int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0
+	}
+
+	c.queue = append(c.queue, b)
+	c.size += len(b)
+
+	var n int
+	for c.size > c.max && len(c.queue) > 1 {
+		n += len(c.queue[0])
+		c.size -= len(c.queue[0])
+
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+	}
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+
+	if n == 0 || c.behind {
+		return 0
+	}
+
+	c.behind = true
+	return n
+}
+
+// pop returns the next write to send to the client, waiting until there is one, or returns false, once the client has been closed.
+func (c *relayClient) pop() ([]byte, bool) {
+	for {
+		c.mu.Lock()
+
+		if c.closed {
+			c.mu.Unlock()
+			return nil, false
+		}
+
+		if len(c.queue) > 0 {
+			b := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.size -= len(b)
+
+			if len(c.queue) < 1 {
+				// It has caught up, so the next time that it falls behind, we should hear about it again.
+				c.behind = false
+			}
+
+			c.mu.Unlock()
+			return b, true
+		}
+
+		c.mu.Unlock()
+		<-c.ready
+	}
+}
+
+// close ends the copy to the client, dropping whatever is still queued for it.
+func (c *relayClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.queue = nil
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func newRelayServer(addr string) (*relayServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relayServer{
+		l:       l,
+		clients: make(map[*relayClient]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Name returns the address that the relay is listening on.
+func (s *relayServer) Name() string {
+	return "tcp://" + s.l.Addr().String()
+}
+
+func (s *relayServer) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				glog.Errorf("relay: %s: %+v", s.Name(), err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve reads the request of a relay client, and then sends it the stream, until it hangs up, or is dropped.
+func (s *relayServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	addr := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(Flags.Timeout))
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		if glog.V(1) {
+			glog.Infof("relay: %s: bad request: %+v", addr, err)
+		}
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		fmt.Fprintf(conn, "HTTP/1.0 405 Method Not Allowed\r\nAllow: GET, HEAD\r\n\r\n")
+		return
+	}
+
+	c := newRelayClient(conn)
+
+	switch err := s.add(c); {
+	case errors.Is(err, errRelayFull):
+		glog.Warningf("relay: %s: refusing client: %s: already at --max-clients %d", s.Name(), addr, Flags.MaxClients)
+		io.WriteString(conn, "HTTP/1.0 503 Service Unavailable\r\n\r\n")
+		return
+	case err != nil:
+		return
+	}
+	defer s.remove(c)
+
+	var metaint int
+	if req.Header.Get("Icy-MetaData") == "1" {
+		metaint = relayMetaInt
+	}
+
+	if _, err := io.WriteString(conn, relayResponse(metaint)); err != nil {
+		return
+	}
+
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	glog.Infof("relay: %s: client connected: %s", s.Name(), addr)
+	defer glog.Infof("relay: %s: client disconnected: %s", s.Name(), addr)
+
+	var w io.Writer = conn
+	if metaint > 0 {
+		w = &icyMetaWriter{
+			w:       conn,
+			metaint: metaint,
+			left:    metaint,
+		}
+	}
+
+	timeout := Flags.OutputTimeout
+	if timeout <= 0 {
+		timeout = Flags.Timeout
+	}
+
+	for {
+		b, ok := c.pop()
+		if !ok {
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+
+		if _, err := w.Write(b); err != nil {
+			if glog.V(1) {
+				glog.Infof("relay: %s: %+v", addr, err)
+			}
+			return
+		}
+	}
+}
+
+// relayResponse returns the response header that is sent to each relay client.
+func relayResponse(metaint int) string {
+	relayInfo.Lock()
+	header := relayInfo.header.Clone()
+	relayInfo.Unlock()
+
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "audio/mpeg")
+	}
+
+	header.Set("Icy-Pub", "0")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Server", "icycat/"+Version)
+
+	if metaint > 0 {
+		header.Set("Icy-Metaint", strconv.Itoa(metaint))
+	}
+
+	var b strings.Builder
+
+	b.WriteString("HTTP/1.0 200 OK\r\n")
+	header.Write(&b)
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+var (
+	errRelayClosed = errors.New("relay closed")
+	errRelayFull   = errors.New("relay full")
+)
+
+// add adds the client to the relay, unless the relay has already been closed, or it already has --max-clients.
+func (s *relayServer) add(c *relayClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errRelayClosed
+	}
+
+	if Flags.MaxClients > 0 && len(s.clients) >= Flags.MaxClients {
+		return errRelayFull
+	}
+
+	s.clients[c] = struct{}{}
+	relayClients.Inc()
+
+	return nil
+}
+
+// remove removes the client from the relay, if it has not been already.
+func (s *relayServer) remove(c *relayClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drop(c)
+}
+
+// drop removes the client from the relay, and ends its copy.
+//
+// Caller MUST hold the lock.
+func (s *relayServer) drop(c *relayClient) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+
+	delete(s.clients, c)
+	relayClients.Dec()
+	c.close()
+
+	// Closing the connection also unblocks a write that is in progress.
+	c.conn.Close()
+}
+
+func (s *relayServer) Write(b []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) < 1 {
+		return len(b), nil
+	}
+
+	// Every client writes this out in its own time, and the caller is allowed to reuse b as soon as we return.
+	buf := append([]byte(nil), b...)
+
+	for c := range s.clients {
+		if dropped := c.push(buf); dropped > 0 {
+			glog.Warningf("relay: %s: client is falling behind, dropped the oldest %d bytes: %s", s.Name(), dropped, c.conn.RemoteAddr())
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close stops listening, disconnects all of the clients, and waits for them to finish.
+func (s *relayServer) Close() error {
+	err := s.l.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		s.drop(c)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+// icyMetaWriter inserts an ICY metadata block after every metaint bytes of the stream,
+// with the StreamTitle whenever it has changed, and an empty block otherwise.
+type icyMetaWriter struct {
+	w io.Writer
+
+	metaint int
+	left    int
+
+	sent bool
+	last string
+}
+
+func (w *icyMetaWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if w.left == 0 {
+			if _, err := w.w.Write(w.block()); err != nil {
+				return n, err
+			}
+
+			w.left = w.metaint
+		}
+
+		chunk := b
+		if len(chunk) > w.left {
+			chunk = chunk[:w.left]
+		}
+
+		m, err := w.w.Write(chunk)
+		n += m
+		w.left -= m
+
+		if err != nil {
+			return n, err
+		}
+
+		b = b[m:]
+	}
+
+	return n, nil
+}
+
+// block returns the next metadata block, including its length byte.
+func (w *icyMetaWriter) block() []byte {
+	title := StreamTitle()
+	if w.sent && title == w.last {
+		return []byte{0}
+	}
+
+	w.sent = true
+	w.last = title
+
+	meta := "StreamTitle='" + title + "';"
+	if len(meta) > maxMetaBlock {
+		meta = meta[:maxMetaBlock]
+	}
+
+	l := (len(meta) + 15) / 16
+
+	buf := make([]byte, 1+l*16)
+	buf[0] = byte(l)
+	copy(buf[1:], meta)
+
+	return buf
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// isResumable returns true if the response is for a static file, which we can resume with a Range request.
+//
+// Live streams have no Content-Length, and a stream with inline metadata cannot be resumed by byte offset.
+func isResumable(header http.Header) bool {
+	if header.Get("Accept-Ranges") != "bytes" || header.Get("Icy-Metaint") != "" {
+		return false
+	}
+
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	return err == nil && n > 0
+}
+
+// contentRange returns the first byte position, and the complete length from a Content-Range header.
+func contentRange(header http.Header) (start, total int64, ok bool) {
+	var end int64
+
+	if _, err := fmt.Sscanf(header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, false
+	}
+
+	return start, total, true
+}
+
+// rangeResume tracks how much of a static file source has been copied,
+// so that a reconnect can resume from where it left off, rather than start over from the beginning.
+type rangeResume struct {
+	// cur is the index of the source in the sourceSet that we are resuming.
+	cur int
+
+	offset int64
+	total  int64
+}
+
+// next returns the byte offset to resume from, if we are reopening the given source, or else 0.
+func (r *rangeResume) next(cur int) int64 {
+	if r.total <= 0 || cur != r.cur {
+		return 0
+	}
+
+	return r.offset
+}
+
+// opened records a newly opened source, which we requested from the given offset,
+// and returns true if the source has been resumed from that offset.
+func (r *rangeResume) opened(cur int, f files.Reader, requested int64) bool {
+	var header http.Header
+	if h, ok := f.(headerer); ok {
+		header, _ = h.Header()
+	}
+
+	if requested > 0 {
+		if start, total, ok := contentRange(header); ok && start == requested && total == r.total {
+			glog.Infof("%s: resuming from byte %d of %d", f.Name(), start, total)
+			return true
+		}
+
+		glog.Warningf("%s: could not resume from byte %d, starting over", f.Name(), requested)
+	}
+
+	r.cur = cur
+	r.offset = 0
+	r.total = 0
+
+	if isResumable(header) {
+		r.total, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	}
+
+	return false
+}
+
+// copied records that n more bytes of the source have been copied.
+func (r *rangeResume) copied(n int64) {
+	if r.total > 0 {
+		r.offset += n
+	}
+}
+
+// rewind starts the source over from the beginning, for --loop.
+func (r *rangeResume) rewind() {
+	r.offset = 0
+}
+
+// complete returns true if all of a static file has been copied.
+func (r *rangeResume) complete() bool {
+	return r.total > 0 && r.offset >= r.total
+}
+
+// rangeValue returns the value of a Range header to request everything from the given offset on.
+func rangeValue(offset int64) string {
+	return "bytes=" + strconv.FormatInt(offset, 10) + "-"
+}
+
+// isPartialContent returns true if the response is the partial content that a Range request asked for.
+func isPartialContent(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes ")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryAfterError is returned in place of a 429 Too Many Requests, or 503 Service Unavailable response,
+// so that the Retry-After of the server survives to the reconnect loop,
+// since httpfiles only keeps the status of a failed response.
+type retryAfterError struct {
+	code   int
+	status string
+	delay  time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%s (Retry-After %v)", e.status, e.delay)
+}
+
+// checkRetryAfter returns a retryAfterError, if the response is a 429 or 503 with a valid Retry-After header.
+func checkRetryAfter(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return nil
+	}
+
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return nil
+	}
+
+	return &retryAfterError{
+		code:   resp.StatusCode,
+		status: resp.Status,
+		delay:  delay,
+	}
+}
+
+// parseRetryAfter parses a Retry-After value, which is either a number of seconds, or an HTTP-date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+
+	// The date has already passed, so there is nothing to wait for.
+	return 0, true
+}
+
+// serverRetryAfter returns how long the server asked us to wait before reconnecting, if err came from a retryAfterError.
+func serverRetryAfter(err error) time.Duration {
+	var e *retryAfterError
+	if errors.As(err, &e) {
+		return e.delay
+	}
+
+	return 0
+}
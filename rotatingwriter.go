@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+// defaultRotateTemplate is added to an output filename without a % template, if it is to be rotated.
+const defaultRotateTemplate = "-%Y%m%d-%H%M%S"
+
+// titleTemplate is expanded to the StreamTitle when each file is started.
+// It is added to an output filename that does not already have it, if it is to be split on each title.
+const titleTemplate = "%{title}"
+
+// isRotatingOutput returns true if the given file output should be written with a rotatingWriter.
+func isRotatingOutput(filename string) bool {
+	if filename == "" || filename == "-" {
+		return false
+	}
+
+	return strings.Contains(filename, "%") || Flags.RotateSize != (byteSize{}) || Flags.RotateInterval > 0 || Flags.SplitOnTitle
+}
+
+// rotatingWriter is an io.WriteCloser that writes to a sequence of files,
+// rolling over to a new file after --rotate-size bytes, at every multiple of --rotate-interval,
+// or with --split-on-title, whenever the StreamTitle changes.
+//
+// Each file is named by expanding the strftime-style template with the time the file was started.
+//
+// If mpegts is true, then the files are only rolled over at the start of the PSI preamble that the ts.Mux periodically writes,
+// so that every file starts with a PAT and PMT, and can be played on its own.
+type rotatingWriter struct {
+	mu sync.Mutex
+
+	ctx      context.Context
+	template string
+	mpegts   bool
+
+	// onRotate is called after each new file has been started, except the first.
+	onRotate func()
+
+	f       files.Writer
+	written int
+	next    time.Time
+	inPSI   bool
+	title   string
+
+	// started and titles describe the current file for the --manifest.
+	started time.Time
+	titles  []manifestTitle
+
+	// last is the most recent expansion of the template, and dup counts how many files have had that same name.
+	last string
+	dup  int
+}
+
+func newRotatingWriter(ctx context.Context, filename string, mpegts bool) (*rotatingWriter, error) {
+	template := filename
+	if !strings.Contains(template, "%") {
+		ext := filepath.Ext(template)
+		template = strings.TrimSuffix(template, ext) + defaultRotateTemplate + ext
+	}
+
+	if Flags.SplitOnTitle && !strings.Contains(template, titleTemplate) {
+		ext := filepath.Ext(template)
+		template = strings.TrimSuffix(template, ext) + "-" + titleTemplate + ext
+	}
+
+	w := &rotatingWriter{
+		ctx:      ctx,
+		template: template,
+		mpegts:   mpegts,
+	}
+
+	// Open the first file right away, so that we find out immediately if we cannot create it.
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Name returns the name of the current file.
+func (w *rotatingWriter) Name() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Name()
+}
+
+// OnRotate sets a function to be called each time a new file is started.
+func (w *rotatingWriter) OnRotate(fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.onRotate = fn
+}
+
+// open starts a new file.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) open(now time.Time) error {
+	f, title, err := w.create(now)
+	if err != nil {
+		return err
+	}
+
+	w.start(now, f, title)
+	return nil
+}
+
+// create creates the next file, and returns it along with the StreamTitle that it was named for.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) create(now time.Time) (files.Writer, string, error) {
+	title := StreamTitle()
+
+	// The title could contain a %, so it has to be expanded after the strftime.
+	name := strftime(w.template, now)
+	name = strings.ReplaceAll(name, titleTemplate, sanitizeFilename(title))
+
+	last, dup := name, 0
+	if name == w.last {
+		// We are rotating faster than the template can tell apart, so do not overwrite the file we just finished.
+		last, dup = w.last, w.dup+1
+
+		ext := filepath.Ext(name)
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), dup, ext)
+	}
+
+	var align int64
+	if w.mpegts {
+		align = ts.PacketSize
+	}
+
+	f, err := createOutput(w.ctx, name, align)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !w.mpegts {
+		f = withID3(f, name)
+	}
+
+	w.last, w.dup = last, dup
+
+	return f, title, nil
+}
+
+// start makes the given file, just created for the given StreamTitle, the current file.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) start(now time.Time, f files.Writer, title string) {
+	w.f = f
+	w.written = 0
+	w.title = title
+
+	w.started = now
+	w.titles = nil
+	w.noteTitle(now, title)
+
+	if Flags.RotateInterval > 0 {
+		w.next = now.Truncate(Flags.RotateInterval).Add(Flags.RotateInterval)
+	}
+}
+
+// noteTitle records the StreamTitle for the --manifest, if it is not the same as the last one recorded for the current file.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) noteTitle(now time.Time, title string) {
+	if Flags.Manifest == "" || title == "" {
+		return
+	}
+
+	if n := len(w.titles); n > 0 && w.titles[n-1].Title == title {
+		return
+	}
+
+	w.titles = append(w.titles, manifestTitle{
+		Title:  title,
+		Offset: now.Sub(w.started).Seconds(),
+	})
+}
+
+// finish records the current file, which has just been closed, in the --manifest, and runs --on-rotate on it.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) finish(now time.Time) {
+	name := w.f.Name()
+	if path, ok := localPath(name); ok {
+		name = path
+	}
+
+	addManifestSegment(manifestSegment{
+		Filename: name,
+		Start:    w.started,
+		Duration: now.Sub(w.started).Seconds(),
+		Bytes:    w.written,
+		Titles:   w.titles,
+	})
+
+	runOnRotate(w.f.Name())
+}
+
+// shouldRotate returns true if the current file should be ended.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) shouldRotate(now time.Time) bool {
+	if w.written == 0 {
+		return false
+	}
+
+	if size := Flags.RotateSize.Bytes(streamBitrate()); size > 0 && w.written >= size {
+		return true
+	}
+
+	if Flags.SplitOnTitle && StreamTitle() != w.title {
+		return true
+	}
+
+	return !w.next.IsZero() && !now.Before(w.next)
+}
+
+// rotate closes the current file, and starts a new one.
+//
+// The new file is created before the current one is closed, just as reopenFile.Reopen does,
+// so that if it cannot be created, we are still left with the current file, rather than with no file at all.
+//
+// Caller MUST hold the lock.
+func (w *rotatingWriter) rotate(now time.Time) error {
+	f, title, err := w.create(now)
+	if err != nil {
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		glog.Errorf("%s: %+v", w.f.Name(), err)
+	}
+	w.finish(now)
+
+	w.start(now, f, title)
+
+	glog.Infof("output: %s", w.f.Name())
+
+	if w.onRotate != nil {
+		w.onRotate()
+	}
+
+	return nil
+}
+
+func (w *rotatingWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	boundary := true
+	if w.mpegts {
+		psi := isPreamblePacket(b)
+		boundary = psi && !w.inPSI
+		w.inPSI = psi
+	}
+
+	now := time.Now()
+
+	if boundary && w.shouldRotate(now) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	w.noteTitle(now, StreamTitle())
+
+	n, err = w.f.Write(b)
+	w.written += n
+
+	return n, err
+}
+
+// Close closes the current file, which also finishes it for the --manifest and --on-rotate.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.f.Close()
+	w.finish(time.Now())
+
+	return err
+}
+
+// sanitizeFilename makes a StreamTitle safe to use as part of a filename.
+//
+// Path separators, control characters, and characters that are not allowed in Windows filenames are replaced with an underscore,
+// and the result is limited to maxTitleFilename bytes, without splitting a UTF-8 sequence.
+func sanitizeFilename(title string) string {
+	const maxTitleFilename = 200
+
+	title = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7F:
+			return '_'
+		case strings.ContainsRune(`/\:*?"<>|%`, r):
+			return '_'
+		}
+
+		return r
+	}, title)
+
+	// Leading dots would make a hidden file, and Windows does not allow trailing dots or spaces.
+	title = strings.Trim(title, ". ")
+
+	if len(title) > maxTitleFilename {
+		title = title[:maxTitleFilename]
+
+		for !utf8.ValidString(title) {
+			title = title[:len(title)-1]
+		}
+
+		title = strings.TrimRight(title, ". ")
+	}
+
+	if title == "" {
+		return "untitled"
+	}
+
+	return title
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/metrics"
+)
+
+const (
+	// rtpMaxDropout and rtpMaxMisorder are from RFC 3550, Appendix A.1:
+	// a sequence number further than this from the one expected is taken as the sender having restarted.
+	rtpMaxDropout  = 3000
+	rtpMaxMisorder = 100
+
+	// maxDatagram is the largest UDP payload.
+	maxDatagram = 65535
+)
+
+var rtpLost = metrics.Counter("rtp_packets_lost_total", "number of RTP packets of the input stream that never arrived within the --rtp-jitter-window", metrics.WithLabels(labelStream))
+
+// rtpHandler opens rtp: streams, which are received over UDP, just as udp: streams are,
+// and then unwrapped from RTP, reordered by sequence number.
+//
+// Outputs never get here, since openMuxOutput turns an rtp: output into a udp: one.
+type rtpHandler struct{}
+
+func init() {
+	files.RegisterScheme(&rtpHandler{}, "rtp")
+}
+
+// packetReader is implemented by the datagram readers of socketfiles, which can read a single datagram at a time.
+type packetReader interface {
+	ReadPacket(b []byte) (n int, err error)
+}
+
+func (h *rtpHandler) Open(ctx context.Context, uri *url.URL) (files.Reader, error) {
+	udp := *uri
+	udp.Scheme = "udp"
+
+	f, err := files.Open(ctx, udp.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok := f.(packetReader)
+	if !ok {
+		f.Close()
+		return nil, files.PathError("open", uri.String(), errors.New("udp reader cannot read single datagrams"))
+	}
+
+	window := Flags.RTPJitterWindow
+	if window < 1 {
+		window = 1
+	}
+
+	return &rtpReader{
+		Reader:  f,
+		name:    uri.String(),
+		r:       r,
+		window:  window,
+		lost:    rtpLost.WithLabels(labelStream.WithValue(uri.String())),
+		buf:     make([]byte, maxDatagram),
+		pending: make(map[uint16][]byte),
+	}, nil
+}
+
+func (h *rtpHandler) Create(ctx context.Context, uri *url.URL) (files.Writer, error) {
+	return nil, files.PathError("create", uri.String(), os.ErrInvalid)
+}
+
+func (h *rtpHandler) List(ctx context.Context, uri *url.URL) ([]os.FileInfo, error) {
+	return nil, files.PathError("readdir", uri.String(), os.ErrInvalid)
+}
+
+// rtpReader reads the MPEG-TS carried in an RTP stream, as per RFC 2250.
+//
+// Packets that arrive out of order are held, until either the missing packets arrive,
+// or window packets are being held, at which point the missing ones are given up on as lost.
+// Late and duplicate packets are dropped.
+type rtpReader struct {
+	files.Reader
+	name string
+
+	r      packetReader
+	window int
+	lost   *metrics.CounterValue
+
+	mu sync.Mutex
+
+	buf []byte
+	out []byte
+
+	started bool
+	ssrc    uint32
+	next    uint16
+
+	// late counts the late packets in a row, which means that the sender restarted below where we were.
+	late    int
+	pending map[uint16][]byte
+}
+
+// Name returns the rtp: URL, rather than the udp: one that is actually being read.
+func (r *rtpReader) Name() string {
+	return r.name
+}
+
+func (r *rtpReader) Read(b []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(r.out) < 1 {
+		n, err := r.r.ReadPacket(r.buf)
+		if n > 0 {
+			r.packet(r.buf[:n])
+		}
+
+		if err != nil && len(r.out) < 1 {
+			return 0, err
+		}
+	}
+
+	n = copy(b, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+// packet handles a single received RTP packet.
+//
+// Caller MUST hold the lock.
+func (r *rtpReader) packet(pkt []byte) {
+	seq, ssrc, payload, ok := parseRTP(pkt)
+	if !ok {
+		if glog.V(1) {
+			glog.Infof("rtp: %s: dropping a malformed packet of %d bytes", r.Name(), len(pkt))
+		}
+		return
+	}
+
+	if !r.started || ssrc != r.ssrc {
+		if r.started {
+			glog.Warningf("rtp: %s: SSRC changed from 0x%08X to 0x%08X", r.Name(), r.ssrc, ssrc)
+		}
+
+		r.restart(seq, ssrc)
+	}
+
+	switch diff := int(int16(seq - r.next)); {
+	case diff < 0:
+		r.late++
+		if diff >= -rtpMaxMisorder && r.late <= r.window {
+			if glog.V(2) {
+				glog.Infof("rtp: %s: dropping late or duplicate packet, seq %d", r.Name(), seq)
+			}
+			return
+		}
+
+		glog.Warningf("rtp: %s: sequence jumped back from %d to %d", r.Name(), r.next, seq)
+		r.restart(seq, ssrc)
+
+	case diff >= rtpMaxDropout:
+		glog.Warningf("rtp: %s: sequence jumped ahead from %d to %d", r.Name(), r.next, seq)
+		r.restart(seq, ssrc)
+	}
+	r.late = 0
+
+	if _, ok := r.pending[seq]; ok {
+		// A duplicate of a packet we are already holding.
+		return
+	}
+
+	// buf is reused for the next packet, so anything we hold onto has to be copied out.
+	r.pending[seq] = append([]byte(nil), payload...)
+
+	r.deliver()
+
+	for len(r.pending) > r.window {
+		r.skip()
+		r.deliver()
+	}
+}
+
+// restart starts over from the given sequence number, after handing on whatever was still being held, in order.
+//
+// Caller MUST hold the lock.
+func (r *rtpReader) restart(seq uint16, ssrc uint32) {
+	for len(r.pending) > 0 {
+		r.skip()
+		r.deliver()
+	}
+
+	r.started = true
+	r.ssrc = ssrc
+	r.next = seq
+	r.late = 0
+}
+
+// deliver hands on every held packet that follows on from the last one delivered.
+//
+// Caller MUST hold the lock.
+func (r *rtpReader) deliver() {
+	for {
+		payload, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+
+		delete(r.pending, r.next)
+		r.next++
+
+		r.out = append(r.out, payload...)
+	}
+}
+
+// skip gives up on the packets missing before the earliest one being held, and counts them as lost.
+//
+// Caller MUST hold the lock.
+func (r *rtpReader) skip() {
+	first, found := 0, false
+	for seq := range r.pending {
+		if diff := int(uint16(seq - r.next)); !found || diff < first {
+			first, found = diff, true
+		}
+	}
+
+	if !found || first == 0 {
+		return
+	}
+
+	glog.Warningf("rtp: %s: lost %d packets, from seq %d", r.Name(), first, r.next)
+	r.lost.Add(float64(first))
+
+	r.next += uint16(first)
+}
+
+// parseRTP returns the sequence number, SSRC, and payload of an RTP packet.
+func parseRTP(pkt []byte) (seq uint16, ssrc uint32, payload []byte, ok bool) {
+	const (
+		flagPadding   = 0x20
+		flagExtension = 0x10
+	)
+
+	if len(pkt) < rtpHeaderSize || pkt[0]>>6 != rtpVersion {
+		return 0, 0, nil, false
+	}
+
+	seq = binary.BigEndian.Uint16(pkt[2:])
+	ssrc = binary.BigEndian.Uint32(pkt[8:])
+
+	off := rtpHeaderSize + 4*int(pkt[0]&0x0F)
+
+	if pkt[0]&flagExtension != 0 {
+		if len(pkt) < off+4 {
+			return 0, 0, nil, false
+		}
+
+		off += 4 + 4*int(binary.BigEndian.Uint16(pkt[off+2:]))
+	}
+
+	end := len(pkt)
+	if pkt[0]&flagPadding != 0 {
+		end -= int(pkt[end-1])
+	}
+
+	if off > end {
+		return 0, 0, nil, false
+	}
+
+	return seq, ssrc, pkt[off:end], true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	rtpHeaderSize = 12
+
+	rtpVersion     = 2
+	rtpPayloadMP2T = 33 // RFC 3551: MPEG-2 Transport Stream, with a 90 kHz clock.
+)
+
+// rtpWriter wraps groups of MPEG-TS packets into RTP packets, as per RFC 2250.
+//
+// Each Write of a full RTP packet to the underlying writer is expected to be sent as a single datagram.
+type rtpWriter struct {
+	mu sync.Mutex
+
+	w namedWriteCloser
+
+	buf []byte
+	off int
+
+	seq   uint16
+	ssrc  uint32
+	base  uint32
+	start time.Time
+}
+
+// newRTPWriter returns an rtpWriter that writes payloadSize bytes of MPEG-TS in each RTP packet.
+//
+// If ssrc is 0, then a random SSRC is chosen.
+func newRTPWriter(w namedWriteCloser, payloadSize int, ssrc uint32) *rtpWriter {
+	if ssrc == 0 {
+		ssrc = rand.Uint32()
+	}
+
+	buf := make([]byte, rtpHeaderSize+payloadSize)
+
+	buf[0] = rtpVersion << 6
+	buf[1] = rtpPayloadMP2T
+	binary.BigEndian.PutUint32(buf[8:], ssrc)
+
+	return &rtpWriter{
+		w: w,
+
+		buf: buf,
+		off: rtpHeaderSize,
+
+		// RFC 3550 says the initial sequence number and timestamp should be random.
+		seq:   uint16(rand.Uint32()),
+		ssrc:  ssrc,
+		base:  rand.Uint32(),
+		start: time.Now(),
+	}
+}
+
+// Name returns the name of the underlying writer.
+func (w *rtpWriter) Name() string {
+	return w.w.Name()
+}
+
+func (w *rtpWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(b) > 0 {
+		l := copy(w.buf[w.off:], b)
+		w.off += l
+		n += l
+
+		b = b[l:]
+
+		if w.off < len(w.buf) {
+			break
+		}
+
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// SetPacketSize sets how many bytes of MPEG-TS are sent in each RTP packet, and returns the previous size.
+func (w *rtpWriter) SetPacketSize(size int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prev := len(w.buf) - rtpHeaderSize
+
+	if w.off > rtpHeaderSize+size {
+		// Too much is already buffered for the new size, so send it as it is.
+		if err := w.flush(); err != nil {
+			glog.Errorf("rtp: %s: %+v", w.w.Name(), err)
+		}
+	}
+
+	if size <= prev {
+		w.buf = w.buf[:rtpHeaderSize+size]
+	} else {
+		w.buf = append(w.buf, make([]byte, size-prev)...)
+	}
+
+	return prev
+}
+
+// flush sends any buffered MPEG-TS packets as an RTP packet.
+//
+// Caller MUST hold the lock.
+func (w *rtpWriter) flush() error {
+	if w.off <= rtpHeaderSize {
+		return nil
+	}
+
+	// 90 kHz is 9 ticks every 100,000 ns, and this will not overflow for centuries.
+	elapsed := uint64(time.Since(w.start))
+	ts := w.base + uint32(elapsed*9/100000)
+
+	binary.BigEndian.PutUint16(w.buf[2:], w.seq)
+	binary.BigEndian.PutUint32(w.buf[4:], ts)
+
+	_, err := w.w.Write(w.buf[:w.off])
+
+	w.seq++
+	w.off = rtpHeaderSize
+
+	return err
+}
+
+// Close sends any remaining MPEG-TS packets as a short RTP packet, and closes the underlying writer.
+func (w *rtpWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.flush()
+
+	if err2 := w.w.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// sapAddress is the well-known SAP address for global scope IPv4 sessions, as per RFC 2974.
+	sapAddress = "224.2.127.254:9875"
+
+	sapInterval = 5 * time.Second
+
+	sapVersion  = 1 << 5
+	sapDeletion = 1 << 2
+)
+
+// sapSession is a multicast output to be announced with SAP.
+type sapSession struct {
+	group net.IP
+	port  int
+	ttl   int
+	ifi   *net.Interface
+	rtp   bool
+
+	id      uint64
+	version uint64
+
+	sdp  []byte
+	hash uint16
+}
+
+// newSAPSession returns a sapSession for the given output, if it is a multicast udp: or rtp: output.
+func newSAPSession(filename string) (*sapSession, bool) {
+	uri, err := url.Parse(strings.TrimPrefix(filename, "mpegts:"))
+	if err != nil {
+		return nil, false
+	}
+
+	q := uri.Query()
+
+	isRTP := uri.Scheme == "rtp"
+	if uri.Scheme == "udp" {
+		isRTP, _ = strconv.ParseBool(q.Get("rtp"))
+	} else if !isRTP {
+		return nil, false
+	}
+
+	host, port, err := net.SplitHostPort(uri.Host)
+	if err != nil {
+		return nil, false
+	}
+
+	group := net.ParseIP(host).To4()
+	if group == nil || !group.IsMulticast() {
+		return nil, false
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, false
+	}
+
+	ttl, err := multicastTTL(q)
+	if err != nil {
+		return nil, false
+	}
+
+	ifi, err := multicastInterface(q)
+	if err != nil {
+		return nil, false
+	}
+
+	now := uint64(time.Now().Unix())
+
+	return &sapSession{
+		group: group,
+		port:  p,
+		ttl:   ttl,
+		ifi:   ifi,
+		rtp:   isRTP,
+
+		id:      now,
+		version: now,
+	}, true
+}
+
+// update rebuilds the SDP of the session, and returns true if it has changed.
+func (s *sapSession) update(origin net.IP, name, info string) bool {
+	media := fmt.Sprintf("m=video %d udp mpeg", s.port) // as understood by VLC.
+	if s.rtp {
+		media = fmt.Sprintf("m=video %d RTP/AVP %d", s.port, rtpPayloadMP2T)
+	}
+
+	body := func(version uint64) []byte {
+		b := new(bytes.Buffer)
+
+		fmt.Fprint(b, "v=0\r\n")
+		fmt.Fprintf(b, "o=- %d %d IN IP4 %s\r\n", s.id, version, origin)
+		fmt.Fprintf(b, "s=%s\r\n", name)
+		if info != "" {
+			fmt.Fprintf(b, "i=%s\r\n", info)
+		}
+		fmt.Fprintf(b, "c=IN IP4 %s/%d\r\n", s.group, s.ttl)
+		fmt.Fprint(b, "t=0 0\r\n")
+		fmt.Fprintf(b, "a=tool:icycat %s\r\n", Version)
+		fmt.Fprint(b, "a=type:broadcast\r\n")
+		fmt.Fprint(b, "a=recvonly\r\n")
+		fmt.Fprintf(b, "%s\r\n", media)
+
+		return b.Bytes()
+	}
+
+	if s.sdp != nil && bytes.Equal(body(s.version), s.sdp) {
+		return false
+	}
+
+	if s.sdp != nil {
+		s.version++
+	}
+
+	s.sdp = body(s.version)
+
+	// The message identifier hash must change whenever the session description does.
+	h := fnv.New32a()
+	h.Write(s.sdp)
+	sum := h.Sum32()
+	s.hash = uint16(sum>>16 ^ sum)
+
+	return true
+}
+
+// packet returns a SAP announcement, or deletion packet for the session.
+func (s *sapSession) packet(origin net.IP, deletion bool) []byte {
+	b := []byte{sapVersion, 0, byte(s.hash >> 8), byte(s.hash)}
+	if deletion {
+		b[0] |= sapDeletion
+	}
+
+	b = append(b, origin.To4()...)
+
+	if deletion {
+		// A deletion only needs to identify the session, which is done by its origin field.
+		o := s.sdp[bytes.Index(s.sdp, []byte("o=")):]
+		return append(b, o[:bytes.IndexByte(o, '\n')+1]...)
+	}
+
+	b = append(b, "application/sdp\x00"...)
+	return append(b, s.sdp...)
+}
+
+// startSAP starts periodically announcing each of the given outputs that are multicast udp: or rtp: outputs.
+//
+// The announcements stop when ctx is done, or the returned function is called,
+// at which point a deletion is sent for each session.
+// The returned function waits for the deletions to be sent.
+func startSAP(ctx context.Context, outputs []string) (stop func(), err error) {
+	var sessions []*sapSession
+
+	for _, output := range outputs {
+		if s, ok := newSAPSession(output); ok {
+			sessions = append(sessions, s)
+		}
+	}
+
+	if len(sessions) < 1 {
+		return nil, errors.New("--sap requires a multicast udp: or rtp: output")
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", sapAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	origin := conn.LocalAddr().(*net.UDPAddr).IP
+
+	// Announcements should reach as far as the furthest session, and go out the same interface as the sessions.
+	ttl := defaultMulticastTTL
+	var ifi *net.Interface
+
+	for _, s := range sessions {
+		if s.ttl > ttl {
+			ttl = s.ttl
+		}
+
+		if ifi == nil {
+			ifi = s.ifi
+		}
+	}
+
+	p := ipv4.NewPacketConn(conn)
+
+	if err := p.SetMulticastTTL(ttl); err != nil {
+		glog.Warningf("sap: could not set multicast ttl: %+v", err)
+	}
+
+	if ifi != nil {
+		if err := p.SetMulticastInterface(ifi); err != nil {
+			glog.Warningf("sap: could not set multicast interface: %s: %+v", ifi.Name, err)
+		}
+
+		if ip := interfaceIPv4(ifi); ip != nil {
+			origin = ip
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+
+		var announced bool
+
+		for {
+			name, codec := DVBServiceName(), streamCodec()
+
+			// We do not announce anything until we know what is being streamed.
+			if codec != 0 {
+				if name == "" {
+					name = "icycat"
+				}
+
+				for _, s := range sessions {
+					if s.update(origin, name, codecName(codec)) {
+						glog.Infof("sap: announcing %s:%d as %q", s.group, s.port, name)
+					}
+
+					if _, err := conn.Write(s.packet(origin, false)); err != nil {
+						glog.Errorf("sap: %+v", err)
+					}
+				}
+
+				announced = true
+			}
+
+			// Until the codec is known, check back frequently, so that we announce as soon as we can.
+			wait := time.Second
+			if announced {
+				wait = sapInterval
+			}
+
+			t := time.NewTimer(wait)
+
+			select {
+			case <-ctx.Done():
+				if announced {
+					for _, s := range sessions {
+						if _, err := conn.Write(s.packet(origin, true)); err != nil {
+							glog.Errorf("sap: %+v", err)
+						}
+					}
+				}
+				t.Stop()
+				return
+
+			case <-t.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}, nil
+}
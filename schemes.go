@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/puellanivis/breton/lib/files"
+)
+
+// outputForms are the forms of output that icycat itself handles, on top of the schemes of lib/files.
+var outputForms = []struct {
+	form, desc string
+}{
+	{"-", "stdout"},
+	{"mpegts:<output>", "mux the stream into an MPEG-TS, rather than writing it out as Ogg"},
+	{"hls:<file>, <file>.m3u8", "an HLS playlist and its MPEG-TS segments"},
+	{"rtp:<host:port>, udp:<host:port>?rtp=1", "an RTP stream of MPEG-TS over UDP"},
+	{"tcp://:<port>, tcp://<host:port>?listen=1", "listen for clients, and relay the stream to them, as an ICECAST server would"},
+	{"<file with strftime %-directives>", "a rotating output, see also --rotate-size, --rotate-interval, and --split-on-title"},
+}
+
+// listSchemes writes out every URL scheme that files.Open and files.Create can handle in this build,
+// that is, the ones that lib/files and its plugins have registered, and then the forms of output that icycat adds.
+//
+// A scheme being listed only means that it is registered, not that it supports both reading and writing.
+func listSchemes(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "schemes:")
+
+	for _, scheme := range files.RegisteredSchemes() {
+		fmt.Fprintf(&b, "  %s:\n", scheme)
+	}
+
+	fmt.Fprintln(&b, "  (a path without a scheme is a local file)")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "outputs:")
+
+	for _, f := range outputForms {
+		fmt.Fprintf(&b, "  %s\n      %s\n", f.form, f.desc)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+const (
+	// selfTestDuration is how much synthetic audio --self-test muxes into each output.
+	selfTestDuration = 5 * time.Second
+
+	// silentFrameSamples is the number of samples in each MPEG-1 Layer III frame.
+	silentFrameSamples = 1152
+)
+
+// silentMP3Frame returns a 128 kbit/s, 44.1 kHz, mono MPEG-1 Layer III frame that decodes to digital silence:
+// with its side information all zero, it has no main data at all.
+func silentMP3Frame() []byte {
+	header := []byte{0xFF, 0xFB, 0x90, 0xC4}
+
+	n, _ := frameLength(header)
+
+	frame := make([]byte, n)
+	copy(frame, header)
+
+	return frame
+}
+
+// selfTest muxes a few seconds of synthetic silence through the framer, the mux, and each of the outputs,
+// just as it would a stream, and then checks that each output came out as a valid MPEG-TS.
+//
+// Every output must be a local file, so that it can be read back.
+// Without any outputs, a temporary file is used, and removed afterwards.
+func selfTest(ctx context.Context, outputs []string) error {
+	if len(outputs) < 1 {
+		f, err := os.CreateTemp("", "icycat-self-test-*.ts")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		outputs = []string{f.Name()}
+	}
+
+	var paths []string
+	for i, output := range outputs {
+		name := strings.TrimPrefix(output, "mpegts:")
+
+		if isHLSOutput(name) || isRotatingOutput(name) || isStdoutOutput(name) || isSocketOutput(name) {
+			return errors.Errorf("self-test: %s: must be a single local file", output)
+		}
+
+		path, ok := localPath(name)
+		if !ok {
+			return errors.Errorf("self-test: %s: must be a single local file", output)
+		}
+		paths = append(paths, path)
+
+		// The whole point is to exercise the mux, so the output is always muxed, even without the mpegts: prefix.
+		outputs[i] = "mpegts:" + name
+	}
+
+	out, _, err := openOutputs(ctx, outputs)
+	if err != nil {
+		return errors.Errorf("self-test: %+v", err)
+	}
+
+	frame := silentMP3Frame()
+	count := int(selfTestDuration.Seconds() * float64(mpegSampleRates[0]) / silentFrameSamples)
+
+	for i := 0; i < count; i++ {
+		if _, err := out.Write(frame); err != nil {
+			out.Close()
+			return errors.Errorf("self-test: write: %+v", err)
+		}
+	}
+
+	// Closing the outputs flushes out the whole of the mux.
+	if err := out.Close(); err != nil {
+		return errors.Errorf("self-test: close: %+v", err)
+	}
+
+	var failed int
+	for _, path := range paths {
+		if err := verifySelfTest(path); err != nil {
+			glog.Errorf("self-test: %s: %+v", path, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("self-test ok: %s\n", path)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("self-test: %d of %d outputs failed", failed, len(paths))
+	}
+
+	return nil
+}
+
+// verifySelfTest checks that the file is a whole number of MPEG-TS packets, without any defects,
+// and that it holds a PAT, a PMT, and an elementary stream.
+func verifySelfTest(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 1 {
+		return errors.New("no output")
+	}
+
+	if len(b)%ts.PacketSize != 0 {
+		return errors.Errorf("%d bytes, not a whole number of packets", len(b))
+	}
+
+	v := newTSVerifier(&discardSink{name: path})
+	v.Write(b)
+
+	if v.Found() {
+		return errors.New("defects found in the mpegts output")
+	}
+
+	if _, ok := v.cc[pidPAT]; !ok {
+		return errors.New("no PAT")
+	}
+
+	if len(v.pmts) < 1 {
+		return errors.New("no PMT")
+	}
+
+	for pid := range v.cc {
+		switch {
+		case pid == pidPAT, pid == pidSDT, pid == pidEIT, v.pmts[pid]:
+		default:
+			return nil
+		}
+	}
+
+	return errors.New("no elementary stream")
+}
+
+// discardSink is a namedWriteCloser that throws away everything written to it.
+type discardSink struct {
+	name string
+}
+
+func (w *discardSink) Name() string                      { return w.name }
+func (w *discardSink) Write(b []byte) (n int, err error) { return len(b), nil }
+func (w *discardSink) Close() error                      { return nil }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/os/process"
+)
+
+// shutdownContext returns a context.Context for a graceful shutdown, which is bounded by --shutdown-timeout, if it is set.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	if Flags.ShutdownTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), Flags.ShutdownTimeout)
+}
+
+// boundShutdown bounds the whole graceful drain that follows ctx being canceled to --shutdown-timeout.
+//
+// If the returned done has not been called by then, a stuck output is holding everything up,
+// so force is called to cancel the outputs, and the process exits with a failure status, without waiting any further.
+func boundShutdown(ctx context.Context, force func()) (done func()) {
+	if Flags.ShutdownTimeout <= 0 {
+		return func() {}
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-finished:
+			return
+		case <-ctx.Done():
+		}
+
+		timer := time.NewTimer(Flags.ShutdownTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-finished:
+			return
+		case <-timer.C:
+		}
+
+		glog.Errorf("shutdown: still draining after --shutdown-timeout %v, forcing exit", Flags.ShutdownTimeout)
+		logEvent("error", "shutdown-timeout", "timeout", Flags.ShutdownTimeout)
+
+		force()
+		process.Exit(1)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(finished) })
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// silenceDetector is an io.Writer that watches an MP3 stream for dead air,
+// and calls onSilence once the stream has been near-silent for long enough.
+//
+// It does not actually decode the audio, instead it estimates an upper bound on the level of each frame from its Layer III side information:
+// a granule without any big_values can only hold spectral values of magnitude at most one,
+// so its peak level is bounded by its global_gain, which scales by 1.5 dB per step, relative to full scale at 210.
+// A granule with no main data at all is digital silence.
+//
+// Writes never fail or block on anything other than the parsing itself.
+type silenceDetector struct {
+	mu sync.Mutex
+
+	timeout   time.Duration
+	threshold float64
+	onSilence func()
+
+	buf    []byte
+	silent time.Duration
+	fired  bool
+	warned bool
+}
+
+func newSilenceDetector(timeout time.Duration, threshold float64, onSilence func()) *silenceDetector {
+	return &silenceDetector{
+		timeout:   timeout,
+		threshold: threshold,
+		onSilence: onSilence,
+	}
+}
+
+// Fired returns true if the detector has detected silence.
+func (d *silenceDetector) Fired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.fired
+}
+
+func (d *silenceDetector) Write(b []byte) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.fired {
+		return len(b), nil
+	}
+
+	d.buf = append(d.buf, b...)
+
+	for len(d.buf) >= maxFrameHeader {
+		n, _ := frameLength(d.buf)
+		if n == 0 {
+			// resync
+			d.buf = d.buf[1:]
+			continue
+		}
+
+		if n > len(d.buf) {
+			break
+		}
+
+		d.frame(d.buf[:n])
+		d.buf = d.buf[n:]
+
+		if d.fired {
+			d.buf = nil
+			break
+		}
+	}
+
+	// Do not let junk grow the buffer without bound.
+	if len(d.buf) > maxResync {
+		d.buf = nil
+	}
+
+	return len(b), nil
+}
+
+// frame accounts for a single whole frame.
+//
+// Caller MUST hold the lock.
+func (d *silenceDetector) frame(b []byte) {
+	level, dur, ok := frameLevel(b)
+	if !ok {
+		if !d.warned {
+			d.warned = true
+			glog.Warning("silence detector: only MPEG Layer III streams are supported")
+		}
+		return
+	}
+
+	if level > d.threshold {
+		d.silent = 0
+		return
+	}
+
+	d.silent += dur
+	if d.silent < d.timeout {
+		return
+	}
+
+	d.fired = true
+
+	glog.Warningf("silence detector: no audio above %.1f dBFS for %v", d.threshold, d.silent)
+
+	if d.onSilence != nil {
+		d.onSilence()
+	}
+}
+
+// frameLevel returns an estimated upper bound on the peak level in dBFS of the given MPEG Layer III frame, and its duration.
+//
+// It returns false if the frame is not a Layer III frame.
+func frameLevel(b []byte) (level float64, dur time.Duration, ok bool) {
+	if b[0] != 0xFF {
+		// LOAS
+		return 0, 0, false
+	}
+
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+	if layer != 1 {
+		// ADTS, or not Layer III
+		return 0, 0, false
+	}
+
+	mpeg1 := version == 3
+	mono := b[3]>>6 == 3
+
+	sr := mpegSampleRates[(b[2]>>2)&0x03]
+	samples := 1152
+	if !mpeg1 {
+		samples = 576
+
+		sr /= 2
+		if version == 0 {
+			sr /= 2
+		}
+	}
+	dur = time.Duration(samples) * time.Second / time.Duration(sr)
+
+	off := 4
+	if b[1]&0x01 == 0 {
+		off += 2 // CRC
+	}
+
+	channels := 2
+	if mono {
+		channels = 1
+	}
+
+	// The number of bits before the first granule, and the number of bits of side information per granule per channel.
+	var skip, granules, stride int
+	switch {
+	case mpeg1 && mono:
+		skip, granules, stride = 9+5+4, 2, 59
+	case mpeg1:
+		skip, granules, stride = 9+3+8, 2, 59
+	case mono:
+		skip, granules, stride = 8+1, 1, 63
+	default:
+		skip, granules, stride = 8+2, 1, 63
+	}
+
+	r := bitReader{b: b[off:], pos: skip}
+
+	level = -1000 // effectively -∞ for digital silence.
+
+	for gr := 0; gr < granules; gr++ {
+		for ch := 0; ch < channels; ch++ {
+			start := r.pos
+
+			part23 := r.bits(12)
+			bigValues := r.bits(9)
+			globalGain := r.bits(8)
+
+			if r.short {
+				return 0, dur, true
+			}
+
+			switch {
+			case part23 == 0:
+			case bigValues > 0:
+				return 0, dur, true
+			default:
+				if l := 1.5 * float64(int(globalGain)-210); l > level {
+					level = l
+				}
+			}
+
+			r.pos = start + stride
+		}
+	}
+
+	return level, dur, true
+}
+
+// bitReader reads big-endian bit fields from a byte slice.
+type bitReader struct {
+	b     []byte
+	pos   int
+	short bool
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+
+	for i := 0; i < n; i++ {
+		byt := (r.pos + i) / 8
+		if byt >= len(r.b) {
+			r.short = true
+			return 0
+		}
+
+		v = v<<1 | uint32(r.b[byt]>>(7-uint((r.pos+i)%8)))&1
+	}
+
+	r.pos += n
+
+	return v
+}
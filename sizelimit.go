@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// sizeLimitWriter stops the recording once --max-filesize of the stream has been written to the outputs.
+//
+// Nothing past the limit is written, and stop is called, which shuts down just as on a SIGTERM:
+// the reader is stopped, and closing the outputs then flushes the mux, so that an MPEG-TS still ends on a whole packet.
+type sizeLimitWriter struct {
+	io.WriteCloser
+
+	stop func()
+
+	mu      sync.Mutex
+	limit   int64
+	written int64
+	done    bool
+}
+
+func newSizeLimitWriter(w io.WriteCloser, stop func()) *sizeLimitWriter {
+	return &sizeLimitWriter{
+		WriteCloser: w,
+		stop:        stop,
+	}
+}
+
+func (w *sizeLimitWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		// Whatever is still buffered after we have called stop is discarded.
+		return len(b), nil
+	}
+
+	if w.limit <= 0 {
+		// The stream has connected by the time that anything is written, so its icy-br is known.
+		// The limit is then fixed, so that a failover to a lower bitrate cannot pull it back below what has already been written.
+		w.limit = int64(Flags.MaxFilesize.Bytes(streamBitrate()))
+	}
+
+	if remaining := w.limit - w.written; int64(len(b)) >= remaining {
+		if remaining > 0 {
+			n, err = w.WriteCloser.Write(b[:remaining])
+			w.written += int64(n)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		glog.Infof("reached --max-filesize of %d bytes, stopping", w.limit)
+		w.done = true
+		w.stop()
+
+		return len(b), nil
+	}
+
+	n, err = w.WriteCloser.Write(b)
+	w.written += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// source is one stream URL that ICECASTReader may read from,
+// with its credentials held separately, so that they are never logged.
+type source struct {
+	filename string
+	user     *url.Userinfo
+
+	// name and header are set for a source from the --url-file, whose URL is never logged at all.
+	name   string
+	header http.Header
+
+	// resolved is set once we know that the source is not a playlist.
+	resolved bool
+
+	// playlist is the playlist source that this source is an entry of, if it is one.
+	// Every entry of the same playlist shares the same pointer.
+	playlist *source
+
+	// errs is shared by every copy of the source, so that its repeated connect errors are coalesced, even when failing over.
+	errs *dedupLogger
+}
+
+func newSource(filename string) source {
+	entry := lookupURLFile(filename)
+
+	filename, user := streamCredentials(filename)
+
+	src := source{
+		filename: filename,
+		user:     user,
+		errs:     new(dedupLogger),
+	}
+
+	if entry != nil {
+		src.name = entry.name
+		src.header = entry.header
+	}
+
+	return src
+}
+
+// Name returns the name to log the source by, which is its URL, unless it came from the --url-file.
+func (src source) Name() string {
+	if src.name != "" {
+		return src.name
+	}
+
+	return src.filename
+}
+
+// secrets returns the forms of the URL of the source that must be masked, longest first.
+func (src source) secrets() []string {
+	secrets := []string{src.filename}
+
+	if uri, err := url.Parse(src.filename); err == nil && uri.RawQuery != "" {
+		secrets = append(secrets, "?"+uri.RawQuery)
+	}
+
+	return secrets
+}
+
+// sourceSet is the list of stream URLs that ICECASTReader fails over between.
+//
+// The first source is the primary, and all the others are backups, in order of preference.
+// Any source may be a PLS or M3U playlist, in which case it is replaced by the entries of that playlist,
+// until every one of those entries has failed, and then it is put back, so that it is fetched again.
+type sourceSet struct {
+	mu sync.Mutex
+
+	srcs     []source
+	cur      int
+	failures int
+
+	// switched is set when we have just switched back to the primary, and should reconnect immediately.
+	switched bool
+
+	// state records each failure and success to the --state-file, if it is set.
+	state *reconnectState
+}
+
+func newSourceSet(filenames []string) *sourceSet {
+	s := new(sourceSet)
+
+	for _, filename := range filenames {
+		s.srcs = append(s.srcs, newSource(filename))
+	}
+
+	return s
+}
+
+// Current returns the index, and source currently in use.
+func (s *sourceSet) Current() (int, source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cur, s.srcs[s.cur]
+}
+
+// Primary returns the first source.
+func (s *sourceSet) Primary() source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.srcs[0]
+}
+
+// failed records a failure of the current source,
+// and fails over to the next source after --failover-threshold consecutive failures, or immediately if now is true.
+//
+// Caller MUST hold the lock.
+func (s *sourceSet) failed(now bool) {
+	s.state.failed(s.srcs[s.cur].Name())
+
+	s.failures++
+
+	if !now && s.failures < Flags.FailoverThreshold {
+		return
+	}
+
+	s.failures = 0
+
+	s.unresolvePlaylist()
+
+	if len(s.srcs) > 1 {
+		s.cur = (s.cur + 1) % len(s.srcs)
+		glog.Warningf("failing over to: %s", s.srcs[s.cur].Name())
+	}
+}
+
+// unresolvePlaylist puts the playlist back in place of its entries, if the current source is the last of them,
+// since a station may well have moved its relays elsewhere, and only a fresh copy of its playlist will tell us where.
+//
+// Caller MUST hold the lock.
+func (s *sourceSet) unresolvePlaylist() {
+	pl := s.srcs[s.cur].playlist
+	if pl == nil {
+		return
+	}
+
+	if next := s.cur + 1; next < len(s.srcs) && s.srcs[next].playlist == pl {
+		return
+	}
+
+	start := s.cur
+	for start > 0 && s.srcs[start-1].playlist == pl {
+		start--
+	}
+
+	s.srcs = append(s.srcs[:start], append([]source{*pl}, s.srcs[s.cur+1:]...)...)
+	s.cur = start
+
+	if glog.V(1) {
+		glog.Infof("playlist: %s: every entry has failed, it will be fetched again", pl.Name())
+	}
+}
+
+// Failed records a failed copy from the current source, which did not receive any data.
+func (s *sourceSet) Failed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed(false)
+}
+
+// Succeeded records a successful copy from the current source.
+func (s *sourceSet) Succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = 0
+	s.state.succeeded(s.srcs[s.cur].Name())
+}
+
+// Restore records failures and successes to the given state, and continues with the source that the last run was using, if it is one of ours.
+func (s *sourceSet) Restore(state *reconnectState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+
+	current, _, _ := state.resume()
+	if current == "" {
+		return
+	}
+
+	for i, src := range s.srcs {
+		if src.Name() == current {
+			if i != s.cur && glog.V(1) {
+				glog.Infof("--state-file: continuing with: %s", current)
+			}
+
+			s.cur = i
+			return
+		}
+	}
+}
+
+// Open opens the current source.
+//
+// If all is true, then each source is tried once in turn, until one works.
+// Otherwise, only the current source is tried, and failures are counted towards failing over.
+func (s *sourceSet) Open(ctx context.Context, all bool) (files.Reader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tries := 1
+	if all {
+		tries = len(s.srcs)
+	}
+
+	var err error
+
+	for i := 0; i < tries; i++ {
+		src := s.srcs[s.cur]
+
+		// Opening the source can take a while, so do not hold the lock while doing so.
+		s.mu.Unlock()
+		var f files.Reader
+		f, err = openSource(ctx, src)
+		s.mu.Lock()
+
+		if err != nil {
+			class := countError(err)
+			src.errs.Errorf("%s: [%s] %+v", src.Name(), class, err)
+			logEvent("error", "connect", "stream", src.Name(), "class", class, "error", err)
+			s.failed(all)
+			continue
+		}
+
+		src.errs.Reset()
+
+		if src.resolved || !isPlaylist(f) {
+			s.srcs[s.cur].resolved = true
+			logEvent("info", "connect", "stream", src.Name(), "url", resolvedName(f))
+			return f, nil
+		}
+
+		entries, err2 := readPlaylist(f)
+		if err2 != nil {
+			err = err2
+			glog.Errorf("%+v", err)
+			s.failed(all)
+			continue
+		}
+
+		glog.Infof("playlist: %s: %d entries", src.Name(), len(entries))
+
+		// We do not follow playlists of playlists.
+		playlist := &src
+
+		var srcs []source
+		for i, entry := range entries {
+			parent := src
+
+			src := newSource(entry)
+			src.resolved = true
+			src.playlist = playlist
+
+			if parent.name != "" {
+				// The entries of a playlist from the --url-file may hold secrets just as well.
+				src.name = fmt.Sprintf("%s (entry %d)", parent.name, i+1)
+				src.header = parent.header
+			}
+
+			srcs = append(srcs, src)
+		}
+
+		s.srcs = append(s.srcs[:s.cur], append(srcs, s.srcs[s.cur+1:]...)...)
+
+		// Retry at the same index, which is now the first entry of the playlist.
+		i--
+		if all {
+			tries += len(srcs) - 1
+		}
+	}
+
+	return nil, err
+}
+
+// TakeSwitched returns true if we have just switched back to the primary, and clears the flag.
+func (s *sourceSet) TakeSwitched() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switched := s.switched
+	s.switched = false
+
+	return switched
+}
+
+// ProbePrimary checks every --failover-probe whether the primary source has recovered, if we are not already using it.
+// Once it has recovered, we switch over to it, and call abort in order to end the copy from the current backup.
+//
+// The probing stops when the returned function is called.
+func (s *sourceSet) ProbePrimary(ctx context.Context, abort func()) (stop func()) {
+	if cur, _ := s.Current(); cur == 0 || Flags.FailoverProbe <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(Flags.FailoverProbe)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			primary := s.Primary()
+
+			f, err := openSource(ctx, primary)
+			if err != nil {
+				if glog.V(2) {
+					glog.Infof("primary still down: %s: %+v", primary.Name(), err)
+				}
+				continue
+			}
+			f.Close()
+
+			select {
+			case <-ctx.Done():
+				// We were stopped while connecting, so the copy is already over.
+				return
+			default:
+			}
+
+			glog.Infof("primary has recovered: %s", primary.Name())
+
+			s.mu.Lock()
+			s.cur = 0
+			s.failures = 0
+			s.switched = true
+			s.mu.Unlock()
+
+			abort()
+			return
+		}
+	}()
+
+	return cancel
+}
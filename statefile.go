@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// sourceState is the JSON structure of the state of each source in the --state-file.
+type sourceState struct {
+	Attempts    int        `json:"attempts"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+// reconnectState is the reconnect backoff and failover state of the primary stream, which is kept in the --state-file,
+// so that a supervisor restarting us against a flaky source does not defeat the backoff.
+//
+// Sources are keyed by their URL, without any credentials, so a state file from a run with different streams is simply ignored.
+type reconnectState struct {
+	mu       sync.Mutex
+	filename string
+
+	Current string                  `json:"current,omitempty"`
+	Backoff time.Duration           `json:"backoff,omitempty"`
+	RetryAt *time.Time              `json:"retry_at,omitempty"`
+	Sources map[string]*sourceState `json:"sources"`
+}
+
+// loadReconnectState reads the --state-file, if it exists.
+// A state file that cannot be read is only warned about, since it only makes us reconnect sooner than we might have.
+func loadReconnectState(filename string) *reconnectState {
+	s := &reconnectState{
+		filename: filename,
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("--state-file: %s: %+v: starting over", filename, err)
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(b, s); err != nil {
+			glog.Warningf("--state-file: %s: %+v: starting over", filename, errors.Wrap(err, "state json"))
+			*s = reconnectState{filename: filename}
+		}
+	}
+
+	if s.Sources == nil {
+		s.Sources = make(map[string]*sourceState)
+	}
+
+	return s
+}
+
+// source returns the state of the given source, adding it if it is not yet known.
+//
+// Caller MUST hold the lock.
+func (s *reconnectState) source(filename string) *sourceState {
+	src := s.Sources[filename]
+	if src == nil {
+		src = new(sourceState)
+		s.Sources[filename] = src
+	}
+
+	return src
+}
+
+// save atomically replaces the --state-file with the current state.
+//
+// Caller MUST hold the lock.
+func (s *reconnectState) save() {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		glog.Errorf("--state-file: %+v", err)
+		return
+	}
+
+	b = append(b, '\n')
+
+	if err := writeFileAtomic(s.filename, b); err != nil {
+		glog.Errorf("--state-file: %s: %+v", s.filename, err)
+	}
+}
+
+// resume returns which source the last run was using, and if it ended in a backoff, the delay it was at, and when it was due to reconnect.
+func (s *reconnectState) resume() (current string, backoff time.Duration, retryAt time.Time) {
+	if s == nil {
+		return "", 0, time.Time{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.RetryAt == nil {
+		return s.Current, s.Backoff, time.Time{}
+	}
+
+	return s.Current, s.Backoff, *s.RetryAt
+}
+
+// succeeded records that data was received from the given source, which clears any backoff.
+func (s *reconnectState) succeeded(filename string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src := s.source(filename)
+	now := time.Now()
+
+	src.Attempts = 0
+	src.LastSuccess = &now
+
+	s.Current = filename
+	s.Backoff = 0
+	s.RetryAt = nil
+
+	s.save()
+}
+
+// failed records a failed attempt on the given source.
+func (s *reconnectState) failed(filename string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	src := s.source(filename)
+	src.Attempts++
+	src.LastFailure = &now
+
+	s.save()
+}
+
+// backingOff records that we are going to reconnect to the given source at retryAt, with the backoff now at the given delay.
+func (s *reconnectState) backingOff(filename string, backoff time.Duration, retryAt time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Current = filename
+	s.Backoff = backoff
+	s.RetryAt = &retryAt
+
+	s.save()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// maxStatusSize limits how much of a --status-url response we will read, after decompression.
+const maxStatusSize = 1 << 20
+
+// pollStatus fetches the now-playing title from the given status URL every --status-interval,
+// and records it as the StreamTitle, just as if it had been received as inline ICY metadata.
+//
+// It returns once ctx is canceled.
+func pollStatus(ctx context.Context, statusURL string) {
+	t, err := getBaseTransport()
+	if err != nil {
+		glog.Errorf("status: %+v", err)
+		return
+	}
+
+	cl := &http.Client{
+		Transport: t,
+		Timeout:   Flags.Timeout,
+	}
+
+	ticker := time.NewTicker(Flags.StatusInterval)
+	defer ticker.Stop()
+
+	for {
+		title, err := fetchStatus(ctx, cl, statusURL)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			glog.Warningf("status: %s: %+v", statusURL, err)
+		default:
+			setStreamTitle(title)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchStatus makes a single request to the status URL, and returns the title from it.
+func fetchStatus(ctx context.Context, cl *http.Client, statusURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", Flags.UserAgent)
+	// Setting this ourselves turns off the transparent gzip of net/http, so we must also decompress it ourselves.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	r, err := decodeBody(resp)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r, maxStatusSize))
+	if err != nil {
+		return "", err
+	}
+
+	return parseStatus(resp.Header.Get("Content-Type"), b)
+}
+
+// decodeBody returns a reader of the body of the response, decompressed according to its Content-Encoding.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return resp.Body, nil
+
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+
+	case "deflate":
+		// The HTTP deflate encoding is supposed to be zlib, but a lot of servers send raw deflate instead.
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if r, err := zlib.NewReader(bytes.NewReader(b)); err == nil {
+			return r, nil
+		}
+
+		return flate.NewReader(bytes.NewReader(b)), nil
+
+	default:
+		return nil, errors.Errorf("unsupported Content-Encoding: %q", enc)
+	}
+}
+
+// parseStatus returns the now-playing title from a status response.
+//
+// A text/plain response is taken as the title itself.
+// Otherwise, it should be JSON, such as from the status-json.xsl of ICECAST, or the /stats?json=1 of SHOUTcast.
+func parseStatus(contentType string, b []byte) (string, error) {
+	if typ, _, _ := mime.ParseMediaType(contentType); typ == "text/plain" {
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", errors.Wrap(err, "status json")
+	}
+
+	title, ok := findTitle(v)
+	if !ok {
+		return "", errors.New("no title found in status json")
+	}
+
+	return title, nil
+}
+
+// titleKeys are the keys that are taken to be the now-playing title in a status json, in order of preference.
+var titleKeys = []string{
+	"streamtitle",
+	"songtitle",
+	"now_playing",
+	"nowplaying",
+	"title",
+}
+
+// findTitle searches depth first through the decoded JSON value for the first object with a title.
+//
+// If the object has both an artist and a title, then they are joined as "artist - title",
+// since that is how StreamTitle is conventionally formatted.
+func findTitle(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			if title, ok := findTitle(elem); ok {
+				return title, true
+			}
+		}
+
+	case map[string]interface{}:
+		fields := make(map[string]interface{})
+		for key, val := range v {
+			fields[strings.ToLower(key)] = val
+		}
+
+		for _, key := range titleKeys {
+			title, ok := fields[key].(string)
+			if !ok {
+				// Some APIs nest the title in an object, as in: "now_playing": {"artist": ..., "title": ...}
+				if title, ok := findTitle(fields[key]); ok {
+					return title, true
+				}
+				continue
+			}
+
+			if artist, _ := fields["artist"].(string); artist != "" && key == "title" {
+				return artist + " - " + title, true
+			}
+
+			return title, true
+		}
+
+		// Go through the rest in a fixed order, so that we pick the same one every time.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if title, ok := findTitle(v[key]); ok {
+				return title, true
+			}
+		}
+	}
+
+	return "", false
+}
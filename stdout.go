@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isStdoutOutput returns true if the given output, or its mpegts: sink, is stdout.
+func isStdoutOutput(filename string) bool {
+	switch strings.TrimPrefix(filename, "mpegts:") {
+	case "", "-", "/dev/stdout":
+		return true
+	}
+
+	return false
+}
+
+// validateStdout checks that at most one thing is going to write to stdout,
+// since anything else written to it would corrupt the stream for whatever it is piped into.
+//
+// All of our logging goes to stderr, or to the log files, and never to stdout.
+func validateStdout(outputs []string) error {
+	if len(outputs) < 1 {
+		outputs = []string{""}
+	}
+
+	var prev string
+	for _, output := range outputs {
+		if !isStdoutOutput(output) {
+			continue
+		}
+
+		if prev != "" {
+			return errors.Errorf("cannot write both %q and %q to stdout", prev, output)
+		}
+
+		prev = output
+		if prev == "" {
+			prev = "-"
+		}
+	}
+
+	if prev != "" && Flags.HeadersJSON == "-" {
+		return errors.Errorf("cannot write both %q and --headers-json to stdout", prev)
+	}
+
+	return nil
+}
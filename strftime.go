@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// strftime formats t according to a strftime(3)-style template.
+//
+// Only the common conversions are supported, any other conversion is left in place as is.
+func strftime(template string, t time.Time) string {
+	if !strings.Contains(template, "%") {
+		return template
+	}
+
+	b := new(strings.Builder)
+
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' || i+1 >= len(template) {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+
+		switch template[i] {
+		case 'Y':
+			fmt.Fprintf(b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(b, "%03d", t.YearDay())
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 's':
+			fmt.Fprintf(b, "%d", t.Unix())
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(template[i])
+		}
+	}
+
+	return b.String()
+}
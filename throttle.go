@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// throttleTicks is how many separate writes per second the throttleWriter breaks its writes into.
+	throttleTicks = 50
+
+	// maxThrottleLag is how far behind schedule the throttleWriter may fall, before it gives up on catching up.
+	// Otherwise, after a stall, we would burst out everything that we missed.
+	maxThrottleLag = 1 * time.Second
+)
+
+// throttleWriter is an io.WriteCloser that paces its writes to a constant bitrate.
+//
+// If its rate is zero, then the rate is taken from the icy-br of the stream at the time of the first write.
+//
+// Once its context is done, it stops pacing, so that whatever is left can be flushed out quickly on shutdown.
+type throttleWriter struct {
+	io.WriteCloser
+
+	ctx context.Context
+
+	mu sync.Mutex
+
+	bps   float64
+	chunk int
+
+	start time.Time
+	sent  int64
+}
+
+func newThrottleWriter(ctx context.Context, w io.WriteCloser, bps float64) *throttleWriter {
+	return &throttleWriter{
+		WriteCloser: w,
+		ctx:         ctx,
+		bps:         bps,
+	}
+}
+
+// setup decides the rate to throttle at.
+//
+// Caller MUST hold the lock.
+func (w *throttleWriter) setup() {
+	if w.bps <= 0 {
+		w.bps = streamBitrate()
+	}
+
+	if w.bps <= 0 {
+		glog.Warningf("throttle: stream does not advertise its bitrate, and no --rate given, using %d bps", defaultBitrate)
+		w.bps = defaultBitrate
+	}
+
+	glog.Infof("throttle: %.0f bps", w.bps)
+
+	w.chunk = int(w.bps / 8 / throttleTicks)
+	if w.chunk < 1 {
+		w.chunk = 1
+	}
+}
+
+// due returns the time at which everything sent so far should have been sent.
+//
+// Caller MUST hold the lock.
+func (w *throttleWriter) due() time.Time {
+	return w.start.Add(time.Duration(float64(w.sent) * 8 / w.bps * float64(time.Second)))
+}
+
+func (w *throttleWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.chunk == 0 {
+		w.setup()
+	}
+
+	for len(b) > 0 {
+		now := time.Now()
+
+		if w.start.IsZero() || now.Sub(w.due()) > maxThrottleLag {
+			w.start, w.sent = now, 0
+		}
+
+		if d := w.due().Sub(now); d > 0 {
+			t := time.NewTimer(d)
+
+			select {
+			case <-t.C:
+			case <-w.ctx.Done():
+				t.Stop()
+			}
+		}
+
+		l := len(b)
+		if l > w.chunk {
+			l = w.chunk
+		}
+
+		m, err := w.WriteCloser.Write(b[:l])
+		n += m
+		w.sent += int64(m)
+
+		if err != nil {
+			return n, err
+		}
+
+		b = b[l:]
+	}
+
+	return n, nil
+}
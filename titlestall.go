@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+const (
+	// titleStallSample is how long each sample of the bitrate covers.
+	titleStallSample = 1 * time.Second
+
+	// titleStallSamples is how many of the most recent samples the bitrate is judged on.
+	titleStallSamples = 60
+
+	// titleStallMinSamples is how many samples we need, before we judge the bitrate at all.
+	titleStallMinSamples = 10
+)
+
+// titleStallDetector is an io.Writer that watches for a server that is stuck looping the same content,
+// and calls onStall once the StreamTitle has not changed for --title-stall-timeout,
+// while the bitrate also looks suspicious: either below --title-stall-bitrate of the icy-br,
+// or so constant that its coefficient of variation is below --title-stall-variation.
+//
+// This is a softer signal than the silence detector, since a long track can also hold the same title for a long while,
+// so the title alone is never enough to reconnect.
+//
+// Writes never fail or block.
+type titleStallDetector struct {
+	mu sync.Mutex
+
+	start   time.Time
+	onStall func()
+
+	bucket      int
+	bucketStart time.Time
+	samples     []float64
+
+	fired bool
+}
+
+func newTitleStallDetector(onStall func()) *titleStallDetector {
+	now := time.Now()
+
+	return &titleStallDetector{
+		start:       now,
+		bucketStart: now,
+		onStall:     onStall,
+	}
+}
+
+// Fired returns true if the detector has detected a stalled title.
+func (d *titleStallDetector) Fired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.fired
+}
+
+func (d *titleStallDetector) Write(b []byte) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.fired {
+		return len(b), nil
+	}
+
+	d.bucket += len(b)
+
+	now := time.Now()
+
+	elapsed := now.Sub(d.bucketStart)
+	if elapsed < titleStallSample {
+		return len(b), nil
+	}
+
+	d.samples = append(d.samples, float64(d.bucket*8)/elapsed.Seconds())
+	if len(d.samples) > titleStallSamples {
+		d.samples = d.samples[len(d.samples)-titleStallSamples:]
+	}
+
+	d.bucket = 0
+	d.bucketStart = now
+
+	d.check(now)
+
+	return len(b), nil
+}
+
+// check decides if the title has stalled, and if so, calls onStall.
+//
+// Caller MUST hold the lock.
+func (d *titleStallDetector) check(now time.Time) {
+	changed, ok := titleChangedAt()
+	if !ok {
+		// Without any metadata, there is no title to stall.
+		return
+	}
+
+	if changed.Before(d.start) {
+		// A title that was already stale when we connected only counts from when we connected.
+		changed = d.start
+	}
+
+	stalled := now.Sub(changed)
+	if stalled < Flags.TitleStallTimeout || len(d.samples) < titleStallMinSamples {
+		return
+	}
+
+	mean, cv := meanAndVariation(d.samples)
+
+	var reason string
+
+	switch expected := streamBitrate(); {
+	case expected > 0 && mean < Flags.TitleStallBitrate*expected:
+		reason = "low"
+	case cv < Flags.TitleStallVariation:
+		reason = "constant"
+	default:
+		return
+	}
+
+	d.fired = true
+
+	glog.Warningf("title stall: StreamTitle %q unchanged for %v, with a %s bitrate of %.0f bps (variation %.4f)", StreamTitle(), stalled.Truncate(time.Second), reason, mean, cv)
+	logEvent("warning", "title-stall", "title", StreamTitle(), "duration", stalled, "reason", reason, "bitrate", mean, "variation", cv)
+
+	if d.onStall != nil {
+		d.onStall()
+	}
+}
+
+// meanAndVariation returns the mean of the samples, and their coefficient of variation, the standard deviation over the mean.
+func meanAndVariation(samples []float64) (mean, cv float64) {
+	for _, s := range samples {
+		mean += s
+	}
+	mean /= float64(len(samples))
+
+	if mean == 0 {
+		return 0, 0
+	}
+
+	var variance float64
+	for _, s := range samples {
+		variance += (s - mean) * (s - mean)
+	}
+	variance /= float64(len(samples))
+
+	return mean, math.Sqrt(variance) / mean
+}
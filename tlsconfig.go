@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// newTLSConfig returns the tls.Config to use for connecting to https streams, as configured from the Flags.
+//
+// It returns nil if none of the TLS flags are set, in order to use the default configuration.
+func newTLSConfig() (*tls.Config, error) {
+	if !Flags.TLSInsecure && Flags.TLSCA == "" && Flags.TLSCert == "" && Flags.TLSKey == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: Flags.TLSInsecure,
+	}
+
+	if Flags.TLSCA != "" {
+		pem, err := os.ReadFile(Flags.TLSCA)
+		if err != nil {
+			return nil, errors.Errorf("bad --tls-ca: %+v", err)
+		}
+
+		// The given CAs are trusted in addition to the system trust store, not instead of it.
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("bad --tls-ca: %s: no PEM certificates found", Flags.TLSCA)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if Flags.TLSCert != "" || Flags.TLSKey != "" {
+		if Flags.TLSCert == "" || Flags.TLSKey == "" {
+			return nil, errors.New("--tls-cert and --tls-key must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(Flags.TLSCert, Flags.TLSKey)
+		if err != nil {
+			return nil, errors.Errorf("bad --tls-cert or --tls-key: %+v", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// newMetricsTLSConfig returns the tls.Config to serve metrics over https with, as configured from the Flags.
+//
+// It returns nil if the metrics TLS flags are not set, in order to serve metrics over plain http.
+func newMetricsTLSConfig() (*tls.Config, error) {
+	if Flags.MetricsTLSCert == "" && Flags.MetricsTLSKey == "" {
+		return nil, nil
+	}
+
+	if Flags.MetricsTLSCert == "" || Flags.MetricsTLSKey == "" {
+		return nil, errors.New("--metrics-tls-cert and --metrics-tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(Flags.MetricsTLSCert, Flags.MetricsTLSKey)
+	if err != nil {
+		return nil, errors.Errorf("bad --metrics-tls-cert or --metrics-tls-key: %+v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files/httpfiles"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+var baseTransport struct {
+	sync.Once
+	t   *http.Transport
+	err error
+}
+
+// getBaseTransport returns the http.Transport shared by all stream connections, configured from the Flags.
+func getBaseTransport() (*http.Transport, error) {
+	baseTransport.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+
+		// The default transport already uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment.
+		if Flags.Proxy != "" {
+			proxy, err := url.Parse(Flags.Proxy)
+			if err != nil {
+				baseTransport.err = errors.Errorf("bad --proxy value: %s: %+v", Flags.Proxy, err)
+				return
+			}
+
+			switch proxy.Scheme {
+			case "http", "https", "socks5":
+			default:
+				baseTransport.err = errors.Errorf("unsupported --proxy scheme: %q", proxy.Scheme)
+				return
+			}
+
+			t.Proxy = http.ProxyURL(proxy)
+		}
+
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			baseTransport.err = err
+			return
+		}
+
+		if tlsConfig != nil {
+			t.TLSClientConfig = tlsConfig
+		}
+
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: Flags.TCPKeepalive,
+		}
+
+		if Flags.TCPKeepalive <= 0 {
+			// A zero KeepAlive would leave it to the default of net.Dialer, rather than turning it off.
+			dialer.KeepAlive = -1
+		}
+
+		if Flags.SourceAddress != "" {
+			ip := net.ParseIP(Flags.SourceAddress)
+			if ip == nil {
+				baseTransport.err = errors.Errorf("bad --source-address value: %s: not an IP address", Flags.SourceAddress)
+				return
+			}
+
+			// Every connection is dialed through this, so it applies to each reconnect, and each redirect.
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if Flags.AllowICYProtocol {
+				conn = &icyConn{
+					Conn: conn,
+				}
+			}
+
+			return conn, nil
+		}
+
+		baseTransport.t = t
+	})
+
+	return baseTransport.t, baseTransport.err
+}
+
+// streamTransport is an http.RoundTripper that applies our per-stream settings to every request made to the upstream server.
+type streamTransport struct {
+	base http.RoundTripper
+
+	// host is the only host that credentials will be sent to, so they do not leak through a redirect.
+	host string
+	user *url.Userinfo
+
+	// header is sent only to host as well, since it came from the --url-file along with the URL.
+	header http.Header
+}
+
+func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given.
+	req = req.Clone(req.Context())
+
+	if Flags.RequestMetadata {
+		// Without this, ICECAST servers do not send the icy-metaint header, or any inline metadata.
+		req.Header.Set("Icy-MetaData", "1")
+	}
+
+	if Flags.Referer != "" {
+		req.Header.Set("Referer", Flags.Referer)
+	}
+
+	if accept := acceptHeader(); accept != "" {
+		// This only asks for a variant, the server is free to send whatever it has.
+		req.Header.Set("Accept", accept)
+	}
+
+	setHeaders(req, inputHeaders, t.host, false)
+	setHeaders(req, t.header, t.host, true)
+
+	if t.user != nil && req.URL.Host == t.host {
+		password, _ := t.user.Password()
+		req.SetBasicAuth(t.user.Username(), password)
+	}
+
+	offset, _ := req.Context().Value(rangeOffsetKey{}).(int64)
+	if offset > 0 {
+		req.Header.Set("Range", rangeValue(offset))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRetryAfter(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, &httpStatusError{
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
+	}
+
+	partial := offset > 0 && isPartialContent(resp)
+	if partial {
+		// httpfiles only accepts a 200 OK, and ICECASTReader checks the Content-Range itself.
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+	}
+
+	// A server may well answer our Range with a 206, without having sent an Accept-Ranges, and it might be a live stream.
+	if partial || isResumable(resp.Header) {
+		// Otherwise, httpfiles reads the whole of the body before returning any of it,
+		// and a disconnect partway through would lose everything, with nothing to resume from.
+		resp.ContentLength = -1
+	}
+
+	return resp, nil
+}
+
+type rangeOffsetKey struct{}
+
+// withRangeOffset returns a context.Context that requests the stream starting from the given byte offset.
+func withRangeOffset(ctx context.Context, offset int64) context.Context {
+	return context.WithValue(ctx, rangeOffsetKey{}, offset)
+}
+
+// withStreamClient returns a context.Context that will use a new http.Client for the stream,
+// so that it is reapplied on every reconnect.
+func withStreamClient(ctx context.Context, src source) (context.Context, error) {
+	base, err := getBaseTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &streamTransport{
+		base:   base,
+		user:   src.user,
+		header: src.header,
+	}
+
+	if uri, err := url.Parse(src.filename); err == nil {
+		t.host = uri.Host
+	}
+
+	return httpfiles.WithClient(ctx, &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkRedirect(req, via, src.name)
+		},
+	}), nil
+}
+
+// checkRedirect enforces --max-redirects and --same-host-redirects, and logs each redirect hop.
+//
+// If masked is set, then the stream came from the --url-file, and only the hosts of the redirect are logged.
+func checkRedirect(req *http.Request, via []*http.Request, masked string) error {
+	if len(via) > Flags.MaxRedirects {
+		return errors.Errorf("stopped after %d redirects", Flags.MaxRedirects)
+	}
+
+	prev := via[len(via)-1]
+
+	from, to := prev.URL.Redacted(), req.URL.Redacted()
+	if masked != "" {
+		from, to = masked, req.URL.Scheme+"://"+req.URL.Hostname()+"/[masked]"
+	}
+
+	if Flags.SameHostRedirects && req.URL.Host != via[0].URL.Host {
+		return errors.Errorf("refusing redirect to a different host: %s", to)
+	}
+
+	if glog.V(1) {
+		glog.Infof("redirect: %s -> %s", from, to)
+	}
+
+	return nil
+}
+
+// streamCredentials splits any userinfo out of the filename, so that the password does not get logged,
+// and returns the credentials to use for the stream.
+//
+// The --username and --password flags take precedence over credentials given in the URL.
+func streamCredentials(filename string) (string, *url.Userinfo) {
+	var user *url.Userinfo
+
+	uri, err := url.Parse(filename)
+	if err == nil && (uri.Scheme == "http" || uri.Scheme == "https") && uri.User != nil {
+		user = uri.User
+
+		uri.User = nil
+		filename = uri.String()
+	}
+
+	username, password := Flags.Username, Flags.Password
+
+	if user != nil {
+		if username == "" {
+			username = user.Username()
+		}
+
+		if password == "" {
+			password, _ = user.Password()
+		}
+	}
+
+	if username == "" && password == "" {
+		return filename, nil
+	}
+
+	return filename, url.UserPassword(username, password)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+// tsWrap is where the 33-bit PCR base, PTS, and DTS of the 90 kHz clock wrap around.
+const tsWrap = 1 << 33
+
+// tsOffset is a flag value for --timestamp-offset, given either as a plain number of 90 kHz ticks,
+// or as a duration, e.g. 40ms, or -1.5s. Either may be negative.
+type tsOffset struct {
+	ticks int64
+	d     time.Duration
+}
+
+func (o *tsOffset) String() string {
+	if o.d != 0 {
+		return o.d.String()
+	}
+
+	return strconv.FormatInt(o.ticks, 10)
+}
+
+// Get implements flag.Getter.
+func (o *tsOffset) Get() interface{} {
+	return *o
+}
+
+// Set implements flag.Value.
+func (o *tsOffset) Set(val string) error {
+	val = strings.TrimSpace(val)
+
+	if d, err := time.ParseDuration(val); err == nil {
+		*o = tsOffset{d: d}
+		return nil
+	}
+
+	ticks, err := strconv.ParseInt(val, 0, 64)
+	if err != nil {
+		return err
+	}
+
+	*o = tsOffset{ticks: ticks}
+	return nil
+}
+
+// Ticks returns the offset in ticks of the 90 kHz clock, converting a duration, if that is what was given.
+func (o *tsOffset) Ticks() int64 {
+	if o.d != 0 {
+		// 90 kHz is 9 ticks every 100,000 ns.
+		return int64(o.d) * 9 / 100000
+	}
+
+	return o.ticks
+}
+
+// tsOffsetter shifts every PCR base, and every PTS and DTS, in the muxed MPEG-TS by a fixed number of 90 kHz ticks,
+// so that the audio timing can be lined up with another source in a downstream mux.
+//
+// The ts.Mux takes its PCR from the wall clock, with no way to start it from anywhere else,
+// so the offset is applied to its output instead, after the pcrPacer, so that any extrapolated PCRs are shifted as well.
+type tsOffsetter struct {
+	namedWriteCloser
+
+	ticks int64
+
+	buf []byte
+}
+
+func newTSOffsetter(w namedWriteCloser, ticks int64) *tsOffsetter {
+	return &tsOffsetter{
+		namedWriteCloser: w,
+		ticks:            ticks,
+	}
+}
+
+func (w *tsOffsetter) Write(b []byte) (n int, err error) {
+	// The caller still owns b, so rewrite a copy.
+	w.buf = append(w.buf[:0], b...)
+
+	for off := 0; off+ts.PacketSize <= len(w.buf); off += ts.PacketSize {
+		w.shift(w.buf[off : off+ts.PacketSize])
+	}
+
+	return w.namedWriteCloser.Write(w.buf)
+}
+
+// shift applies the offset to the PCR, and the PTS and DTS of any PES header, within a single packet.
+func (w *tsOffsetter) shift(pkt []byte) {
+	const (
+		flagPUSI    = 0x40
+		flagAF      = 0x20
+		flagPayload = 0x10
+
+		flagPCR = 0x10
+
+		flagPTS = 0x80
+		flagDTS = 0x40
+	)
+
+	if pkt[0] != 0x47 {
+		return
+	}
+
+	switch getPID(pkt[1:]) {
+	case pidPAT, pidSDT, pidEIT, pidNull:
+		return
+	}
+
+	payload := 4
+
+	if pkt[3]&flagAF != 0 {
+		afLen := int(pkt[4])
+		if afLen >= 7 && pkt[5]&flagPCR != 0 {
+			w.shiftPCR(pkt[6:12])
+		}
+
+		payload += 1 + afLen
+	}
+
+	if pkt[1]&flagPUSI == 0 || pkt[3]&flagPayload == 0 || payload+14 > len(pkt) {
+		return
+	}
+
+	// A PES packet starts with the packet_start_code_prefix, where a PSI section would start with its pointer_field.
+	pes := pkt[payload:]
+	if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+
+	flags := pes[7]
+	if flags&flagPTS != 0 {
+		w.shiftTimestamp(pes[9:14])
+	}
+
+	if flags&flagPTS != 0 && flags&flagDTS != 0 && len(pes) >= 19 {
+		w.shiftTimestamp(pes[14:19])
+	}
+}
+
+// shiftPCR shifts the 33-bit program_clock_reference_base, leaving the reserved bits and the extension alone.
+func (w *tsOffsetter) shiftPCR(b []byte) {
+	base := uint64(b[0])<<25 | uint64(b[1])<<17 | uint64(b[2])<<9 | uint64(b[3])<<1 | uint64(b[4])>>7
+
+	base = w.add(base)
+
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7)&0x80 | b[4]&0x7F
+}
+
+// shiftTimestamp shifts a 33-bit PTS or DTS, leaving its 4-bit prefix and marker bits alone.
+func (w *tsOffsetter) shiftTimestamp(b []byte) {
+	t := uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+
+	t = w.add(t)
+
+	b[0] = b[0]&0xF1 | byte(t>>29)&0x0E
+	b[1] = byte(t >> 22)
+	b[2] = byte(t>>14)&0xFE | 0x01
+	b[3] = byte(t >> 7)
+	b[4] = byte(t<<1)&0xFE | 0x01
+}
+
+// add adds the offset to a 33-bit timestamp, wrapping around just as the timestamp itself does.
+func (w *tsOffsetter) add(t uint64) uint64 {
+	v := (int64(t) + w.ticks) % tsWrap
+	if v < 0 {
+		v += tsWrap
+	}
+
+	return uint64(v)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/metrics"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+var (
+	labelDefect = metrics.Label("defect")
+
+	tsDefects = metrics.Counter("ts_verify_defects_total", "number of defects found by --verify-ts in the muxed mpegts output", metrics.WithLabels(labelDefect))
+)
+
+// tsVerifier sits right before the sink, and with --verify-ts, re-parses every packet of the muxed MPEG-TS, checking its sync byte,
+// that its continuity_counter follows on from the last packet of its PID, and that the CRC32 of each PSI section is valid.
+//
+// The first defect is logged as an error, with the byte offset of its packet in the output, and the rest are only counted,
+// unless verbosity is at least 1.
+// A defect is never an error of the write itself, since the data is going out either way.
+type tsVerifier struct {
+	namedWriteCloser
+
+	mu     sync.Mutex
+	offset int64
+	found  bool
+
+	cc   map[uint16]byte
+	pmts map[uint16]bool
+}
+
+func newTSVerifier(w namedWriteCloser) *tsVerifier {
+	return &tsVerifier{
+		namedWriteCloser: w,
+		cc:               make(map[uint16]byte),
+		pmts:             make(map[uint16]bool),
+	}
+}
+
+func (w *tsVerifier) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	for off := 0; off+ts.PacketSize <= len(b); off += ts.PacketSize {
+		w.verify(b[off:off+ts.PacketSize], w.offset+int64(off))
+	}
+	w.offset += int64(len(b))
+	w.mu.Unlock()
+
+	return w.namedWriteCloser.Write(b)
+}
+
+// Found returns true if any defect has been found.
+func (w *tsVerifier) Found() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.found
+}
+
+// verify checks a single packet, which starts at the given offset in the output.
+//
+// Caller MUST hold the lock.
+func (w *tsVerifier) verify(pkt []byte, offset int64) {
+	const (
+		flagAF      = 0x20
+		flagPayload = 0x10
+
+		flagDiscontinuity = 0x80
+	)
+
+	if pkt[0] != 0x47 {
+		w.defect("sync", offset, fmt.Sprintf("bad sync byte 0x%02X", pkt[0]))
+		return
+	}
+
+	pid := getPID(pkt[1:])
+	if pid == pidNull {
+		return
+	}
+
+	cc := pkt[3] & 0x0F
+	hasPayload := pkt[3]&flagPayload != 0
+
+	// A set discontinuity_indicator allows the continuity_counter to start over at anything.
+	discontinuity := pkt[3]&flagAF != 0 && pkt[4] > 0 && pkt[5]&flagDiscontinuity != 0
+
+	if last, ok := w.cc[pid]; ok && !discontinuity {
+		expected := last
+		if hasPayload {
+			expected = (last + 1) & 0x0F
+		}
+
+		// A single duplicate packet is allowed to repeat the continuity_counter, but we never send any on purpose.
+		if cc != expected {
+			w.defect("continuity", offset, fmt.Sprintf("pid 0x%04X: continuity_counter %d, expected %d", pid, cc, expected))
+		}
+	}
+	w.cc[pid] = cc
+
+	switch {
+	case pid == pidPAT, pid == pidSDT, pid == pidEIT, w.pmts[pid]:
+	default:
+		return
+	}
+
+	sec := psiSection(pkt)
+	if sec == nil {
+		return
+	}
+
+	// The CRC32 of a whole section, including its own CRC32, is always zero.
+	if crc32MPEG2(sec) != 0 {
+		w.defect("crc", offset, fmt.Sprintf("pid 0x%04X: table_id 0x%02X: bad CRC32 0x%08X", pid, sec[0], binary.BigEndian.Uint32(sec[len(sec)-4:])))
+		return
+	}
+
+	if pid == pidPAT && sec[0] == tablePAT {
+		for b := sec[8 : len(sec)-4]; len(b) >= 4; b = b[4:] {
+			if binary.BigEndian.Uint16(b) != 0 {
+				w.pmts[getPID(b[2:])] = true
+			}
+		}
+	}
+}
+
+// defect records a defect found in the packet at the given offset.
+//
+// Caller MUST hold the lock.
+func (w *tsVerifier) defect(kind string, offset int64, desc string) {
+	tsDefects.WithLabels(labelDefect.WithValue(kind)).Inc()
+
+	if !w.found {
+		w.found = true
+
+		glog.Errorf("verify-ts: %s: first defect, in the packet at byte %d: %s", w.Name(), offset, desc)
+		logEvent("error", "ts-defect", "output", w.Name(), "offset", offset, "defect", kind, "error", desc)
+		return
+	}
+
+	if glog.V(1) {
+		glog.Infof("verify-ts: %s: defect, in the packet at byte %d: %s", w.Name(), offset, desc)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+	"github.com/puellanivis/breton/lib/mpeg/ts"
+)
+
+// packetSizeSetter is implemented by the datagram writers, as with socketfiles.WithPacketSize.
+type packetSizeSetter interface {
+	SetPacketSize(int) int
+}
+
+// latencySizer sets the datagram size of a udp output from --udp-latency, when the first data is written to it.
+//
+// The outputs are opened before we have connected to the stream, so its bitrate is not known until then.
+type latencySizer struct {
+	namedWriteCloser
+
+	max  int
+	once sync.Once
+}
+
+// newLatencySizer wraps a udp output, so that it sends datagrams that fill within --udp-latency, but no larger than maxSize.
+func newLatencySizer(w namedWriteCloser, maxSize int) namedWriteCloser {
+	if _, ok := w.(packetSizeSetter); !ok {
+		glog.Warningf("%s: --udp-latency is not supported by this output", w.Name())
+		return w
+	}
+
+	return &latencySizer{
+		namedWriteCloser: w,
+		max:              maxSize,
+	}
+}
+
+// latencyPacketSize returns the number of bytes of mpegts that the output sends within --udp-latency,
+// in whole mpegts packets, from one packet up to maxSize.
+func latencyPacketSize(maxSize int) int {
+	bps := float64(Flags.TSMuxRate)
+	if bps <= 0 {
+		bps = streamBitrate()
+		if bps <= 0 {
+			bps = defaultBitrate
+		}
+
+		bps *= muxOverhead
+	}
+
+	size := int(Flags.UDPLatency.Seconds() * bps / 8)
+	size -= size % ts.PacketSize
+
+	if size > maxSize {
+		size = maxSize
+	}
+
+	if size < ts.PacketSize {
+		size = ts.PacketSize
+	}
+
+	return size
+}
+
+func (w *latencySizer) Write(b []byte) (n int, err error) {
+	w.once.Do(func() {
+		size := latencyPacketSize(w.max)
+
+		w.namedWriteCloser.(packetSizeSetter).SetPacketSize(size)
+
+		if glog.V(1) {
+			glog.Infof("%s: --udp-latency %v: sending %d bytes per datagram", w.Name(), Flags.UDPLatency, size)
+		}
+	})
+
+	return w.namedWriteCloser.Write(b)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// isUnixScheme returns true if the given URL scheme is one of the unix domain socket schemes.
+func isUnixScheme(scheme string) bool {
+	return scheme == "unix" || scheme == "unixgram"
+}
+
+// removeStaleSocket removes a unix socket file left behind by an earlier run, so that we can bind to it again.
+//
+// Anything that is not a socket is left alone.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		glog.Warningf("%s: %+v", path, err)
+	}
+}
+
+// unixSocketWriter wraps a unix domain socket output that is bound to a local address,
+// and removes the socket file of that local address when it is closed.
+type unixSocketWriter struct {
+	namedWriteCloser
+
+	laddr string
+}
+
+func (w *unixSocketWriter) Close() error {
+	err := w.namedWriteCloser.Close()
+
+	if err2 := os.Remove(w.laddr); err2 != nil && !os.IsNotExist(err2) && err == nil {
+		err = err2
+	}
+
+	return err
+}
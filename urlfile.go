@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// urlFileEntry is a stream URL read from the --url-file, which is only ever logged by its masked name.
+type urlFileEntry struct {
+	name   string
+	header http.Header
+}
+
+var urlFile struct {
+	sync.Mutex
+	entries map[string]*urlFileEntry
+}
+
+// loadURLFile reads the stream URLs from the --url-file, and returns them, in order.
+//
+// Each line is a URL, which may include credentials as user:password@, and the indented lines after it are
+// "Key: Value" headers that are sent only to that URL, e.g. an Authorization header.
+// Blank lines, and lines starting with # are ignored.
+func loadURLFile(ctx context.Context, filename string) ([]string, error) {
+	if path, ok := localPath(filename); ok {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+			glog.Warningf("--url-file: %s: is readable by other users, its mode is %v", filename, fi.Mode().Perm())
+		}
+	}
+
+	b, err := files.Read(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	urlFile.Lock()
+	defer urlFile.Unlock()
+
+	urlFile.entries = make(map[string]*urlFileEntry)
+
+	var urls []string
+	var cur *urlFileEntry
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; s.Scan(); lineno++ {
+		line := s.Text()
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			uri, err := url.Parse(trimmed)
+			if err != nil || uri.Scheme == "" {
+				// Do not quote the line, since it may well hold a secret.
+				return nil, errors.Errorf("--url-file: %s: line %d: not a URL", filename, lineno)
+			}
+
+			cur = &urlFileEntry{
+				name: fmt.Sprintf("%s://%s/[url-file #%d]", uri.Scheme, uri.Hostname(), len(urls)+1),
+			}
+
+			urlFile.entries[trimmed] = cur
+			urls = append(urls, trimmed)
+			continue
+		}
+
+		key, val, ok := strings.Cut(trimmed, ":")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+
+		switch {
+		case cur == nil:
+			return nil, errors.Errorf("--url-file: %s: line %d: header before any URL", filename, lineno)
+		case !ok || !isHeaderToken(key) || strings.ContainsAny(val, "\r\n\x00"):
+			return nil, errors.Errorf("--url-file: %s: line %d: header must be of the form \"Key: Value\"", filename, lineno)
+		}
+
+		if cur.header == nil {
+			cur.header = make(http.Header)
+		}
+		cur.header.Add(textproto.CanonicalMIMEHeaderKey(key), val)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(urls) < 1 {
+		return nil, errors.Errorf("--url-file: %s: no URLs found", filename)
+	}
+
+	return urls, nil
+}
+
+// lookupURLFile returns the --url-file entry of the given stream URL, or nil if it did not come from the --url-file.
+func lookupURLFile(filename string) *urlFileEntry {
+	urlFile.Lock()
+	defer urlFile.Unlock()
+
+	return urlFile.entries[filename]
+}
+
+// maskedError replaces the URL of a source in the message of an error, while still unwrapping to the original error.
+type maskedError struct {
+	err error
+	msg string
+}
+
+func maskError(err error, src source) error {
+	if err == nil || src.name == "" {
+		return err
+	}
+
+	msg := err.Error()
+	for _, secret := range src.secrets() {
+		msg = strings.ReplaceAll(msg, secret, src.name)
+	}
+
+	return &maskedError{
+		err: err,
+		msg: msg,
+	}
+}
+
+func (e *maskedError) Error() string { return e.msg }
+func (e *maskedError) Unwrap() error { return e.err }
+func (e *maskedError) Cause() error  { return errors.Cause(e.err) }
+
+// maskedReader reports the masked name of a --url-file source, rather than its URL.
+type maskedReader struct {
+	files.Reader
+	name string
+}
+
+func (r *maskedReader) Name() string {
+	return r.name
+}
+
+func (r *maskedReader) Stat() (os.FileInfo, error) {
+	info, err := r.Reader.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return maskedInfo{info, r.name}, nil
+}
+
+// maskedHeaderReader is a maskedReader of a stream that has headers.
+type maskedHeaderReader struct {
+	*maskedReader
+	headerer
+}
+
+type maskedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i maskedInfo) Name() string {
+	return i.name
+}
+
+// maskReader wraps f, so that it reports the masked name of its --url-file source, if it came from one.
+func maskReader(f files.Reader, src source) files.Reader {
+	if src.name == "" {
+		return f
+	}
+
+	r := &maskedReader{
+		Reader: f,
+		name:   src.name,
+	}
+
+	if h, ok := f.(headerer); ok {
+		return &maskedHeaderReader{r, h}
+	}
+
+	return r
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/puellanivis/breton/lib/files"
+	"github.com/puellanivis/breton/lib/files/httpfiles"
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// browserUserAgents is the pool that --user-agent-random picks from, if no --user-agent-file is given.
+var browserUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+	"VLC/3.0.20 LibVLC/3.0.20",
+}
+
+// userAgents is the list of User-Agents that each reconnect rotates through.
+// If the list is empty, then --user-agent is always used.
+var userAgents struct {
+	sync.Mutex
+	list []string
+	next int
+}
+
+// loadUserAgents sets up the User-Agent rotation from --user-agent-file and --user-agent-random.
+func loadUserAgents(ctx context.Context) error {
+	var list []string
+
+	if Flags.UserAgentFile != "" {
+		b, err := files.Read(ctx, Flags.UserAgentFile)
+		if err != nil {
+			return err
+		}
+
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			list = append(list, line)
+		}
+
+		if err := s.Err(); err != nil {
+			return err
+		}
+
+		if len(list) < 1 {
+			return errors.Errorf("%s: no User-Agents found", Flags.UserAgentFile)
+		}
+	}
+
+	if Flags.UserAgentRandom {
+		if list == nil {
+			list = append([]string(nil), browserUserAgents...)
+		}
+
+		rand.Shuffle(len(list), func(i, j int) {
+			list[i], list[j] = list[j], list[i]
+		})
+	}
+
+	userAgents.Lock()
+	defer userAgents.Unlock()
+
+	userAgents.list = list
+	userAgents.next = 0
+
+	return nil
+}
+
+// nextUserAgent returns the next User-Agent to connect with.
+func nextUserAgent() string {
+	userAgents.Lock()
+	defer userAgents.Unlock()
+
+	if len(userAgents.list) < 1 {
+		return Flags.UserAgent
+	}
+
+	ua := userAgents.list[userAgents.next]
+	userAgents.next = (userAgents.next + 1) % len(userAgents.list)
+
+	return ua
+}
+
+// withNextUserAgent returns a context that connects with the next User-Agent in the rotation.
+func withNextUserAgent(ctx context.Context) context.Context {
+	ua := nextUserAgent()
+
+	if glog.V(2) {
+		glog.Infof("User-Agent: %s", ua)
+	}
+
+	return httpfiles.WithUserAgent(ctx, ua)
+}
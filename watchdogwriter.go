@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errOutputStalled is returned when a write to the output has not completed within --output-timeout.
+var errOutputStalled = errors.New("output stalled")
+
+type writeResult struct {
+	n   int
+	err error
+}
+
+// watchdogWriter performs the writes to its underlying io.WriteCloser in a separate goroutine,
+// so that a write which blocks for longer than the timeout returns errOutputStalled, rather than hanging forever.
+//
+// While a stalled write remains outstanding, all further writes fail immediately with errOutputStalled.
+// Once the stalled write finally completes, writes resume as normal.
+type watchdogWriter struct {
+	io.WriteCloser
+
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending chan writeResult
+}
+
+func newWatchdogWriter(w io.WriteCloser, timeout time.Duration) *watchdogWriter {
+	return &watchdogWriter{
+		WriteCloser: w,
+		timeout:     timeout,
+	}
+}
+
+func (w *watchdogWriter) Write(b []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending != nil {
+		select {
+		case <-w.pending:
+			// The stalled write has finally completed, we can move on.
+			w.pending = nil
+		default:
+			return 0, errOutputStalled
+		}
+	}
+
+	// The caller is allowed to reuse b as soon as we return, so we need our own copy.
+	buf := append([]byte(nil), b...)
+	done := make(chan writeResult, 1)
+
+	go func() {
+		n, err := w.WriteCloser.Write(buf)
+		done <- writeResult{n, err}
+	}()
+
+	t := time.NewTimer(w.timeout)
+	defer t.Stop()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+
+	case <-t.C:
+		w.pending = done
+		return 0, errors.Wrapf(errOutputStalled, "no progress in %v", w.timeout)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/puellanivis/breton/lib/glog"
+)
+
+// playerHLSPath is where the --web-player serves the playlist and segments of the hls output from.
+const playerHLSPath = "/player/hls/"
+
+var playerStream struct {
+	sync.Mutex
+	url string
+}
+
+// setPlayerStream records the URL of the stream that we are currently copying, for the --web-player to play,
+// if there is no hls output to play instead.
+func setPlayerStream(url string) {
+	playerStream.Lock()
+	defer playerStream.Unlock()
+
+	playerStream.url = url
+}
+
+// currentPlayerStream returns the URL of the stream that we are currently copying.
+func currentPlayerStream() string {
+	playerStream.Lock()
+	defer playerStream.Unlock()
+
+	return playerStream.url
+}
+
+// nowPlayingInfo is the JSON structure served by the --web-player at /player/nowplaying.
+type nowPlayingInfo struct {
+	Title  string  `json:"title"`
+	Stream string  `json:"stream,omitempty"`
+	Up     bool    `json:"up"`
+	Since  float64 `json:"seconds_since_data,omitempty"`
+}
+
+var playerPage = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>icycat</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+#title { font-size: 1.5em; margin: 1em 0; }
+#status { color: #888; }
+</style>
+</head>
+<body>
+<div id="title">…</div>
+<audio id="audio" controls></audio>
+<div id="status"></div>
+<script>
+var audio = document.getElementById("audio");
+{{if .HLS}}
+var src = {{.HLS}};
+if (audio.canPlayType("application/vnd.apple.mpegurl")) {
+	audio.src = src;
+} else {
+	var s = document.createElement("script");
+	s.src = "https://cdn.jsdelivr.net/npm/hls.js@1";
+	s.onload = function() {
+		var hls = new Hls();
+		hls.loadSource(src);
+		hls.attachMedia(audio);
+	};
+	document.head.appendChild(s);
+}
+{{end}}
+var stream = "";
+function update() {
+	fetch("nowplaying").then(function(resp) { return resp.json(); }).then(function(np) {
+		document.getElementById("title").textContent = np.title || "(no title)";
+		document.getElementById("status").textContent = np.up ? "streaming" : "not streaming";
+{{if not .HLS}}
+		if (np.stream && np.stream !== stream) {
+			stream = np.stream;
+			audio.src = stream;
+		}
+{{end}}
+	}).catch(function(err) {
+		document.getElementById("status").textContent = "icycat unreachable: " + err;
+	});
+}
+update();
+setInterval(update, 5000);
+</script>
+</body>
+</html>
+`))
+
+// registerPlayerHandlers adds the --web-player pages to the default http.ServeMux.
+//
+// If playlist is not empty, then the player plays that hls output, and its playlist and segments are served as well.
+// Otherwise, the browser connects straight to the stream that we are copying.
+func registerPlayerHandlers(playlist string) {
+	var hlsURL string
+	if playlist != "" {
+		hlsURL = playerHLSPath + filepath.Base(playlist)
+	}
+
+	http.HandleFunc("/player", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/player/", http.StatusMovedPermanently)
+	})
+
+	http.HandleFunc("/player/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/player/" {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		if err := playerPage.Execute(w, struct{ HLS string }{hlsURL}); err != nil {
+			glog.Errorf("--web-player: %+v", err)
+		}
+	})
+
+	http.HandleFunc("/player/nowplaying", func(w http.ResponseWriter, req *http.Request) {
+		info := &nowPlayingInfo{
+			Title: StreamTitle(),
+			Up:    isReady(),
+		}
+
+		if playlist == "" {
+			info.Stream = currentPlayerStream()
+		}
+
+		if since, ok := sinceLastData(); ok {
+			info.Since = since.Seconds()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			glog.Errorf("--web-player: %+v", err)
+		}
+	})
+
+	if playlist == "" {
+		return
+	}
+
+	dir := filepath.Dir(playlist)
+	base := filepath.Base(playlist)
+	prefix := strings.TrimSuffix(base, ".m3u8") + "-"
+
+	http.HandleFunc(playerHLSPath, func(w http.ResponseWriter, req *http.Request) {
+		name := path.Base(req.URL.Path)
+
+		// Only serve the hls output itself, and not anything else that happens to be in its directory.
+		switch {
+		case name == base:
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+		case strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".ts"):
+			w.Header().Set("Content-Type", "video/mp2t")
+		default:
+			http.NotFound(w, req)
+			return
+		}
+
+		http.ServeFile(w, req, filepath.Join(dir, name))
+	})
+}